@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/bubu256/gophermart_pet/pkg/logger"
+)
+
+func main() {
+	log := logger.New()
+	var address string
+	settings := Settings{}
+	flag.StringVar(&address, "a", "localhost:8081", "Address to start the accrual mock")
+	flag.StringVar(&settings.ScenarioPath, "scenario", "", "Path to JSON scenario with status progressions per order")
+	flag.BoolVar(&settings.Auto, "auto", true, "Unknown orders go REGISTERED -> PROCESSING -> PROCESSED (otherwise 204)")
+	var maxAccrual float64
+	flag.Float64Var(&maxAccrual, "max-accrual", 1000, "Max random accrual for auto scenario")
+	flag.DurationVar(&settings.LatencyMin, "latency-min", 0, "Min response latency")
+	flag.DurationVar(&settings.LatencyMax, "latency-max", 0, "Max response latency")
+	flag.Float64Var(&settings.NoContent, "no-content-rate", 0, "Probability of 204 answer")
+	flag.Float64Var(&settings.ServerError, "error-rate", 0, "Probability of 500 answer")
+	flag.IntVar(&settings.RateLimit, "rate-limit", 0, "Requests per minute before 429 (0 - unlimited)")
+	flag.IntVar(&settings.RetryAfter, "retry-after", 60, "Retry-After seconds in 429 answer (0 - until the end of the minute)")
+	flag.Parse()
+	settings.MaxAccrual = float32(maxAccrual)
+
+	mock, err := NewMock(settings, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("некорректные настройки или сценарий имитатора;")
+	}
+	log.Info().Msgf("Запуск имитатора аккрол сервиса: %s", address)
+	err = http.ListenAndServe(address, mock.Router())
+	if err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+// имитатор системы расчета баллов: GET /api/orders/{number} по SPECIFICATION.md
+
+// шаг сценария заказа: либо код ответа без тела (204, 500), либо статус с начислением
+type Step struct {
+	Code    int                  `json:"code,omitempty"`
+	Status  schema.AccrualStatus `json:"status,omitempty"`
+	Accrual float32              `json:"accrual,omitempty"`
+}
+
+// сценарий: последовательность ответов по каждому заказу.
+// каждый запрос заказа переходит к следующему шагу, последний шаг повторяется
+type Scenario struct {
+	Orders map[string][]Step `json:"orders"`
+}
+
+type Settings struct {
+	Auto         bool          // незнакомые заказы проходят REGISTERED -> PROCESSING -> PROCESSED
+	MaxAccrual   float32       // максимальное случайное начисление в автоматическом сценарии
+	LatencyMin   time.Duration // случайная задержка ответа от LatencyMin до LatencyMax
+	LatencyMax   time.Duration
+	NoContent    float64 // вероятность ответа 204 вместо шага сценария
+	ServerError  float64 // вероятность ответа 500 вместо шага сценария
+	RateLimit    int     // запросов в минуту, сверх лимита ответ 429; 0 - без ограничения
+	RetryAfter   int     // значение заголовка Retry-After в секундах, 0 - до конца текущей минуты
+	ScenarioPath string
+}
+
+type Mock struct {
+	settings Settings
+	logger   zerolog.Logger
+
+	mu       sync.Mutex
+	scenario Scenario
+	calls    map[string]int
+	rnd      *rand.Rand
+	window   time.Time // начало текущей минуты ограничения запросов
+	requests int       // запросов в текущей минуте
+}
+
+func NewMock(settings Settings, logger zerolog.Logger) (*Mock, error) {
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+	m := &Mock{
+		settings: settings,
+		logger:   logger,
+		scenario: Scenario{Orders: make(map[string][]Step)},
+		calls:    make(map[string]int),
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if settings.ScenarioPath != "" {
+		data, err := os.ReadFile(settings.ScenarioPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &m.scenario); err != nil {
+			return nil, fmt.Errorf("сценарий %s: %w", settings.ScenarioPath, err)
+		}
+		// "orders": null в файле сценария
+		if m.scenario.Orders == nil {
+			m.scenario.Orders = make(map[string][]Step)
+		}
+		for number, steps := range m.scenario.Orders {
+			if len(steps) == 0 {
+				return nil, fmt.Errorf("сценарий %s: у заказа %s нет шагов", settings.ScenarioPath, number)
+			}
+		}
+	}
+	return m, nil
+}
+
+// проверяет настройки, с которыми имитатор не может отвечать
+func (s Settings) validate() error {
+	switch {
+	case s.MaxAccrual < 0:
+		return fmt.Errorf("максимальное начисление не может быть отрицательным: %v", s.MaxAccrual)
+	case s.LatencyMin < 0 || s.LatencyMax < s.LatencyMin:
+		return fmt.Errorf("некорректная задержка ответа: от %s до %s", s.LatencyMin, s.LatencyMax)
+	case s.NoContent < 0 || s.NoContent > 1:
+		return fmt.Errorf("вероятность ответа 204 должна быть от 0 до 1: %v", s.NoContent)
+	case s.ServerError < 0 || s.ServerError > 1:
+		return fmt.Errorf("вероятность ответа 500 должна быть от 0 до 1: %v", s.ServerError)
+	}
+	return nil
+}
+
+func (m *Mock) Router() *chi.Mux {
+	router := chi.NewRouter()
+	router.Get("/api/orders/{number}", m.GetOrder)
+	return router
+}
+
+// Хендлер: GET /api/orders/{number}
+func (m *Mock) GetOrder(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+	latency, retryAfter, limited, step := m.plan(number)
+
+	time.Sleep(latency)
+	if limited {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "No more than %d requests per minute allowed", m.settings.RateLimit)
+		m.logger.Debug().Msgf("%s -> 429", number)
+		return
+	}
+	if step.Code != 0 && step.Code != http.StatusOK {
+		w.WriteHeader(step.Code)
+		m.logger.Debug().Msgf("%s -> %d", number, step.Code)
+		return
+	}
+	answer := schema.AnswerAccrualService{Order: number, Status: step.Status, Accrual: step.Accrual}
+	body, err := json.Marshal(answer)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	m.logger.Debug().Msgf("%s -> %s %v", number, answer.Status, answer.Accrual)
+}
+
+// выбирает задержку и ответ на запрос заказа под блокировкой
+func (m *Mock) plan(number string) (latency time.Duration, retryAfter int, limited bool, step Step) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	latency = m.latency()
+	retryAfter, limited = m.limit()
+	if !limited {
+		step = m.next(number)
+	}
+	return latency, retryAfter, limited, step
+}
+
+// считает запрос в текущей минуте, возвращает Retry-After если лимит превышен
+func (m *Mock) limit() (int, bool) {
+	if m.settings.RateLimit <= 0 {
+		return 0, false
+	}
+	now := time.Now()
+	if now.Sub(m.window) >= time.Minute {
+		m.window = now.Truncate(time.Minute)
+		m.requests = 0
+	}
+	m.requests++
+	if m.requests <= m.settings.RateLimit {
+		return 0, false
+	}
+	retryAfter := m.settings.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = int(m.window.Add(time.Minute).Sub(now).Seconds()) + 1
+	}
+	return retryAfter, true
+}
+
+// следующий шаг сценария заказа с учетом случайных 204 и 500
+func (m *Mock) next(number string) Step {
+	switch p := m.rnd.Float64(); {
+	case p < m.settings.NoContent:
+		return Step{Code: http.StatusNoContent}
+	case p < m.settings.NoContent+m.settings.ServerError:
+		return Step{Code: http.StatusInternalServerError}
+	}
+	steps, ok := m.scenario.Orders[number]
+	if !ok {
+		if !m.settings.Auto {
+			return Step{Code: http.StatusNoContent}
+		}
+		steps = m.autoScenario()
+		m.scenario.Orders[number] = steps
+	}
+	call := m.calls[number]
+	m.calls[number]++
+	if call >= len(steps) {
+		call = len(steps) - 1
+	}
+	return steps[call]
+}
+
+// сценарий для незнакомого заказа: регистрация, расчет и начисление
+// либо отказ в расчете для каждого десятого заказа
+func (m *Mock) autoScenario() []Step {
+	if m.rnd.Intn(10) == 0 {
+		return []Step{{Status: schema.AccrualStatusRegistered}, {Status: schema.AccrualStatusInvalid}}
+	}
+	accrual := float32(m.rnd.Intn(int(m.settings.MaxAccrual*100)+1)) / 100
+	return []Step{
+		{Status: schema.AccrualStatusRegistered},
+		{Status: schema.AccrualStatusProcessing},
+		{Status: schema.AccrualStatusProcessed, Accrual: accrual},
+	}
+}
+
+// случайная задержка ответа
+func (m *Mock) latency() time.Duration {
+	if m.settings.LatencyMax <= m.settings.LatencyMin {
+		return m.settings.LatencyMin
+	}
+	return m.settings.LatencyMin + time.Duration(m.rnd.Int63n(int64(m.settings.LatencyMax-m.settings.LatencyMin)))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/rs/zerolog"
+)
+
+// ответ имитатора на один запрос заказа
+type response struct {
+	code       int
+	retryAfter string
+	answer     schema.AnswerAccrualService
+}
+
+func newTestMock(t *testing.T, settings Settings) *Mock {
+	t.Helper()
+	m, err := NewMock(settings, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewMock: %v", err)
+	}
+	return m
+}
+
+func request(t *testing.T, m *Mock, number string) response {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	m.Router().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/orders/"+number, nil))
+	result := response{code: recorder.Code, retryAfter: recorder.Header().Get("Retry-After")}
+	if recorder.Code == http.StatusOK {
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", contentType)
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result.answer); err != nil {
+			t.Fatalf("body %s: %v", recorder.Body.String(), err)
+		}
+	}
+	return result
+}
+
+func TestScriptedProgression(t *testing.T) {
+	m := newTestMock(t, Settings{ScenarioPath: writeScenario(t, `{"orders": {"12345678903": [
+		{"status": "REGISTERED"},
+		{"code": 500},
+		{"status": "PROCESSING"},
+		{"status": "PROCESSED", "accrual": 729.98}
+	]}}`)})
+
+	want := []response{
+		{code: http.StatusOK, answer: schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusRegistered}},
+		{code: http.StatusInternalServerError},
+		{code: http.StatusOK, answer: schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusProcessing}},
+		{code: http.StatusOK, answer: schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusProcessed, Accrual: 729.98}},
+		// последний шаг повторяется
+		{code: http.StatusOK, answer: schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusProcessed, Accrual: 729.98}},
+	}
+	for i, w := range want {
+		if got := request(t, m, "12345678903"); got != w {
+			t.Errorf("request %d = %+v, want %+v", i+1, got, w)
+		}
+	}
+	// заказа нет в сценарии, автоматический сценарий выключен
+	if got := request(t, m, "2377225624"); got.code != http.StatusNoContent {
+		t.Errorf("unknown order code = %d, want 204", got.code)
+	}
+}
+
+func TestAutoScenario(t *testing.T) {
+	m := newTestMock(t, Settings{Auto: true, MaxAccrual: 100})
+	for i := 0; i < 20; i++ {
+		number := strconv.Itoa(1000 + i)
+		first := request(t, m, number)
+		if first.code != http.StatusOK || first.answer.Status != schema.AccrualStatusRegistered {
+			t.Fatalf("order %s first answer = %+v, want REGISTERED", number, first)
+		}
+		var last response
+		for j := 0; j < 3; j++ {
+			last = request(t, m, number)
+		}
+		switch last.answer.Status {
+		case schema.AccrualStatusProcessed:
+			if last.answer.Accrual < 0 || last.answer.Accrual > 100 {
+				t.Errorf("order %s accrual = %v, want within MaxAccrual", number, last.answer.Accrual)
+			}
+		case schema.AccrualStatusInvalid:
+		default:
+			t.Errorf("order %s final answer = %+v, want PROCESSED or INVALID", number, last)
+		}
+	}
+}
+
+func TestInjectedFailures(t *testing.T) {
+	cases := map[string]struct {
+		settings Settings
+		code     int
+	}{
+		"no failures":       {Settings{Auto: true, MaxAccrual: 100}, http.StatusOK},
+		"always 204":        {Settings{Auto: true, MaxAccrual: 100, NoContent: 1}, http.StatusNoContent},
+		"always 500":        {Settings{Auto: true, MaxAccrual: 100, ServerError: 1}, http.StatusInternalServerError},
+		"204 before 500":    {Settings{Auto: true, MaxAccrual: 100, NoContent: 1, ServerError: 1}, http.StatusNoContent},
+		"unknown order 204": {Settings{}, http.StatusNoContent},
+	}
+	for name, tc := range cases {
+		m := newTestMock(t, tc.settings)
+		for i := 0; i < 10; i++ {
+			if got := request(t, m, "12345678903"); got.code != tc.code {
+				t.Errorf("%s: request %d code = %d, want %d", name, i+1, got.code, tc.code)
+				break
+			}
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	m := newTestMock(t, Settings{Auto: true, MaxAccrual: 100, RateLimit: 2, RetryAfter: 7})
+	for i := 0; i < 2; i++ {
+		if got := request(t, m, "12345678903"); got.code != http.StatusOK {
+			t.Fatalf("request %d code = %d, want 200 within the limit", i+1, got.code)
+		}
+	}
+	got := request(t, m, "12345678903")
+	if got.code != http.StatusTooManyRequests || got.retryAfter != "7" {
+		t.Errorf("request over the limit = %+v, want 429 with Retry-After 7", got)
+	}
+	// запрос сверх лимита не продвигает сценарий заказа
+	if calls := m.calls["12345678903"]; calls != 2 {
+		t.Errorf("scenario advanced %d times, want 2", calls)
+	}
+
+	// без RetryAfter ожидание до конца текущей минуты
+	m = newTestMock(t, Settings{Auto: true, MaxAccrual: 100, RateLimit: 1})
+	request(t, m, "12345678903")
+	got = request(t, m, "12345678903")
+	retryAfter, err := strconv.Atoi(got.retryAfter)
+	if got.code != http.StatusTooManyRequests || err != nil || retryAfter < 1 || retryAfter > 61 {
+		t.Errorf("request over the limit = %+v, want 429 with Retry-After up to the end of the minute", got)
+	}
+}
+
+// пишет сценарий во временный файл и возвращает путь к нему
+func writeScenario(t *testing.T, scenario string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "scenario.json")
+	if err := os.WriteFile(path, []byte(scenario), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestInvalidSettings(t *testing.T) {
+	cases := map[string]Settings{
+		"empty step list":       {ScenarioPath: writeScenario(t, `{"orders": {"12345678903": []}}`)},
+		"negative max accrual":  {Auto: true, MaxAccrual: -1},
+		"latency max below min": {LatencyMin: time.Second, LatencyMax: time.Millisecond},
+		"negative latency":      {LatencyMin: -time.Second},
+		"negative 204 rate":     {NoContent: -0.1},
+		"204 rate above 1":      {NoContent: 1.5},
+		"negative 500 rate":     {ServerError: -0.1},
+		"500 rate above 1":      {ServerError: 1.5},
+	}
+	for name, settings := range cases {
+		if _, err := NewMock(settings, zerolog.Nop()); err == nil {
+			t.Errorf("%s: NewMock accepted invalid settings", name)
+		}
+	}
+}
+
+func TestNullOrdersInAutoMode(t *testing.T) {
+	m := newTestMock(t, Settings{Auto: true, MaxAccrual: 100, ScenarioPath: writeScenario(t, `{"orders": null}`)})
+	for i := 0; i < 2; i++ {
+		if got := request(t, m, "12345678903"); got.code != http.StatusOK {
+			t.Errorf("request %d code = %d, want 200 from auto scenario", i+1, got.code)
+		}
+	}
+}
+
+// паника при выборе ответа не оставляет имитатор заблокированным
+func TestPanicReleasesLock(t *testing.T) {
+	m := newTestMock(t, Settings{})
+	m.scenario.Orders["12345678903"] = []Step{}
+	func() {
+		defer func() { recover() }()
+		m.plan("12345678903")
+	}()
+	done := make(chan struct{})
+	go func() {
+		request(t, m, "2377225624")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("mock is locked after a panic in a previous request")
+	}
+}
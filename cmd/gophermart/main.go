@@ -1,32 +1,90 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/accrual/client"
 	"github.com/bubu256/gophermart_pet/internal/accrual/worker"
+	"github.com/bubu256/gophermart_pet/internal/balancecheck"
+	"github.com/bubu256/gophermart_pet/internal/expiration"
 	"github.com/bubu256/gophermart_pet/internal/handlers"
+	"github.com/bubu256/gophermart_pet/internal/health"
 	"github.com/bubu256/gophermart_pet/internal/mediator"
+	"github.com/bubu256/gophermart_pet/internal/metrics"
+	"github.com/bubu256/gophermart_pet/internal/pubsub"
+	"github.com/bubu256/gophermart_pet/internal/reload"
+	"github.com/bubu256/gophermart_pet/internal/tracing"
+	"github.com/bubu256/gophermart_pet/internal/webhook"
 	"github.com/bubu256/gophermart_pet/pkg/logger"
+	"github.com/bubu256/gophermart_pet/pkg/storage/backend"
 	"github.com/bubu256/gophermart_pet/pkg/storage/postgres"
-	"github.com/rs/zerolog"
 )
 
 func main() {
-	zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	log := logger.New()
-	log.Info().Msg("Start application")
+	// до загрузки конфигурации пишем в JSON с уровнем info
+	bootstrap := logger.New()
 
-	cfg := config.New(log)
-	cfg.LoadFromFlag() // загрузка параметров из флагов запуска или значения по умолчанию
-	cfg.LoadFromEnv()  // загрузка параметров из переменных окружения
-	db := postgres.New(cfg.DataBase, log)
-	mediator := mediator.New(db, cfg.Mediator, log)
-	worker.Run(db, log, cfg.Worker)
-	handler := handlers.New(mediator, cfg.Server, log)
+	// значения по умолчанию < файл конфигурации < переменные окружения < флаги запуска
+	cfg, err := config.Load(os.Args[1:], os.Environ())
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		bootstrap.Fatal().Err(err).Msg("не удалось загрузить конфигурацию; error is here 7730128")
+	}
+	if cfg.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			bootstrap.Fatal().Err(err).Msg("не удалось вывести конфигурацию; error is here 7730129")
+		}
+		return
+	}
+	log, err := logger.NewWithConfig(cfg.Log)
+	if err != nil {
+		bootstrap.Fatal().Err(err).Msg("некорректная конфигурация логов; error is here 7730127")
+	}
+	if len(cfg.Args) > 0 {
+		if err := runCommand(cfg, log); err != nil {
+			log.Fatal().Err(err).Msg("ошибка выполнения команды; error is here 7730130")
+		}
+		return
+	}
+	log.Info().Msg("Start application")
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		log.Fatal().Err(err).Msg("не удалось настроить трассировку; error is here 7730125")
+	}
+	db := backend.New(cfg.DataBase, log)
+	if pdb, ok := db.(*postgres.PosgresDB); ok {
+		metrics.RegisterDB(pdb.DB)
+	}
+	broker := pubsub.New()
+	pubsub.Run(db, broker, log)
+	// настройки, которые меняются без перезапуска по SIGHUP или изменению файла конфигурации
+	live := config.NewLive(cfg.Runtime())
+	reload.Run(cfg, os.Args[1:], live, log)
+	mediator := mediator.New(db, broker, cfg.Mediator, cfg.Expiration, live, log)
+	accrualClient := client.NewHTTP(cfg.Worker, log, metrics.ObserveBreakerState)
+	accrualWorker := worker.Run(db, accrualClient, log, cfg.Worker, live)
+	balancecheck.Run(db, log, cfg.BalanceCheck)
+	expiration.Run(db, log, cfg.Expiration)
+	webhook.Run(db, log, cfg.Webhook)
+	handler := handlers.New(mediator, accrualWorker, health.New(db, accrualWorker, cfg.Health), cfg.Server, log)
 	log.Info().Msgf("Запуск сервера: %s", cfg.Server.RunAddress)
-	err := http.ListenAndServe(cfg.Server.RunAddress, handler.Router)
+	err = http.ListenAndServe(cfg.Server.RunAddress, handler.Router)
+	// отправляем накопленные спаны до выхода
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Error().Err(err).Msg("ошибка при остановке трассировки; error is here 7730126")
+	}
+	// останавливаем проверку реплик и закрываем соединения с БД любого хранилища
+	if closer, ok := db.(interface{ Close() }); ok {
+		closer.Close()
+	}
 	if err != nil {
 		log.Fatal().Err(err)
 	}
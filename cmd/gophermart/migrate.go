@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/pkg/storage/backend"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/rs/zerolog"
+)
+
+const migrateUsage = "usage: gophermart [flags] migrate up|down [steps]|status|force <version>"
+
+// выполняет подкоманду вместо запуска сервера
+func runCommand(cfg config.Configuration, log zerolog.Logger) error {
+	switch cfg.Args[0] {
+	case "migrate":
+		return runMigrate(cfg.DataBase, cfg.Args[1:], log)
+	}
+	return fmt.Errorf("unknown command %q; %s", cfg.Args[0], migrateUsage)
+}
+
+// gophermart migrate up|down [steps]|status|force <version>
+func runMigrate(cfg config.CfgDataBase, args []string, log zerolog.Logger) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	migrator, err := backend.NewMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	switch args[0] {
+	case "up":
+		err = migrator.Up()
+		if errors.Is(err, migrate.ErrNoChange) {
+			log.Info().Msg("Миграция БД не требуется;")
+			return nil
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil {
+				return fmt.Errorf("invalid steps %q; %s", args[1], migrateUsage)
+			}
+		}
+		err = migrator.Down(steps)
+	case "status":
+		// состояние выводится и после выполнения остальных команд
+	case "force":
+		if len(args) < 2 {
+			return errors.New(migrateUsage)
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return fmt.Errorf("invalid version %q; %s", args[1], migrateUsage)
+		}
+		err = migrator.Force(version)
+	default:
+		return fmt.Errorf("unknown migrate command %q; %s", args[0], migrateUsage)
+	}
+	if err != nil {
+		return err
+	}
+
+	status, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("версия схемы БД %d, последняя миграция %d, dirty %v;", status.Version, status.Expected, status.Dirty)
+	return nil
+}
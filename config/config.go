@@ -1,75 +1,193 @@
 package config
 
 import (
-	"flag"
-
-	"github.com/caarlos0/env/v6"
-	"github.com/rs/zerolog"
+	"strings"
+	"time"
 )
 
 //
 /* конфигурации приложения */
 
-func New(logger zerolog.Logger) Configuration {
-
-	return Configuration{logger: logger}
-}
+// значения по умолчанию задаются только в тегах envDefault,
+// порядок применения источников описан в Load
 
 type Configuration struct {
-	DataBase CfgDataBase
-	Server   CfgServer
-	Mediator CfgMediator
-	Worker   CfgAccrualWorker
-	logger   zerolog.Logger
+	DataBase     CfgDataBase      `yaml:"database"`
+	Server       CfgServer        `yaml:"server"`
+	Mediator     CfgMediator      `yaml:"mediator"`
+	Worker       CfgAccrualWorker `yaml:"accrual"`
+	BalanceCheck CfgBalanceCheck  `yaml:"balance_check"`
+	Expiration   CfgExpiration    `yaml:"expiration"`
+	Webhook      CfgWebhook       `yaml:"webhook"`
+	Health       CfgHealth        `yaml:"health"`
+	Tracing      CfgTracing       `yaml:"tracing"`
+	Log          CfgLog           `yaml:"log"`
+	Withdrawal   CfgWithdrawal    `yaml:"withdrawal"`
+	Features     CfgFeatures      `yaml:"features"`
+	Reload       CfgReload        `yaml:"reload"`
+	// файл конфигурации, из которого загружены настройки, пустой - файл не задан
+	File string `yaml:"-"`
+	// напечатать итоговую конфигурацию и выйти (--print-config)
+	PrintConfig bool `yaml:"-"`
+	// аргументы после флагов запуска, например подкоманда "migrate up"
+	Args []string `yaml:"-"`
 }
 
 type CfgMediator struct {
-	SecretKey string `env:"KEY"`
+	SecretKey string `env:"KEY" yaml:"key"`
+	// политика возврата баллов при отмене заказа: negative или clawback
+	CancelPolicy string `env:"CANCEL_POLICY" envDefault:"negative" yaml:"cancel_policy"`
 }
 
+// реализации хранилища, выбираются по схеме DATABASE_URI
+const (
+	DriverPostgres = "postgres"
+	// SQLite для установок на одном сервере: sqlite://путь/к/файлу.db
+	DriverSQLite = "sqlite"
+)
+
 type CfgDataBase struct {
-	DataBaseURI string `env:"DATABASE_URI"`
+	// postgres://... или строка key=value - Postgres, sqlite://... - SQLite
+	DataBaseURI string `env:"DATABASE_URI" yaml:"uri"`
+	// применять миграции при запуске; в production миграции выполняются отдельно: gophermart migrate up
+	AutoMigrate bool `env:"AUTO_MIGRATE" envDefault:"true" yaml:"auto_migrate"`
+	// размер пула соединений: максимум и сколько соединений держать открытыми всегда
+	MaxConns int32 `env:"DB_MAX_CONNS" envDefault:"10" yaml:"max_conns"`
+	MinConns int32 `env:"DB_MIN_CONNS" envDefault:"0" yaml:"min_conns"`
+	// соединение закрывается после этого времени жизни и после этого времени простоя
+	MaxConnLifetime time.Duration `env:"DB_MAX_CONN_LIFETIME" envDefault:"1h" yaml:"max_conn_lifetime"`
+	MaxConnIdleTime time.Duration `env:"DB_MAX_CONN_IDLE_TIME" envDefault:"30m" yaml:"max_conn_idle_time"`
+	// сколько подготовленных запросов кешируется на соединение, 0 - без кеша
+	StatementCacheCapacity int `env:"DB_STATEMENT_CACHE_CAPACITY" envDefault:"512" yaml:"statement_cache_capacity"`
+	// строки подключения к репликам для чтения списков (заказы, списания), пусто - все запросы к основной БД
+	ReplicaURIs []string `env:"DATABASE_REPLICA_URIS" envSeparator:"," yaml:"replica_uris"`
+	// интервал проверки реплик; недоступная или отставшая реплика не используется до следующей успешной проверки
+	ReplicaCheckInterval time.Duration `env:"DATABASE_REPLICA_CHECK_INTERVAL" envDefault:"5s" yaml:"replica_check_interval"`
+	// допустимое отставание реплики, 0 - отставание не проверяется
+	ReplicaMaxLag time.Duration `env:"DATABASE_REPLICA_MAX_LAG" envDefault:"10s" yaml:"replica_max_lag"`
+}
+
+// реализация хранилища по схеме DATABASE_URI
+func (c CfgDataBase) Driver() string {
+	if strings.HasPrefix(c.DataBaseURI, DriverSQLite+"://") {
+		return DriverSQLite
+	}
+	return DriverPostgres
 }
 
 type CfgServer struct {
-	RunAddress string `env:"RUN_ADDRESS"`
+	RunAddress string `env:"RUN_ADDRESS" envDefault:"localhost:8080" yaml:"run_address"`
+	// токен доступа к /api/admin, пустой токен отключает административное API
+	AdminToken string `env:"ADMIN_TOKEN" yaml:"admin_token"`
 }
 
 type CfgAccrualWorker struct {
-	AccrualSystemAddress string `env:"ACCRUAL_SYSTEM_ADDRESS"`
+	AccrualSystemAddress string `env:"ACCRUAL_SYSTEM_ADDRESS" envDefault:"http://localhost:8080" yaml:"address"`
+	// интервал опроса очереди и повторного опроса заказа в неконечном статусе
+	PollInterval time.Duration `env:"ACCRUAL_POLL_INTERVAL" envDefault:"5s" yaml:"poll_interval"`
+	// сколько заказов захватывается из очереди за раз
+	BatchSize int `env:"ACCRUAL_BATCH_SIZE" envDefault:"100" yaml:"batch_size"`
+	// сколько заказов пачки опрашивается одновременно
+	Concurrency int `env:"ACCRUAL_CONCURRENCY" envDefault:"1" yaml:"concurrency"`
+	// на сколько заказ захватывается воркером, после истечения его может забрать другой воркер
+	LeaseTimeout time.Duration `env:"ACCRUAL_LEASE_TIMEOUT" envDefault:"1m" yaml:"lease_timeout"`
+	// задержка повторного опроса после первой ошибки, дальше удваивается с каждой ошибкой
+	RetryBaseDelay time.Duration `env:"ACCRUAL_RETRY_BASE_DELAY" envDefault:"5s" yaml:"retry_base_delay"`
+	// максимальная задержка повторного опроса
+	RetryMaxDelay time.Duration `env:"ACCRUAL_RETRY_MAX_DELAY" envDefault:"10m" yaml:"retry_max_delay"`
+	// доля случайного разброса задержки, от 0 до 1
+	RetryJitter float64 `env:"ACCRUAL_RETRY_JITTER" envDefault:"0.2" yaml:"retry_jitter"`
+	// после стольких ошибок подряд заказ получает статус STALE, 0 - без ограничения
+	MaxAttempts int `env:"ACCRUAL_MAX_ATTEMPTS" envDefault:"50" yaml:"max_attempts"`
+	// заказ не получивший конечный статус за это время получает статус STALE, 0 - без ограничения
+	MaxAge time.Duration `env:"ACCRUAL_MAX_AGE" envDefault:"72h" yaml:"max_age"`
+	// таймаут запроса к аккрол сервису
+	RequestTimeout time.Duration `env:"ACCRUAL_REQUEST_TIMEOUT" envDefault:"1s" yaml:"request_timeout"`
+	// размер пула простаивающих соединений с аккрол сервисом
+	MaxIdleConns int `env:"ACCRUAL_MAX_IDLE_CONNS" envDefault:"100" yaml:"max_idle_conns"`
+	// выключатель: ошибок подряд до размыкания, время в разомкнутом состоянии и число пробных запросов
+	BreakerFailureThreshold int           `env:"ACCRUAL_BREAKER_FAILURES" envDefault:"5" yaml:"breaker_failures"`
+	BreakerOpenTimeout      time.Duration `env:"ACCRUAL_BREAKER_OPEN_TIMEOUT" envDefault:"30s" yaml:"breaker_open_timeout"`
+	BreakerHalfOpenRequests int           `env:"ACCRUAL_BREAKER_HALF_OPEN_REQUESTS" envDefault:"1" yaml:"breaker_half_open_requests"`
+	// ключ подписи HMAC-SHA256 для POST /internal/accrual/callback, пустой ключ отключает callback
+	CallbackSecret string `env:"ACCRUAL_CALLBACK_SECRET" yaml:"callback_secret"`
+	// при включенном callback заказ в неконечном статусе опрашивается повторно с этим интервалом
+	SweepInterval time.Duration `env:"ACCRUAL_SWEEP_INTERVAL" envDefault:"1m" yaml:"sweep_interval"`
 }
 
-// Заполняет конфиг из переменных окружения
-// используемые переменные окружения:
-// RUN_ADDRESS  - адрес поднимаемого сервера, например "localhost:8080"
-// DATABASE_URI - строка подключения к базе данных
-func (c *Configuration) LoadFromEnv() {
-	err := env.Parse(&(c.Server))
-	if err != nil {
-		c.logger.Warn().Msgf("не удалось загрузить конфигурацию сервера из переменных окружения; %v", err)
-	}
+type CfgBalanceCheck struct {
+	// интервал сверки снимков балансов с журналом, 0 - сверка отключена
+	Interval time.Duration `env:"BALANCE_CHECK_INTERVAL" envDefault:"10m" yaml:"interval"`
+}
 
-	err = env.Parse(&(c.DataBase))
-	if err != nil {
-		c.logger.Warn().Msgf("не удалось загрузить конфигурацию сервера из переменных окружения; %v", err)
-	}
+type CfgExpiration struct {
+	// срок жизни начисленных баллов, 0 - баллы не сгорают
+	TTL time.Duration `env:"POINTS_TTL" envDefault:"0" yaml:"ttl"`
+	// за сколько до сгорания баллы показываются в expiring_soon
+	ExpiringSoon time.Duration `env:"POINTS_EXPIRING_SOON" envDefault:"720h" yaml:"expiring_soon"`
+	// интервал запуска сгорания баллов
+	Interval time.Duration `env:"POINTS_EXPIRATION_INTERVAL" envDefault:"1h" yaml:"interval"`
+}
 
-	err = env.Parse(&(c.Mediator))
-	if err != nil {
-		c.logger.Warn().Msgf("не удалось загрузить конфигурацию сервера из переменных окружения; %v", err)
-	}
+type CfgWebhook struct {
+	// интервал разбора очереди доставок вебхуков
+	Interval time.Duration `env:"WEBHOOK_DISPATCH_INTERVAL" envDefault:"5s" yaml:"dispatch_interval"`
+	// сколько доставок захватывается за раз
+	BatchSize int `env:"WEBHOOK_BATCH_SIZE" envDefault:"50" yaml:"batch_size"`
+	// таймаут запроса к получателю
+	Timeout time.Duration `env:"WEBHOOK_TIMEOUT" envDefault:"5s" yaml:"timeout"`
+	// задержка повтора после первой неудачи, дальше удваивается, и максимальная задержка
+	RetryBaseDelay time.Duration `env:"WEBHOOK_RETRY_BASE_DELAY" envDefault:"10s" yaml:"retry_base_delay"`
+	RetryMaxDelay  time.Duration `env:"WEBHOOK_RETRY_MAX_DELAY" envDefault:"1h" yaml:"retry_max_delay"`
+	// после стольких неудачных попыток доставка получает статус FAILED
+	MaxAttempts int `env:"WEBHOOK_MAX_ATTEMPTS" envDefault:"10" yaml:"max_attempts"`
+}
 
-	err = env.Parse(&(c.Worker))
-	if err != nil {
-		c.logger.Warn().Msgf("не удалось загрузить конфигурацию сервера из переменных окружения; %v", err)
-	}
+type CfgHealth struct {
+	// /readyz отвечает 503, если воркер аккрол дольше этого времени не обращался к очереди
+	WorkerMaxAge time.Duration `env:"READY_WORKER_MAX_AGE" envDefault:"5m" yaml:"worker_max_age"`
+}
+
+type CfgTracing struct {
+	// экспорт трассировок: none, stdout или otlp
+	Exporter string `env:"TRACING_EXPORTER" envDefault:"none" yaml:"exporter"`
+	// адрес OTLP/HTTP коллектора, например "localhost:4318"
+	OTLPEndpoint string `env:"TRACING_OTLP_ENDPOINT" envDefault:"localhost:4318" yaml:"otlp_endpoint"`
+	// отправка в коллектор без TLS
+	OTLPInsecure bool `env:"TRACING_OTLP_INSECURE" envDefault:"true" yaml:"otlp_insecure"`
+	// доля трассируемых запросов, от 0 до 1
+	SampleRatio float64 `env:"TRACING_SAMPLE_RATIO" envDefault:"1" yaml:"sample_ratio"`
+	ServiceName string  `env:"TRACING_SERVICE_NAME" envDefault:"gophermart" yaml:"service_name"`
+}
+
+type CfgLog struct {
+	// формат логов: json или console
+	Format string `env:"LOG_FORMAT" envDefault:"json" yaml:"format"`
+	// уровень логирования: debug, info, warn, error
+	Level string `env:"LOG_LEVEL" envDefault:"info" yaml:"level"`
+	// вывод логов: stdout, stderr или путь к файлу
+	Output string `env:"LOG_OUTPUT" envDefault:"stdout" yaml:"output"`
+	// пишется каждая N-я запись уровней debug и info, 0 и 1 - все записи
+	SampleEvery uint32 `env:"LOG_SAMPLE_EVERY" envDefault:"0" yaml:"sample_every"`
+}
+
+type CfgWithdrawal struct {
+	// минимальная и максимальная сумма одного списания, 0 - без ограничения
+	MinSum float32 `env:"WITHDRAW_MIN_SUM" envDefault:"0" yaml:"min_sum"`
+	MaxSum float32 `env:"WITHDRAW_MAX_SUM" envDefault:"0" yaml:"max_sum"`
+}
+
+// выключатели функций, выключенная функция отвечает 503
+type CfgFeatures struct {
+	// регистрация новых пользователей
+	Registration bool `env:"FEATURE_REGISTRATION" envDefault:"true" yaml:"registration"`
+	// списание баллов
+	Withdrawals bool `env:"FEATURE_WITHDRAWALS" envDefault:"true" yaml:"withdrawals"`
+	// поток событий пользователя GET /api/user/events
+	UserEvents bool `env:"FEATURE_USER_EVENTS" envDefault:"true" yaml:"user_events"`
 }
 
-// функция парсит флаги запуска
-func (c *Configuration) LoadFromFlag() {
-	flag.StringVar(&(c.Server.RunAddress), "a", "localhost:8080", "Address to start the server (RUN_ADDRESS environment)")
-	flag.StringVar(&(c.DataBase.DataBaseURI), "d", "", "connecting string to DB (DATABASE_URI environment)")
-	flag.StringVar(&(c.Mediator.SecretKey), "k", "", "Secret key for token generating (KEY environment)")
-	flag.StringVar(&(c.Worker.AccrualSystemAddress), "r", "http://localhost:8080", "Address of the accrual system (ACCRUAL_SYSTEM_ADDRESS environment)")
-	flag.Parse()
+type CfgReload struct {
+	// интервал проверки изменения файла конфигурации, 0 - перечитывать только по SIGHUP
+	WatchInterval time.Duration `env:"CONFIG_WATCH_INTERVAL" envDefault:"10s" yaml:"watch_interval"`
 }
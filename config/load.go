@@ -0,0 +1,205 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v6"
+	"gopkg.in/yaml.v3"
+)
+
+// флаги запуска, задающие настройки, и переменные окружения этих настроек
+var flagEnv = map[string]string{
+	"a":          "RUN_ADDRESS",
+	"d":          "DATABASE_URI",
+	"k":          "KEY",
+	"r":          "ACCRUAL_SYSTEM_ADDRESS",
+	"log-format": "LOG_FORMAT",
+	"log-level":  "LOG_LEVEL",
+	"log-output": "LOG_OUTPUT",
+}
+
+// Загружает конфигурацию из источников по возрастанию приоритета:
+// значения по умолчанию (теги envDefault) < файл YAML или TOML < переменные окружения < флаги запуска.
+// файл задается флагом -config или переменной CONFIG_FILE, формат определяется по расширению,
+// неизвестные ключи в файле - ошибка. пустые переменные окружения не учитываются.
+// args - аргументы запуска без имени программы, environ - окружение в формате os.Environ().
+// итоговая конфигурация проверяется Validate
+//
+// используемые переменные окружения:
+// CONFIG_FILE - путь к файлу конфигурации (.yaml, .yml или .toml)
+// RUN_ADDRESS  - адрес поднимаемого сервера, например "localhost:8080"
+// DATABASE_URI - строка подключения к базе данных: Postgres или sqlite://путь/к/файлу.db
+// AUTO_MIGRATE - применять миграции БД при запуске (true, false)
+// DB_MAX_CONNS, DB_MIN_CONNS - максимальное и минимальное число соединений пула БД
+// DB_MAX_CONN_LIFETIME, DB_MAX_CONN_IDLE_TIME - время жизни и простоя соединения, например "1h"
+// DB_STATEMENT_CACHE_CAPACITY - размер кеша подготовленных запросов соединения, 0 - без кеша
+// DATABASE_REPLICA_URIS - строки подключения к репликам для чтения через запятую
+// DATABASE_REPLICA_CHECK_INTERVAL, DATABASE_REPLICA_MAX_LAG - интервал проверки реплик и допустимое отставание
+// KEY - hex ключ подписи токенов авторизации
+// ADMIN_TOKEN - токен доступа к административному API
+// CANCEL_POLICY - политика возврата баллов при отмене заказа (negative, clawback)
+// ACCRUAL_SYSTEM_ADDRESS - адрес аккрол сервиса, например "http://localhost:8081"
+// ACCRUAL_POLL_INTERVAL - интервал опроса очереди заказов, например "5s"
+// ACCRUAL_BATCH_SIZE - сколько заказов захватывается из очереди за раз
+// ACCRUAL_CONCURRENCY - сколько заказов опрашивается одновременно
+// ACCRUAL_LEASE_TIMEOUT - время захвата заказа воркером, например "1m"
+// ACCRUAL_RETRY_BASE_DELAY, ACCRUAL_RETRY_MAX_DELAY, ACCRUAL_RETRY_JITTER - экспоненциальная задержка повторов
+// ACCRUAL_MAX_ATTEMPTS, ACCRUAL_MAX_AGE - когда заказ снимается с опроса со статусом STALE
+// ACCRUAL_REQUEST_TIMEOUT, ACCRUAL_MAX_IDLE_CONNS - таймаут и пул соединений клиента аккрол
+// ACCRUAL_BREAKER_FAILURES, ACCRUAL_BREAKER_OPEN_TIMEOUT, ACCRUAL_BREAKER_HALF_OPEN_REQUESTS - настройки выключателя
+// ACCRUAL_CALLBACK_SECRET - ключ подписи callback аккрол сервиса, включает POST /internal/accrual/callback
+// ACCRUAL_SWEEP_INTERVAL - интервал повторного опроса заказа при включенном callback, например "1m"
+// BALANCE_CHECK_INTERVAL - интервал сверки балансов с журналом, например "10m"
+// POINTS_TTL - срок жизни начисленных баллов, например "8760h"
+// POINTS_EXPIRING_SOON - окно показа скоро сгорающих баллов, например "720h"
+// POINTS_EXPIRATION_INTERVAL - интервал запуска сгорания баллов, например "1h"
+// WEBHOOK_DISPATCH_INTERVAL, WEBHOOK_BATCH_SIZE, WEBHOOK_TIMEOUT - разбор очереди доставок вебхуков
+// WEBHOOK_RETRY_BASE_DELAY, WEBHOOK_RETRY_MAX_DELAY, WEBHOOK_MAX_ATTEMPTS - повторы доставки вебхуков
+// READY_WORKER_MAX_AGE - допустимое время без обращений воркера к очереди для /readyz, например "5m"
+// TRACING_EXPORTER - экспорт трассировок OpenTelemetry: none, stdout или otlp
+// TRACING_OTLP_ENDPOINT, TRACING_OTLP_INSECURE - адрес OTLP/HTTP коллектора и отправка без TLS
+// TRACING_SAMPLE_RATIO, TRACING_SERVICE_NAME - доля трассируемых запросов и имя сервиса
+// LOG_FORMAT, LOG_LEVEL, LOG_OUTPUT - формат (json, console), уровень и вывод логов (stdout, stderr, файл)
+// LOG_SAMPLE_EVERY - писать только каждую N-ю запись уровней debug и info
+// WITHDRAW_MIN_SUM, WITHDRAW_MAX_SUM - ограничения суммы одного списания
+// FEATURE_REGISTRATION, FEATURE_WITHDRAWALS, FEATURE_USER_EVENTS - включение регистрации, списаний и потока событий
+// CONFIG_WATCH_INTERVAL - интервал проверки изменения файла конфигурации, например "10s"
+//
+// без перезапуска, по SIGHUP или изменению файла, применяются настройки из Runtime
+func Load(args []string, environ []string) (Configuration, error) {
+	fromFlags, flagKeys, err := parseFlags(args)
+	if err != nil {
+		return Configuration{}, err
+	}
+
+	cfg, err := defaults()
+	if err != nil {
+		return cfg, err
+	}
+
+	envs := environMap(environ)
+	cfg.File = envs["CONFIG_FILE"]
+	if fromFlags.File != "" {
+		cfg.File = fromFlags.File
+	}
+	if cfg.File != "" {
+		if err := loadFile(&cfg, cfg.File); err != nil {
+			return cfg, err
+		}
+	}
+
+	// env.Parse заполняет незаданные переменные значениями по умолчанию,
+	// поэтому разбор идет в копию, а переносятся только заданные переменные
+	fromEnv := cfg
+	if err := env.Parse(&fromEnv, env.Options{Environment: envs}); err != nil {
+		return cfg, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	envKeys := make(map[string]bool, len(envs))
+	for key := range envs {
+		envKeys[key] = true
+	}
+	overlay(reflect.ValueOf(&cfg).Elem(), reflect.ValueOf(fromEnv), envKeys)
+	overlay(reflect.ValueOf(&cfg).Elem(), reflect.ValueOf(fromFlags), flagKeys)
+	cfg.PrintConfig = fromFlags.PrintConfig
+	cfg.Args = fromFlags.Args
+
+	return cfg, cfg.Validate()
+}
+
+// значения по умолчанию из тегов envDefault
+func defaults() (Configuration, error) {
+	var cfg Configuration
+	err := env.Parse(&cfg, env.Options{Environment: map[string]string{}})
+	return cfg, err
+}
+
+// разбирает флаги запуска; возвращает заданные флагами значения
+// и переменные окружения настроек, флаги которых заданы явно
+func parseFlags(args []string) (Configuration, map[string]bool, error) {
+	var cfg Configuration
+	fs := flag.NewFlagSet("gophermart", flag.ContinueOnError)
+	fs.StringVar(&(cfg.Server.RunAddress), "a", "", "Address to start the server (RUN_ADDRESS environment)")
+	fs.StringVar(&(cfg.DataBase.DataBaseURI), "d", "", "connecting string to DB (DATABASE_URI environment)")
+	fs.StringVar(&(cfg.Mediator.SecretKey), "k", "", "Secret key for token generating (KEY environment)")
+	fs.StringVar(&(cfg.Worker.AccrualSystemAddress), "r", "", "Address of the accrual system (ACCRUAL_SYSTEM_ADDRESS environment)")
+	fs.StringVar(&(cfg.Log.Format), "log-format", "", "Log format: json or console (LOG_FORMAT environment)")
+	fs.StringVar(&(cfg.Log.Level), "log-level", "", "Log level: debug, info, warn, error (LOG_LEVEL environment)")
+	fs.StringVar(&(cfg.Log.Output), "log-output", "", "Log output: stdout, stderr or file path (LOG_OUTPUT environment)")
+	fs.StringVar(&(cfg.File), "config", "", "Path to YAML or TOML configuration file (CONFIG_FILE environment)")
+	fs.BoolVar(&(cfg.PrintConfig), "print-config", false, "Print the effective configuration with secrets masked and exit")
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+	cfg.Args = fs.Args()
+	keys := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := flagEnv[f.Name]; ok {
+			keys[key] = true
+		}
+	})
+	return cfg, keys, nil
+}
+
+// накладывает на конфигурацию файл YAML или TOML
+func loadFile(cfg *Configuration, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	case ".toml":
+		// TOML приводится к YAML, чтобы разбор и проверка ключей были общими
+		var raw map[string]any
+		if err := toml.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalid, path, err)
+		}
+		if data, err = yaml.Marshal(raw); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: %s: unsupported config file format, use .yaml, .yml or .toml", ErrInvalid, path)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: %s: %v", ErrInvalid, path, err)
+	}
+	return nil
+}
+
+// переносит из src в dst поля, переменные окружения которых есть в keys
+func overlay(dst, src reflect.Value, keys map[string]bool) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			overlay(dst.Field(i), src.Field(i), keys)
+			continue
+		}
+		key, _, _ := strings.Cut(field.Tag.Get("env"), ",")
+		if key != "" && keys[key] {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// окружение в формате KEY=value без пустых переменных
+func environMap(environ []string) map[string]string {
+	envs := make(map[string]string, len(environ))
+	for _, item := range environ {
+		key, value, ok := strings.Cut(item, "=")
+		if ok && value != "" {
+			envs[key] = value
+		}
+	}
+	return envs
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// настройки, которые применяются к работающему приложению без перезапуска
+type Runtime struct {
+	LogLevel           string
+	AccrualPoll        time.Duration
+	AccrualBatchSize   int
+	AccrualConcurrency int
+	Withdrawal         CfgWithdrawal
+	Features           CfgFeatures
+}
+
+// ключи файла конфигурации, попадающие в Runtime; ключ раздела покрывает весь раздел
+var runtimeKeys = []string{
+	"log.level",
+	"accrual.poll_interval",
+	"accrual.batch_size",
+	"accrual.concurrency",
+	"withdrawal",
+	"features",
+}
+
+func (c Configuration) Runtime() Runtime {
+	return Runtime{
+		LogLevel:           c.Log.Level,
+		AccrualPoll:        c.Worker.PollInterval,
+		AccrualBatchSize:   c.Worker.BatchSize,
+		AccrualConcurrency: c.Worker.Concurrency,
+		Withdrawal:         c.Withdrawal,
+		Features:           c.Features,
+	}
+}
+
+// текущие Runtime настройки, общие для всех компонентов; замена атомарная
+type Live struct {
+	current atomic.Pointer[Runtime]
+}
+
+func NewLive(runtime Runtime) *Live {
+	live := &Live{}
+	live.Store(runtime)
+	return live
+}
+
+func (l *Live) Load() Runtime {
+	return *l.current.Load()
+}
+
+func (l *Live) Store(runtime Runtime) {
+	l.current.Store(&runtime)
+}
+
+// изменение настройки; значения секретов замаскированы
+type Change struct {
+	Key      string
+	Old, New string
+	// применяется без перезапуска
+	Runtime bool
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Key, c.Old, c.New)
+}
+
+// изменения между конфигурациями по ключам файла конфигурации
+func Changes(old, new Configuration) []Change {
+	var changes []Change
+	diff(reflect.ValueOf(old), reflect.ValueOf(new),
+		reflect.ValueOf(old.Masked()), reflect.ValueOf(new.Masked()), "", &changes)
+	return changes
+}
+
+// сравнивает значения полей, для вывода берет замаскированные копии
+func diff(old, new, oldMasked, newMasked reflect.Value, prefix string, changes *[]Change) {
+	for i := 0; i < old.NumField(); i++ {
+		name, _, _ := strings.Cut(old.Type().Field(i).Tag.Get("yaml"), ",")
+		if name == "-" || name == "" {
+			continue
+		}
+		key := prefix + name
+		if old.Field(i).Kind() == reflect.Struct {
+			diff(old.Field(i), new.Field(i), oldMasked.Field(i), newMasked.Field(i), key+".", changes)
+			continue
+		}
+		if reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			continue
+		}
+		*changes = append(*changes, Change{
+			Key:     key,
+			Old:     fmt.Sprint(oldMasked.Field(i).Interface()),
+			New:     fmt.Sprint(newMasked.Field(i).Interface()),
+			Runtime: isRuntimeKey(key),
+		})
+	}
+}
+
+func isRuntimeKey(key string) bool {
+	for _, runtimeKey := range runtimeKeys {
+		if key == runtimeKey || strings.HasPrefix(key, runtimeKey+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrInvalid error = errors.New("некорректная конфигурация")
+
+// замена секретов при выводе конфигурации
+const maskedValue = "****"
+
+// пароль в строке подключения вида "host=... password=..."
+var dsnPassword = regexp.MustCompile(`(?i)(password=)\S+`)
+
+// проверяет конфигурацию и возвращает все найденные ошибки одной ошибкой ErrInvalid
+func (c Configuration) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	positive := func(name string, d time.Duration) {
+		check(d > 0, "%s must be positive, got %s", name, d)
+	}
+	notNegative := func(name string, d time.Duration) {
+		check(d >= 0, "%s must not be negative, got %s", name, d)
+	}
+
+	check(c.DataBase.DataBaseURI != "", "DATABASE_URI is required")
+	check(c.DataBase.MaxConns > 0, "DB_MAX_CONNS must be positive, got %d", c.DataBase.MaxConns)
+	check(c.DataBase.MinConns >= 0 && c.DataBase.MinConns <= c.DataBase.MaxConns,
+		"DB_MIN_CONNS must be between 0 and DB_MAX_CONNS, got %d", c.DataBase.MinConns)
+	positive("DB_MAX_CONN_LIFETIME", c.DataBase.MaxConnLifetime)
+	positive("DB_MAX_CONN_IDLE_TIME", c.DataBase.MaxConnIdleTime)
+	check(c.DataBase.StatementCacheCapacity >= 0, "DB_STATEMENT_CACHE_CAPACITY must not be negative, got %d", c.DataBase.StatementCacheCapacity)
+	for i, uri := range c.DataBase.ReplicaURIs {
+		check(strings.TrimSpace(uri) != "", "DATABASE_REPLICA_URIS item %d is empty", i+1)
+	}
+	if c.DataBase.Driver() == DriverSQLite {
+		check(strings.TrimPrefix(c.DataBase.DataBaseURI, DriverSQLite+"://") != "", "DATABASE_URI %q must contain sqlite file path", c.DataBase.DataBaseURI)
+		check(len(c.DataBase.ReplicaURIs) == 0, "DATABASE_REPLICA_URIS are not supported with sqlite DATABASE_URI")
+	}
+	if len(c.DataBase.ReplicaURIs) > 0 {
+		positive("DATABASE_REPLICA_CHECK_INTERVAL", c.DataBase.ReplicaCheckInterval)
+		notNegative("DATABASE_REPLICA_MAX_LAG", c.DataBase.ReplicaMaxLag)
+	}
+	_, _, err := net.SplitHostPort(c.Server.RunAddress)
+	check(err == nil, "RUN_ADDRESS %q must be host:port", c.Server.RunAddress)
+	accrual, err := url.Parse(c.Worker.AccrualSystemAddress)
+	check(err == nil && (accrual.Scheme == "http" || accrual.Scheme == "https") && accrual.Host != "",
+		"ACCRUAL_SYSTEM_ADDRESS %q must be absolute http(s) url", c.Worker.AccrualSystemAddress)
+	if c.Mediator.SecretKey != "" {
+		_, err := hex.DecodeString(c.Mediator.SecretKey)
+		check(err == nil, "KEY must be hex string")
+	}
+	check(c.Mediator.CancelPolicy == "negative" || c.Mediator.CancelPolicy == "clawback",
+		"CANCEL_POLICY %q must be negative or clawback", c.Mediator.CancelPolicy)
+
+	positive("ACCRUAL_POLL_INTERVAL", c.Worker.PollInterval)
+	check(c.Worker.BatchSize > 0, "ACCRUAL_BATCH_SIZE must be positive, got %d", c.Worker.BatchSize)
+	check(c.Worker.Concurrency > 0, "ACCRUAL_CONCURRENCY must be positive, got %d", c.Worker.Concurrency)
+	positive("ACCRUAL_LEASE_TIMEOUT", c.Worker.LeaseTimeout)
+	positive("ACCRUAL_RETRY_BASE_DELAY", c.Worker.RetryBaseDelay)
+	check(c.Worker.RetryMaxDelay >= c.Worker.RetryBaseDelay, "ACCRUAL_RETRY_MAX_DELAY must not be less than ACCRUAL_RETRY_BASE_DELAY")
+	check(c.Worker.RetryJitter >= 0 && c.Worker.RetryJitter <= 1, "ACCRUAL_RETRY_JITTER must be between 0 and 1, got %v", c.Worker.RetryJitter)
+	check(c.Worker.MaxAttempts >= 0, "ACCRUAL_MAX_ATTEMPTS must not be negative, got %d", c.Worker.MaxAttempts)
+	notNegative("ACCRUAL_MAX_AGE", c.Worker.MaxAge)
+	positive("ACCRUAL_REQUEST_TIMEOUT", c.Worker.RequestTimeout)
+	check(c.Worker.MaxIdleConns >= 0, "ACCRUAL_MAX_IDLE_CONNS must not be negative, got %d", c.Worker.MaxIdleConns)
+	check(c.Worker.BreakerFailureThreshold > 0, "ACCRUAL_BREAKER_FAILURES must be positive, got %d", c.Worker.BreakerFailureThreshold)
+	positive("ACCRUAL_BREAKER_OPEN_TIMEOUT", c.Worker.BreakerOpenTimeout)
+	check(c.Worker.BreakerHalfOpenRequests > 0, "ACCRUAL_BREAKER_HALF_OPEN_REQUESTS must be positive, got %d", c.Worker.BreakerHalfOpenRequests)
+	positive("ACCRUAL_SWEEP_INTERVAL", c.Worker.SweepInterval)
+
+	notNegative("BALANCE_CHECK_INTERVAL", c.BalanceCheck.Interval)
+	notNegative("POINTS_TTL", c.Expiration.TTL)
+	notNegative("POINTS_EXPIRING_SOON", c.Expiration.ExpiringSoon)
+	if c.Expiration.TTL > 0 {
+		positive("POINTS_EXPIRATION_INTERVAL", c.Expiration.Interval)
+	}
+
+	positive("WEBHOOK_DISPATCH_INTERVAL", c.Webhook.Interval)
+	check(c.Webhook.BatchSize > 0, "WEBHOOK_BATCH_SIZE must be positive, got %d", c.Webhook.BatchSize)
+	positive("WEBHOOK_TIMEOUT", c.Webhook.Timeout)
+	positive("WEBHOOK_RETRY_BASE_DELAY", c.Webhook.RetryBaseDelay)
+	check(c.Webhook.RetryMaxDelay >= c.Webhook.RetryBaseDelay, "WEBHOOK_RETRY_MAX_DELAY must not be less than WEBHOOK_RETRY_BASE_DELAY")
+	check(c.Webhook.MaxAttempts > 0, "WEBHOOK_MAX_ATTEMPTS must be positive, got %d", c.Webhook.MaxAttempts)
+
+	notNegative("READY_WORKER_MAX_AGE", c.Health.WorkerMaxAge)
+
+	exporter := strings.ToLower(c.Tracing.Exporter)
+	check(exporter == "none" || exporter == "stdout" || exporter == "otlp",
+		"TRACING_EXPORTER %q must be none, stdout or otlp", c.Tracing.Exporter)
+	check(exporter != "otlp" || c.Tracing.OTLPEndpoint != "", "TRACING_OTLP_ENDPOINT is required for otlp exporter")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "TRACING_SAMPLE_RATIO must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+
+	check(c.Withdrawal.MinSum >= 0, "WITHDRAW_MIN_SUM must not be negative, got %v", c.Withdrawal.MinSum)
+	check(c.Withdrawal.MaxSum >= 0, "WITHDRAW_MAX_SUM must not be negative, got %v", c.Withdrawal.MaxSum)
+	check(c.Withdrawal.MaxSum == 0 || c.Withdrawal.MaxSum >= c.Withdrawal.MinSum, "WITHDRAW_MAX_SUM must not be less than WITHDRAW_MIN_SUM")
+	notNegative("CONFIG_WATCH_INTERVAL", c.Reload.WatchInterval)
+
+	format := strings.ToLower(c.Log.Format)
+	check(format == "json" || format == "console", "LOG_FORMAT %q must be json or console", c.Log.Format)
+	level, err := zerolog.ParseLevel(strings.ToLower(c.Log.Level))
+	check(err == nil && level != zerolog.NoLevel, "LOG_LEVEL %q must be debug, info, warn or error", c.Log.Level)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// копия конфигурации с замаскированными секретами
+func (c Configuration) Masked() Configuration {
+	mask(&c.Mediator.SecretKey)
+	mask(&c.Server.AdminToken)
+	mask(&c.Worker.CallbackSecret)
+	c.DataBase.DataBaseURI = maskURI(c.DataBase.DataBaseURI)
+	replicas := make([]string, 0, len(c.DataBase.ReplicaURIs))
+	for _, uri := range c.DataBase.ReplicaURIs {
+		replicas = append(replicas, maskURI(uri))
+	}
+	c.DataBase.ReplicaURIs = replicas
+	return c
+}
+
+// пишет конфигурацию с замаскированными секретами в формате YAML файла конфигурации
+func (c Configuration) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c.Masked()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func mask(value *string) {
+	if *value != "" {
+		*value = maskedValue
+	}
+}
+
+// маскирует пароль в строке подключения к БД в форме URL или key=value
+func maskURI(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err == nil && parsed.User != nil {
+		// пароль заменяется на "xxxxx"
+		return parsed.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(uri, "${1}"+maskedValue)
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/breaker"
+)
+
+// пакет клиентов сервиса аккрол: интерфейс, http реализация и подменная реализация для тестов
+
+var ErrNotRegistered error = errors.New("заказ не зарегистрирован в системе расчёта")
+var ErrServer error = errors.New("внутренняя ошибка сервиса аккрол")
+var ErrInvalidResponse error = errors.New("некорректный ответ сервиса аккрол")
+
+// ответ 429: сервис просит повторить запрос не раньше чем через RetryAfter
+type TooManyRequestsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyRequestsError) Error() string {
+	return fmt.Sprintf("превышено количество запросов к сервису, повтор через %s", e.RetryAfter)
+}
+
+// клиент сервиса аккрол.
+// возвращает проверенный ответ либо ErrNotRegistered, ErrServer, ErrInvalidResponse,
+// *TooManyRequestsError, breaker.ErrOpen или сетевую ошибку
+type AccrualClient interface {
+	GetAccrual(ctx context.Context, order string) (schema.AnswerAccrualService, error)
+}
+
+// клиент с автоматическим выключателем сообщает его состояние
+type BreakerStater interface {
+	BreakerState() breaker.State
+}
+
+// проверяет ответ сервиса на запрос по заказу order:
+// известный статус, неотрицательное начисление и совпадение номера заказа
+func Validate(order string, answer schema.AnswerAccrualService) error {
+	switch answer.Status {
+	case schema.AccrualStatusRegistered, schema.AccrualStatusInvalid,
+		schema.AccrualStatusProcessing, schema.AccrualStatusProcessed:
+	default:
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidResponse, answer.Status)
+	}
+	if answer.Accrual < 0 {
+		return fmt.Errorf("%w: negative accrual %v", ErrInvalidResponse, answer.Accrual)
+	}
+	if answer.Order != order {
+		return fmt.Errorf("%w: order %q in answer for order %q", ErrInvalidResponse, answer.Order, order)
+	}
+	return nil
+}
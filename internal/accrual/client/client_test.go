@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/rs/zerolog"
+)
+
+func TestValidate(t *testing.T) {
+	cases := map[string]struct {
+		answer schema.AnswerAccrualService
+		valid  bool
+	}{
+		"registered": {schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusRegistered}, true},
+		"invalid":    {schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusInvalid}, true},
+		"processing": {schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusProcessing}, true},
+		"processed":  {schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusProcessed, Accrual: 729.98}, true},
+		"unknown status": {
+			schema.AnswerAccrualService{Order: "12345678903", Status: "DONE"}, false,
+		},
+		"empty status": {
+			schema.AnswerAccrualService{Order: "12345678903"}, false,
+		},
+		"negative accrual": {
+			schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusProcessed, Accrual: -1}, false,
+		},
+		"other order": {
+			schema.AnswerAccrualService{Order: "2377225624", Status: schema.AccrualStatusProcessed, Accrual: 10}, false,
+		},
+	}
+	for name, tc := range cases {
+		err := Validate("12345678903", tc.answer)
+		if tc.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("%s: error = %v, want ErrInvalidResponse", name, err)
+		}
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	cases := map[string]struct {
+		status      int
+		contentType string
+		retryAfter  string
+		body        string
+		wantErr     error
+		wantRetry   time.Duration
+	}{
+		"processed": {
+			status: http.StatusOK, contentType: "application/json; charset=utf-8",
+			body: `{"order":"12345678903","status":"PROCESSED","accrual":729.98}`,
+		},
+		"not registered":  {status: http.StatusNoContent, wantErr: ErrNotRegistered},
+		"server error":    {status: http.StatusInternalServerError, wantErr: ErrServer},
+		"too many":        {status: http.StatusTooManyRequests, retryAfter: "30", wantRetry: 30 * time.Second},
+		"too many no hdr": {status: http.StatusTooManyRequests, wantRetry: time.Minute},
+		"text content type": {
+			status: http.StatusOK, contentType: "text/plain",
+			body: `{"order":"12345678903","status":"PROCESSED","accrual":729.98}`, wantErr: ErrInvalidResponse,
+		},
+		"no content type": {
+			status: http.StatusOK,
+			body:   `{"order":"12345678903","status":"PROCESSED","accrual":729.98}`, wantErr: ErrInvalidResponse,
+		},
+		"broken json": {
+			status: http.StatusOK, contentType: "application/json", body: `{"order":`, wantErr: ErrInvalidResponse,
+		},
+		"unknown status": {
+			status: http.StatusOK, contentType: "application/json",
+			body: `{"order":"12345678903","status":"DONE"}`, wantErr: ErrInvalidResponse,
+		},
+		"negative accrual": {
+			status: http.StatusOK, contentType: "application/json",
+			body: `{"order":"12345678903","status":"PROCESSED","accrual":-5}`, wantErr: ErrInvalidResponse,
+		},
+		"other order": {
+			status: http.StatusOK, contentType: "application/json",
+			body: `{"order":"2377225624","status":"PROCESSED","accrual":5}`, wantErr: ErrInvalidResponse,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/orders/12345678903" {
+					t.Errorf("request path = %s, want /api/orders/12345678903", r.URL.Path)
+				}
+				if tc.contentType != "" {
+					w.Header().Set("Content-Type", tc.contentType)
+				}
+				if tc.retryAfter != "" {
+					w.Header().Set("Retry-After", tc.retryAfter)
+				}
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+			client := NewHTTP(config.CfgAccrualWorker{
+				AccrualSystemAddress:    server.URL,
+				RequestTimeout:          time.Second,
+				BreakerFailureThreshold: 100,
+				BreakerOpenTimeout:      time.Minute,
+				BreakerHalfOpenRequests: 1,
+			}, zerolog.Nop(), nil)
+
+			answer, err := client.GetAccrual(context.Background(), "12345678903")
+			var tooManyRequests *TooManyRequestsError
+			switch {
+			case tc.wantRetry > 0:
+				if !errors.As(err, &tooManyRequests) || tooManyRequests.RetryAfter != tc.wantRetry {
+					t.Errorf("error = %v, want TooManyRequestsError with RetryAfter %s", err, tc.wantRetry)
+				}
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("error = %v, want %v", err, tc.wantErr)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case answer.Status != schema.AccrualStatusProcessed || answer.Accrual != 729.98:
+				t.Errorf("answer = %+v, want PROCESSED with 729.98", answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bubu256/gophermart_pet/internal/schema"
+)
+
+// подменный клиент для тестов: ответы задаются заранее по каждому заказу
+
+// ответ подменного клиента: Err либо Answer
+type FakeStep struct {
+	Answer schema.AnswerAccrualService
+	Err    error
+}
+
+type Fake struct {
+	mu      sync.Mutex
+	scripts map[string][]FakeStep
+	calls   map[string]int
+}
+
+func NewFake() *Fake {
+	return &Fake{scripts: make(map[string][]FakeStep), calls: make(map[string]int)}
+}
+
+// задает последовательность ответов по заказу; последний ответ повторяется бесконечно.
+// для незаданных заказов клиент отвечает ErrNotRegistered
+func (f *Fake) Script(order string, steps ...FakeStep) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scripts[order] = steps
+	f.calls[order] = 0
+}
+
+// задает один ответ со статусом и начислением
+func (f *Fake) Set(order string, status schema.AccrualStatus, accrual float32) {
+	f.Script(order, FakeStep{Answer: schema.AnswerAccrualService{Order: order, Status: status, Accrual: accrual}})
+}
+
+// сколько раз запрашивался заказ
+func (f *Fake) Calls(order string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[order]
+}
+
+func (f *Fake) GetAccrual(ctx context.Context, order string) (schema.AnswerAccrualService, error) {
+	if err := ctx.Err(); err != nil {
+		return schema.AnswerAccrualService{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	steps := f.scripts[order]
+	call := f.calls[order]
+	f.calls[order]++
+	if len(steps) == 0 {
+		return schema.AnswerAccrualService{}, ErrNotRegistered
+	}
+	if call >= len(steps) {
+		call = len(steps) - 1
+	}
+	step := steps[call]
+	if step.Err != nil {
+		return schema.AnswerAccrualService{}, step.Err
+	}
+	return step.Answer, Validate(order, step.Answer)
+}
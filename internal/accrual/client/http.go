@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/internal/tracing"
+	"github.com/bubu256/gophermart_pet/pkg/breaker"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+// http клиент сервиса аккрол (GET /api/orders/{number}): общий транспорт с пулом соединений
+// и автоматический выключатель, который перестает слать запросы недоступному сервису
+
+type HTTPClient struct {
+	address string
+	http    *http.Client
+	breaker *breaker.Breaker
+}
+
+// onStateChange дополнительно получает смены состояния выключателя (для метрик), может быть nil
+func NewHTTP(cfg config.CfgAccrualWorker, logger zerolog.Logger, onStateChange func(from, to breaker.State)) *HTTPClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = cfg.MaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConns
+	transport.IdleConnTimeout = 90 * time.Second
+
+	c := &HTTPClient{
+		address: cfg.AccrualSystemAddress,
+		http:    &http.Client{Transport: transport, Timeout: cfg.RequestTimeout},
+	}
+	c.breaker = breaker.New(breaker.Settings{
+		FailureThreshold: cfg.BreakerFailureThreshold,
+		OpenTimeout:      cfg.BreakerOpenTimeout,
+		HalfOpenRequests: cfg.BreakerHalfOpenRequests,
+	}, func(from, to breaker.State) {
+		logger.Warn().Msgf("выключатель клиента аккрол: %s -> %s;", from, to)
+		if onStateChange != nil {
+			onStateChange(from, to)
+		}
+	})
+	return c
+}
+
+// состояние выключателя клиента
+func (c *HTTPClient) BreakerState() breaker.State {
+	return c.breaker.State()
+}
+
+// получает статус и сумму начисления по заказу.
+// пока выключатель разомкнут возвращает breaker.ErrOpen без обращения к сервису
+func (c *HTTPClient) GetAccrual(ctx context.Context, order string) (schema.AnswerAccrualService, error) {
+	if err := c.breaker.Allow(); err != nil {
+		return schema.AnswerAccrualService{}, err
+	}
+	answer, err := c.getAccrual(ctx, order)
+	// недоступность сервиса: сетевые ошибки, таймауты, 5xx и некорректные ответы.
+	// 204 и 429 означают что сервис работает
+	var tooManyRequests *TooManyRequestsError
+	if err == nil || errors.Is(err, ErrNotRegistered) || errors.As(err, &tooManyRequests) {
+		c.breaker.Success()
+	} else {
+		c.breaker.Failure()
+	}
+	return answer, err
+}
+
+func (c *HTTPClient) getAccrual(ctx context.Context, order string) (answerAccrual schema.AnswerAccrualService, err error) {
+	ctx, span := tracing.Start(ctx, "accrual.GetAccrual", attribute.String("order.number", order))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/orders/%s", c.address, order), nil)
+	if err != nil {
+		return answerAccrual, err
+	}
+	request.Header.Add("Accept", "application/json")
+	// трассировка продолжается в аккрол сервисе через заголовок traceparent
+	tracing.Inject(ctx, request.Header)
+	resp, err := c.http.Do(request)
+	if err != nil {
+		return answerAccrual, err
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	// проверка статус кода
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return answerAccrual, ErrNotRegistered
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || retryAfter <= 0 {
+			retryAfter = 60
+		}
+		return answerAccrual, &TooManyRequestsError{RetryAfter: time.Duration(retryAfter) * time.Second}
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return answerAccrual, fmt.Errorf("%w: status code %d", ErrServer, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return answerAccrual, fmt.Errorf("неожиданный статус ответа сервиса аккрол: %d", resp.StatusCode)
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return answerAccrual, fmt.Errorf("%w: content type %q", ErrInvalidResponse, resp.Header.Get("Content-Type"))
+	}
+	// читаем ответ, проверяем и возвращаем результат
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return answerAccrual, err
+	}
+	err = json.Unmarshal(body, &answerAccrual)
+	if err != nil {
+		return answerAccrual, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	if err := Validate(order, answerAccrual); err != nil {
+		return answerAccrual, err
+	}
+	return answerAccrual, nil
+}
@@ -2,139 +2,349 @@ package worker
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/accrual/client"
 	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/metrics"
 	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/internal/tracing"
+	"github.com/bubu256/gophermart_pet/pkg/breaker"
+	"github.com/bubu256/gophermart_pet/pkg/helpfunc"
 	"github.com/bubu256/gophermart_pet/pkg/storage"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // пакет воркера который стучится в аккрол сервис и обновляет статусы заказов
 
-type Queue struct {
-}
-
 type AccrualWorker struct {
-	db            storage.Storage
-	logger        zerolog.Logger
-	serverAddress string
-	// queue *Queue
+	db          storage.Storage
+	logger      zerolog.Logger
+	client      client.AccrualClient
+	owner       string // идентификатор воркера для захвата задач в очереди
+	cfg         config.CfgAccrualWorker
+	live        *config.Live // интервал опроса, размер пачки и параллельность меняются без перезапуска
+	mu          sync.Mutex   // защищает pausedUntil и rnd при параллельном опросе
+	pausedUntil time.Time    // до этого времени аккрол сервис просил не присылать запросы (429)
+	rnd         *rand.Rand
+	lastTick    atomic.Int64 // время последнего успешного обращения к очереди, unix nano
 }
 
 // запускает воркер который в горутине регулярно обновляет статусы заказов
-func Run(db storage.Storage, logger zerolog.Logger, cfg config.CfgAccrualWorker) {
-
-	worker := AccrualWorker{db: db, logger: logger, serverAddress: cfg.AccrualSystemAddress}
-	ticker := time.NewTicker(5 * time.Second)
-	// done := make(chan struct{})
+func Run(db storage.Storage, accrual client.AccrualClient, logger zerolog.Logger, cfg config.CfgAccrualWorker, live *config.Live) *AccrualWorker {
+	worker := &AccrualWorker{
+		db:     db,
+		logger: logger,
+		client: accrual,
+		owner:  newOwnerID(),
+		cfg:    cfg,
+		live:   live,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	// до первого обращения к очереди отсчет идет от запуска
+	worker.lastTick.Store(time.Now().UnixNano())
+	interval := live.Load().AccrualPoll
+	ticker := time.NewTicker(interval)
 	go func() {
 		for range ticker.C {
-			worker.UpdateStatuses()
+			if current := live.Load().AccrualPoll; current != interval {
+				interval = current
+				ticker.Reset(interval)
+				logger.Info().Msgf("интервал опроса очереди изменен на %s;", interval)
+			}
+			start := time.Now()
+			worker.UpdateStatuses(context.Background())
+			metrics.ObserveWorkerTick(time.Since(start))
+			depth, err := db.GetAccrualQueueDepth(context.Background())
+			if err != nil {
+				logger.Error().Err(err).Msg("ошибка при подсчете очереди опроса; err is here 2265213154")
+				continue
+			}
+			metrics.SetAccrualQueueDepth(depth)
 		}
 	}()
-	logger.Info().Msg("Воркер запущен")
-}
-
-// получает из базы список заказов ожидающих расчет начислений
-//
-//	func (a *AccrualWorker) getWaitingOrders(order string) ([]schema.Order, error) {
-//		waitingOrders :=
-//	}
-func (a *AccrualWorker) UpdateStatuses() {
-	//получаем все заказы нуждающиеся в обновлении статуса
-	waitingOrders, err := a.db.GetWaitingOrders()
-	a.logger.Debug().Msgf("заказы ожидающие обновления статуса: %v", waitingOrders)
+	logger.Info().Msgf("Воркер %s запущен", worker.owner)
+	return worker
+}
+
+// захватывает из очереди заказы готовые к опросу и обновляет их статусы,
+// пока очередь не опустеет
+func (a *AccrualWorker) UpdateStatuses(ctx context.Context) {
+	ctx, span := tracing.Start(ctx, "AccrualWorker.UpdateStatuses")
+	defer span.End()
+	// пока сервис недоступен заказы не захватываются, чтобы не тратить их попытки
+	if state, ok := a.BreakerState(); ok && state == breaker.StateOpen {
+		a.logger.Debug().Msg("выключатель клиента аккрол разомкнут, опрос пропущен;")
+		a.lastTick.Store(time.Now().UnixNano())
+		return
+	}
+	for {
+		runtime := a.live.Load()
+		jobs, err := a.db.ClaimAccrualJobs(ctx, a.owner, runtime.AccrualBatchSize, a.cfg.LeaseTimeout)
+		if err != nil {
+			if errors.Is(err, errorapp.ErrEmptyResult) {
+				a.logger.Debug().Msg("нет заказов для обновления статусов;")
+				a.lastTick.Store(time.Now().UnixNano())
+				return
+			}
+			a.logger.Error().Err(err).Msg("ошибка при захвате заказов из очереди; err is here 2265451220")
+			return
+		}
+		a.lastTick.Store(time.Now().UnixNano())
+		a.logger.Debug().Msgf("заказы ожидающие обновления статуса: %v", jobs)
+		a.processJobs(ctx, jobs, runtime.AccrualConcurrency)
+		if len(jobs) < runtime.AccrualBatchSize {
+			return
+		}
+	}
+}
+
+// время последнего успешного обращения к очереди (захват пачки или пустая очередь),
+// до первого обращения - время запуска воркера
+func (a *AccrualWorker) LastTick() time.Time {
+	return time.Unix(0, a.lastTick.Load())
+}
+
+// состояние выключателя клиента аккрол, если клиент его поддерживает
+func (a *AccrualWorker) BreakerState() (breaker.State, bool) {
+	stater, ok := a.client.(client.BreakerStater)
+	if !ok {
+		return breaker.StateClosed, false
+	}
+	return stater.BreakerState(), true
+}
+
+// опрашивает заказы пачки, не больше concurrency одновременно
+func (a *AccrualWorker) processJobs(ctx context.Context, jobs []schema.AccrualJob, concurrency int) {
+	if concurrency <= 1 {
+		for _, job := range jobs {
+			a.processJob(ctx, job)
+		}
+		return
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(job schema.AccrualJob) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			a.processJob(ctx, job)
+		}(job)
+	}
+	wg.Wait()
+}
+
+// проверяет аккрол статус заказа и если требуется обновляет данные в БД.
+// заказ с неконечным статусом возвращается в очередь
+func (a *AccrualWorker) processJob(ctx context.Context, job schema.AccrualJob) {
+	ctx, span := tracing.Start(ctx, "AccrualWorker.processJob", attribute.String("order.number", job.OrderNumber))
+	defer span.End()
+	if pausedUntil := a.paused(); time.Now().Before(pausedUntil) {
+		// сервис просил подождать, не тратим попытку заказа
+		a.reschedule(ctx, job, pausedUntil, "")
+		return
+	}
+	requestCtx, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+	defer cancel()
+	answerAccrual, err := a.client.GetAccrual(requestCtx, job.OrderNumber)
+	metrics.ObserveAccrual(err)
 	if err != nil {
-		if errors.Is(err, errorapp.ErrEmptyResult) {
-			a.logger.Debug().Msg("нет заказов для обновления статусов;")
+		var tooManyRequests *client.TooManyRequestsError
+		if errors.As(err, &tooManyRequests) {
+			pausedUntil := a.pause(tooManyRequests.RetryAfter)
+			a.logger.Warn().Msgf("аккрол сервис ограничил запросы, пауза до %s;", pausedUntil.Format(time.RFC3339))
+			a.reschedule(ctx, job, pausedUntil, "")
 			return
 		}
+		if errors.Is(err, breaker.ErrOpen) {
+			// выключатель разомкнулся посреди пачки, попытка заказа не засчитывается
+			a.reschedule(ctx, job, time.Now().Add(a.cfg.BreakerOpenTimeout), "")
+			return
+		}
+		a.logger.Debug().Err(err).Msg("ошибка при получении статуса из аккрол сервиса;")
+		a.fail(ctx, job, err)
+		return
+	}
+	status, ok := orderStatus(answerAccrual.Status)
+	if !ok {
+		a.fail(ctx, job, fmt.Errorf("неизвестный статус аккрол сервиса %q", answerAccrual.Status))
 		return
 	}
-	// проверяем аккрол статус заказов и если требуется обновляем данные в БД
-	for _, order := range waitingOrders {
-		answerAccrual, err := a.getAccrual(order.Number)
+	if status != job.Status {
+		err = a.ApplyAnswer(ctx, answerAccrual)
+		if errors.Is(err, errorapp.ErrInvalidTransition) || errors.Is(err, errorapp.ErrAlreadyCancelled) {
+			// заказ уже получил конечный статус через callback или отменен, задача снята с очереди
+			a.logger.Debug().Err(err).Msgf("статус заказа %s не обновлен;", job.OrderNumber)
+			return
+		}
 		if err != nil {
-			a.logger.Debug().Err(err).Msg("ошибка при получении статуса из аккрол сервиса;")
-			continue
+			a.logger.Error().Err(err).Msgf("ошибка при попытке обновить статус заказа %s; err is here 2265213151", job.OrderNumber)
+			a.fail(ctx, job, err)
+			return
 		}
-		switch answerAccrual.Status {
-		case schema.AccrualStatusInvalid:
-			err := a.db.SetOrderStatus(answerAccrual.Order, schema.StatusOrderInvalid, 0)
-			if err != nil {
-				a.logger.Error().Err(err).Msgf("ошибка при попытке обновить статус заказа %s; err is here 2265451221", answerAccrual.Order)
-				continue
-			}
-			a.logger.Info().Msgf("обновлен статус заказа %s на %s;", answerAccrual.Order, schema.StatusOrderInvalid)
-
-		case schema.AccrualStatusProcessed:
-			// обновление статуса и зачисление бонусов
-			err := a.db.SetOrderStatus(answerAccrual.Order, schema.StatusOrderProcessed, answerAccrual.Accrual)
-			if err != nil {
-				a.logger.Error().Err(err).Msgf("ошибка при попытке обновить статус заказа %s; err is here 2265213151", answerAccrual.Order)
-				continue
-			}
-			a.logger.Info().Msgf("обновлен статус заказа %s на %s;", answerAccrual.Order, schema.StatusOrderProcessed)
-
-		case schema.AccrualStatusProcessing, schema.AccrualStatusRegistered:
-			if order.Status == string(schema.StatusOrderNew) {
-				err := a.db.SetOrderStatus(answerAccrual.Order, schema.StatusOrderProcessing, 0)
-				if err != nil {
-					a.logger.Error().Err(err).Msgf("ошибка при попытке обновить статус заказа %s; err is here 2265213151", answerAccrual.Order)
-					continue
-				}
-			}
-			a.logger.Info().Msgf("обновлен статус заказа %s на %s;", answerAccrual.Order, schema.StatusOrderProcessing)
+	}
+	if status == schema.StatusOrderProcessing {
+		if a.expired(job) {
+			a.giveUp(ctx, job, "заказ слишком долго не получает конечный статус")
+			return
 		}
+		a.reschedule(ctx, job, time.Now().Add(a.retryInterval()), "")
 	}
 }
 
-// получает статус и сумму начисления из сервиса аккрол
-func (a *AccrualWorker) getAccrual(order string) (schema.AnswerAccrualService, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-	answerAccrual := schema.AnswerAccrualService{}
-	request, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/orders/%s", a.serverAddress, order), nil)
-	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	request.Header.Add("Accept", "application/json")
+// применяет ответ аккрол сервиса к заказу: переводит заказ в соответствующий статус
+// и при PROCESSED начисляет баллы. общий путь для опроса и для callback.
+// повтор уже записанного статуса ничего не меняет, недопустимый переход - errorapp.ErrInvalidTransition
+func (a *AccrualWorker) ApplyAnswer(ctx context.Context, answer schema.AnswerAccrualService) error {
+	ctx, span := tracing.Start(ctx, "AccrualWorker.ApplyAnswer", attribute.String("order.number", answer.Order))
+	defer span.End()
+	status, ok := orderStatus(answer.Status)
+	if !ok {
+		return fmt.Errorf("%w: unknown status %q", client.ErrInvalidResponse, answer.Status)
+	}
+	var accrual float32
+	if status == schema.StatusOrderProcessed {
+		accrual = answer.Accrual
+	}
+	err := a.db.SetOrderStatus(ctx, answer.Order, status, accrual)
+	if errors.Is(err, errorapp.ErrDuplicate) {
+		// статус уже записан, например callback пришел повторно
+		return nil
+	}
 	if err != nil {
-		// a.logger.Error().Err(err).Msg("ошибка при создании запроса для сервиса аккрол; err is here 2235498;")
-		return answerAccrual, err
+		return err
+	}
+	if status == schema.StatusOrderProcessed {
+		metrics.AddPointsCredited(accrual)
+	}
+	a.logger.Info().Msgf("обновлен статус заказа %s на %s;", answer.Order, status)
+	return nil
+}
+
+// статус заказа по статусу аккрол сервиса
+func orderStatus(status schema.AccrualStatus) (schema.StatusOrder, bool) {
+	switch status {
+	case schema.AccrualStatusInvalid:
+		return schema.StatusOrderInvalid, true
+	case schema.AccrualStatusProcessed:
+		return schema.StatusOrderProcessed, true
+	case schema.AccrualStatusProcessing, schema.AccrualStatusRegistered:
+		return schema.StatusOrderProcessing, true
+	}
+	return "", false
+}
+
+// интервал повторного опроса заказа в неконечном статусе.
+// при включенном callback конечный статус обычно приходит сам, опрос нужен только как страховка
+func (a *AccrualWorker) retryInterval() time.Duration {
+	pollInterval := a.live.Load().AccrualPoll
+	if a.CallbackEnabled() && a.cfg.SweepInterval > pollInterval {
+		return a.cfg.SweepInterval
+	}
+	return pollInterval
+}
+
+// включен ли прием статусов через callback
+func (a *AccrualWorker) CallbackEnabled() bool {
+	return a.cfg.CallbackSecret != ""
+}
+
+// проверяет подпись тела callback: hex HMAC-SHA256 тела на ключе CallbackSecret
+func (a *AccrualWorker) VerifySignature(body []byte, signature string) bool {
+	if !a.CallbackEnabled() {
+		return false
 	}
-	// resp, err := http.DefaultClient.Do(request)
-	client := &http.Client{}
-	resp, err := client.Do(request)
+	expected, err := hex.DecodeString(signature)
 	if err != nil {
-		return answerAccrual, err
-	}
-	// проверка статус кода
-	switch resp.StatusCode {
-	case http.StatusInternalServerError:
-		return answerAccrual, errors.New("accraul status code is 500;")
-	case http.StatusNoContent:
-		return answerAccrual, errors.New("заказ не зарегистрирован в системе расчёта;")
-	case http.StatusTooManyRequests:
-		return answerAccrual, errors.New("превышено количество запросов к сервису превышено количество запросов к сервису;")
-	}
-	if resp.Header.Get("Content-Type") != "application/json" {
-		a.logger.Warn().Msg("неожиданный тип ответа от сервиса аккрол; i am here 22345354;")
-	}
-	// читаем ответ и возвращаем результат
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(a.cfg.CallbackSecret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// засчитывает неудачный опрос: заказ либо снимается с опроса, либо повторяется с экспоненциальной задержкой
+func (a *AccrualWorker) fail(ctx context.Context, job schema.AccrualJob, err error) {
+	failures := job.Failures + 1
+	if a.cfg.MaxAttempts > 0 && failures >= a.cfg.MaxAttempts {
+		a.giveUp(ctx, job, fmt.Sprintf("ошибок подряд: %d, последняя: %v", failures, err))
+		return
+	}
+	if a.expired(job) {
+		a.giveUp(ctx, job, fmt.Sprintf("заказ слишком долго не получает конечный статус, последняя ошибка: %v", err))
+		return
+	}
+	delay := helpfunc.Backoff(failures, a.cfg.RetryBaseDelay, a.cfg.RetryMaxDelay, a.cfg.RetryJitter*a.random())
+	a.reschedule(ctx, job, time.Now().Add(delay), err.Error())
+}
+
+// заказ в очереди дольше MaxAge
+func (a *AccrualWorker) expired(job schema.AccrualJob) bool {
+	return a.cfg.MaxAge > 0 && time.Since(job.CreatedAt) > a.cfg.MaxAge
+}
+
+// снимает заказ с опроса со статусом STALE
+func (a *AccrualWorker) giveUp(ctx context.Context, job schema.AccrualJob, reason string) {
+	err := a.db.SetOrderStatus(ctx, job.OrderNumber, schema.StatusOrderStale, 0)
+	if err != nil {
+		a.logger.Error().Err(err).Msgf("ошибка при снятии заказа %s с опроса; err is here 2265213153", job.OrderNumber)
+		a.reschedule(ctx, job, time.Now().Add(a.cfg.RetryMaxDelay), reason)
+		return
+	}
+	a.logger.Warn().Msgf("заказ %s снят с опроса со статусом %s: %s;", job.OrderNumber, schema.StatusOrderStale, reason)
+}
+
+// возвращает заказ в очередь до следующего опроса
+func (a *AccrualWorker) reschedule(ctx context.Context, job schema.AccrualJob, nextAttemptAt time.Time, failure string) {
+	err := a.db.RescheduleAccrualJob(ctx, job.OrderNumber, a.owner, nextAttemptAt, failure)
+	if err != nil {
+		a.logger.Error().Err(err).Msgf("ошибка при возврате заказа %s в очередь; err is here 2265213152", job.OrderNumber)
+	}
+}
+
+// время до которого аккрол сервис просил не присылать запросы
+func (a *AccrualWorker) paused() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.pausedUntil
+}
+
+// приостанавливает опрос на retryAfter, возвращает время окончания паузы
+func (a *AccrualWorker) pause(retryAfter time.Duration) time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pausedUntil = time.Now().Add(retryAfter)
+	return a.pausedUntil
+}
+
+func (a *AccrualWorker) random() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rnd.Float64()
+}
+
+// идентификатор экземпляра воркера: хост, pid и случайный суффикс
+func newOwnerID() string {
+	host, err := os.Hostname()
 	if err != nil {
-		return answerAccrual, err
+		host = "unknown"
 	}
-	err = json.Unmarshal(body, &answerAccrual)
+	suffix, err := helpfunc.GenerateRandomBytes(4)
 	if err != nil {
-		return answerAccrual, err
+		return fmt.Sprintf("%s-%d", host, os.Getpid())
 	}
-	return answerAccrual, nil
+	return fmt.Sprintf("%s-%d-%x", host, os.Getpid(), suffix)
 }
@@ -0,0 +1,404 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/accrual/client"
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+	"github.com/rs/zerolog"
+)
+
+// хранилище в памяти: статусы заказов и очередь опроса, остальные методы не нужны воркеру
+type memStorage struct {
+	storage.Storage
+	mu       sync.Mutex
+	statuses map[string][]schema.StatusOrder
+	accruals map[string]float32
+	jobs     map[string]*memJob
+	// сколько раз задачи возвращались в очередь
+	reschedules int
+	// ошибка записи статуса STALE
+	staleErr error
+}
+
+type memJob struct {
+	job           schema.AccrualJob
+	nextAttemptAt time.Time
+	leased        bool
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		statuses: make(map[string][]schema.StatusOrder),
+		accruals: make(map[string]float32),
+		jobs:     make(map[string]*memJob),
+	}
+}
+
+// добавляет заказ со статусом NEW в очередь опроса
+func (m *memStorage) addOrder(number string) {
+	if err := m.SetOrderStatus(context.Background(), number, schema.StatusOrderNew, 0); err != nil {
+		panic(err)
+	}
+}
+
+func (m *memStorage) status(number string) schema.StatusOrder {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	history := m.statuses[number]
+	if len(history) == 0 {
+		return ""
+	}
+	return history[len(history)-1]
+}
+
+func (m *memStorage) job(number string) (memJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[number]
+	if !ok {
+		return memJob{}, false
+	}
+	return *job, true
+}
+
+func (m *memStorage) SetOrderStatus(ctx context.Context, number string, status schema.StatusOrder, accrual float32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if status == schema.StatusOrderStale && m.staleErr != nil {
+		return m.staleErr
+	}
+	var current schema.StatusOrder
+	if history := m.statuses[number]; len(history) > 0 {
+		current = history[len(history)-1]
+	}
+	switch {
+	case current == schema.StatusOrderCancelled:
+		return errorapp.ErrAlreadyCancelled
+	case current == status:
+		return errorapp.ErrDuplicate
+	case !current.CanBecome(status):
+		return fmt.Errorf("%w: %s -> %s", errorapp.ErrInvalidTransition, current, status)
+	}
+	m.statuses[number] = append(m.statuses[number], status)
+	m.accruals[number] += accrual
+	switch status {
+	case schema.StatusOrderNew, schema.StatusOrderProcessing:
+		if _, ok := m.jobs[number]; !ok {
+			m.jobs[number] = &memJob{job: schema.AccrualJob{OrderNumber: number, CreatedAt: time.Now()}}
+		}
+		m.jobs[number].job.Status = status
+	default:
+		delete(m.jobs, number)
+	}
+	return nil
+}
+
+func (m *memStorage) ClaimAccrualJobs(ctx context.Context, owner string, limit int, lease time.Duration) ([]schema.AccrualJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]schema.AccrualJob, 0)
+	for _, job := range m.jobs {
+		if len(result) == limit {
+			break
+		}
+		if job.leased || job.nextAttemptAt.After(time.Now()) {
+			continue
+		}
+		job.leased = true
+		job.job.Attempts++
+		result = append(result, job.job)
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+func (m *memStorage) RescheduleAccrualJob(ctx context.Context, number string, owner string, nextAttemptAt time.Time, failure string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reschedules++
+	job, ok := m.jobs[number]
+	if !ok {
+		return nil
+	}
+	job.leased = false
+	job.nextAttemptAt = nextAttemptAt
+	job.job.LastError = failure
+	if failure == "" {
+		job.job.Failures = 0
+	} else {
+		job.job.Failures++
+	}
+	return nil
+}
+
+func (m *memStorage) GetAccrualQueueDepth(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.jobs), nil
+}
+
+// воркер без фонового опроса: пачки разбираются вызовом UpdateStatuses из теста
+func newTestWorker(db storage.Storage, accrual client.AccrualClient, cfg config.CfgAccrualWorker, poll time.Duration) *AccrualWorker {
+	return &AccrualWorker{
+		db:     db,
+		logger: zerolog.Nop(),
+		client: accrual,
+		owner:  "test",
+		cfg:    cfg,
+		live:   config.NewLive(config.Runtime{AccrualPoll: poll, AccrualBatchSize: 10, AccrualConcurrency: 1}),
+		rnd:    rand.New(rand.NewSource(1)),
+	}
+}
+
+// настройки без случайного разброса задержек
+func testConfig() config.CfgAccrualWorker {
+	return config.CfgAccrualWorker{
+		LeaseTimeout:   time.Minute,
+		RequestTimeout: time.Second,
+		RetryBaseDelay: time.Second,
+		RetryMaxDelay:  time.Minute,
+		MaxAttempts:    3,
+	}
+}
+
+func TestOrderProgression(t *testing.T) {
+	db := newMemStorage()
+	db.addOrder("12345678903")
+	fake := client.NewFake()
+	fake.Script("12345678903",
+		client.FakeStep{Answer: schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusRegistered}},
+		client.FakeStep{Answer: schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusProcessing}},
+		client.FakeStep{Answer: schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusProcessed, Accrual: 729.98}},
+	)
+	// нулевой интервал опроса: неконечный статус сразу возвращается в очередь
+	worker := newTestWorker(db, fake, testConfig(), 0)
+
+	// каждый тик опроса - один ответ сервиса
+	for i := 0; i < 4; i++ {
+		worker.UpdateStatuses(context.Background())
+	}
+
+	if calls := fake.Calls("12345678903"); calls != 3 {
+		t.Errorf("accrual service called %d times, want 3", calls)
+	}
+	want := []schema.StatusOrder{schema.StatusOrderNew, schema.StatusOrderProcessing, schema.StatusOrderProcessed}
+	if got := db.statuses["12345678903"]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("status history = %v, want %v: REGISTERED maps to PROCESSING, repeated PROCESSING is not recorded", got, want)
+	}
+	if accrual := db.accruals["12345678903"]; accrual != 729.98 {
+		t.Errorf("accrual = %v, want 729.98", accrual)
+	}
+	if _, ok := db.job("12345678903"); ok {
+		t.Error("processed order is still in the queue")
+	}
+}
+
+func TestFailuresBackOff(t *testing.T) {
+	cases := map[string]client.FakeStep{
+		"204 not registered": {Err: client.ErrNotRegistered},
+		"500 server error":   {Err: client.ErrServer},
+		"invalid response":   {Answer: schema.AnswerAccrualService{Order: "12345678903", Status: "UNKNOWN"}},
+	}
+	for name, step := range cases {
+		t.Run(name, func(t *testing.T) {
+			db := newMemStorage()
+			db.addOrder("12345678903")
+			fake := client.NewFake()
+			fake.Script("12345678903", step)
+			worker := newTestWorker(db, fake, testConfig(), time.Hour)
+
+			// первая ошибка - задержка RetryBaseDelay, вторая - вдвое больше
+			for failures, delay := range []time.Duration{time.Second, 2 * time.Second} {
+				start := time.Now()
+				worker.UpdateStatuses(context.Background())
+				job, ok := db.job("12345678903")
+				if !ok {
+					t.Fatal("order left the queue")
+				}
+				if job.job.Failures != failures+1 || job.job.LastError == "" {
+					t.Errorf("job %+v, want %d failures with last error", job.job, failures+1)
+				}
+				if next := job.nextAttemptAt.Sub(start); next < delay || next > delay+time.Second {
+					t.Errorf("next attempt in %s, want %s", next, delay)
+				}
+				db.jobs["12345678903"].nextAttemptAt = time.Time{}
+			}
+			if status := db.status("12345678903"); status != schema.StatusOrderNew {
+				t.Errorf("status = %s, want NEW until MaxAttempts", status)
+			}
+
+			// третья ошибка подряд достигает MaxAttempts, заказ снимается с опроса
+			worker.UpdateStatuses(context.Background())
+			if status := db.status("12345678903"); status != schema.StatusOrderStale {
+				t.Errorf("status = %s, want STALE after MaxAttempts", status)
+			}
+			if _, ok := db.job("12345678903"); ok {
+				t.Error("stale order is still in the queue")
+			}
+		})
+	}
+}
+
+func TestExpiredOrderGivesUp(t *testing.T) {
+	db := newMemStorage()
+	db.addOrder("12345678903")
+	db.jobs["12345678903"].job.CreatedAt = time.Now().Add(-2 * time.Hour)
+	fake := client.NewFake()
+	fake.Set("12345678903", schema.AccrualStatusProcessing, 0)
+	cfg := testConfig()
+	cfg.MaxAge = time.Hour
+	worker := newTestWorker(db, fake, cfg, time.Minute)
+
+	worker.UpdateStatuses(context.Background())
+
+	want := []schema.StatusOrder{schema.StatusOrderNew, schema.StatusOrderProcessing, schema.StatusOrderStale}
+	if got := db.statuses["12345678903"]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("status history = %v, want %v", got, want)
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxAttempts = 0
+	cfg.RetryJitter = 0.5
+	for i := 0; i < 20; i++ {
+		db := newMemStorage()
+		db.addOrder("12345678903")
+		db.jobs["12345678903"].job.Failures = 2
+		fake := client.NewFake()
+		fake.Script("12345678903", client.FakeStep{Err: client.ErrServer})
+		worker := newTestWorker(db, fake, cfg, time.Hour)
+		worker.rnd = rand.New(rand.NewSource(int64(i)))
+
+		start := time.Now()
+		worker.UpdateStatuses(context.Background())
+
+		// третья ошибка подряд: 4s, разброс уменьшает задержку не больше чем вдвое
+		job, _ := db.job("12345678903")
+		if next := job.nextAttemptAt.Sub(start); next < 2*time.Second || next > 4*time.Second+time.Second {
+			t.Errorf("next attempt in %s, want between 2s and 4s", next)
+		}
+	}
+}
+
+func TestGiveUpRetriesWhenStatusFails(t *testing.T) {
+	db := newMemStorage()
+	db.addOrder("12345678903")
+	db.staleErr = errors.New("db is down")
+	fake := client.NewFake()
+	fake.Script("12345678903", client.FakeStep{Err: client.ErrServer})
+	cfg := testConfig()
+	cfg.MaxAttempts = 1
+	worker := newTestWorker(db, fake, cfg, time.Hour)
+
+	start := time.Now()
+	worker.UpdateStatuses(context.Background())
+
+	// заказ не удалось снять с опроса, он остается в очереди до RetryMaxDelay
+	job, ok := db.job("12345678903")
+	if !ok {
+		t.Fatal("order left the queue")
+	}
+	if next := job.nextAttemptAt.Sub(start); next < cfg.RetryMaxDelay || next > cfg.RetryMaxDelay+time.Second {
+		t.Errorf("next attempt in %s, want RetryMaxDelay %s", next, cfg.RetryMaxDelay)
+	}
+	if status := db.status("12345678903"); status != schema.StatusOrderNew {
+		t.Errorf("status = %s, want NEW", status)
+	}
+}
+
+func TestTooManyRequestsPauses(t *testing.T) {
+	db := newMemStorage()
+	db.addOrder("12345678903")
+	db.addOrder("2377225624")
+	fake := client.NewFake()
+	limited := client.FakeStep{Err: &client.TooManyRequestsError{RetryAfter: time.Minute}}
+	fake.Script("12345678903", limited)
+	fake.Script("2377225624", limited)
+	worker := newTestWorker(db, fake, testConfig(), time.Hour)
+
+	start := time.Now()
+	worker.UpdateStatuses(context.Background())
+
+	// ответ 429 приостанавливает опрос всех заказов, попытки не засчитываются
+	if calls := fake.Calls("12345678903") + fake.Calls("2377225624"); calls != 1 {
+		t.Errorf("accrual service called %d times, want 1: the second order waits for the pause", calls)
+	}
+	pausedUntil := worker.paused()
+	if pause := pausedUntil.Sub(start); pause < time.Minute || pause > time.Minute+time.Second {
+		t.Errorf("paused for %s, want Retry-After of 1m", pause)
+	}
+	for _, number := range []string{"12345678903", "2377225624"} {
+		job, ok := db.job(number)
+		if !ok {
+			t.Fatalf("order %s left the queue", number)
+		}
+		if job.job.Failures != 0 || !job.nextAttemptAt.Equal(pausedUntil) {
+			t.Errorf("job %s %+v next attempt %s, want no failures and next attempt at the end of the pause %s",
+				number, job.job, job.nextAttemptAt, pausedUntil)
+		}
+	}
+}
+
+func TestInvalidTransitionDropsJob(t *testing.T) {
+	db := newMemStorage()
+	db.addOrder("12345678903")
+	fake := client.NewFake()
+	fake.Set("12345678903", schema.AccrualStatusInvalid, 0)
+	worker := newTestWorker(db, fake, testConfig(), time.Hour)
+	jobs, err := db.ClaimAccrualJobs(context.Background(), "test", 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// пока шел опрос, конечный статус пришел через callback
+	if err := worker.ApplyAnswer(context.Background(), schema.AnswerAccrualService{
+		Order: "12345678903", Status: schema.AccrualStatusProcessed, Accrual: 10,
+	}); err != nil {
+		t.Fatalf("ApplyAnswer: %v", err)
+	}
+
+	worker.processJob(context.Background(), jobs[0])
+
+	// ответ опроса устарел: задача не возвращается в очередь и ошибка не засчитывается
+	if db.reschedules != 0 {
+		t.Errorf("job rescheduled %d times, want 0", db.reschedules)
+	}
+	if status := db.status("12345678903"); status != schema.StatusOrderProcessed {
+		t.Errorf("status = %s, want PROCESSED from callback", status)
+	}
+	if db.accruals["12345678903"] != 10 {
+		t.Errorf("accrual = %v, want 10", db.accruals["12345678903"])
+	}
+}
+
+func TestApplyAnswerIsIdempotent(t *testing.T) {
+	db := newMemStorage()
+	db.addOrder("12345678903")
+	worker := newTestWorker(db, client.NewFake(), testConfig(), time.Hour)
+	answer := schema.AnswerAccrualService{Order: "12345678903", Status: schema.AccrualStatusProcessed, Accrual: 10}
+
+	for i := 0; i < 2; i++ {
+		if err := worker.ApplyAnswer(context.Background(), answer); err != nil {
+			t.Fatalf("ApplyAnswer %d: %v", i, err)
+		}
+	}
+	if db.accruals["12345678903"] != 10 {
+		t.Errorf("accrual = %v, want 10 recorded once", db.accruals["12345678903"])
+	}
+	answer.Status = schema.AccrualStatusInvalid
+	if err := worker.ApplyAnswer(context.Background(), answer); !errors.Is(err, errorapp.ErrInvalidTransition) {
+		t.Errorf("ApplyAnswer after final status error = %v, want ErrInvalidTransition", err)
+	}
+}
@@ -0,0 +1,57 @@
+package balancecheck
+
+import (
+	"context"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+	"github.com/rs/zerolog"
+)
+
+// пакет периодически сверяет снимки балансов пользователей с журналом и сообщает о расхождениях
+
+type Checker struct {
+	db     storage.Storage
+	logger zerolog.Logger
+}
+
+// запускает сверку в горутине с интервалом из конфига, нулевой интервал отключает сверку
+func Run(db storage.Storage, logger zerolog.Logger, cfg config.CfgBalanceCheck) {
+	if cfg.Interval <= 0 {
+		logger.Info().Msg("Сверка балансов отключена")
+		return
+	}
+	checker := Checker{db: db, logger: logger}
+	ticker := time.NewTicker(cfg.Interval)
+	go func() {
+		for range ticker.C {
+			checker.Check()
+		}
+	}()
+	logger.Info().Msgf("Сверка балансов запущена, интервал %s", cfg.Interval)
+}
+
+// пересчитывает балансы по журналу и пишет в лог каждое расхождение
+func (c *Checker) Check() {
+	ctx := context.Background()
+	total, err := c.db.GetLedgerTotal(ctx)
+	if err != nil {
+		c.logger.Error().Err(err).Msg("ошибка при подсчете суммы журнала; err is here 5120773;")
+	} else if total != 0 {
+		c.logger.Error().Msgf("сумма движений журнала не равна 0: %v; err is here 5120774;", total)
+	}
+
+	drifts, err := c.db.CheckBalances(ctx)
+	if err != nil {
+		c.logger.Error().Err(err).Msg("ошибка при сверке балансов; err is here 5120775;")
+		return
+	}
+	for _, d := range drifts {
+		c.logger.Error().Msgf(
+			"расхождение баланса пользователя %d: снимок %v/%v, журнал %v/%v (текущий/списано);",
+			d.UserID, d.Current, d.Withdrawn, d.LedgerCurrent, d.LedgerWithdrawn,
+		)
+	}
+	c.logger.Debug().Msgf("сверка балансов завершена, расхождений: %d", len(drifts))
+}
@@ -10,3 +10,11 @@ var ErrWrongLoginPassword error = errors.New("wrong login or password")
 var ErrAlreadyAdded error = errors.New("order number already added")
 var ErrEmptyResult error = errors.New("empty result for query")
 var ErrNotEnoughFunds error = errors.New("there are not enough bonuses on the balance")
+var ErrUnbalancedEntry error = errors.New("ledger entry postings do not sum to zero")
+var ErrInvalidEntry error = errors.New("invalid ledger entry")
+var ErrAlreadyReversed error = errors.New("ledger entry already reversed")
+var ErrAlreadyCancelled error = errors.New("order already cancelled")
+var ErrInvalidTransition error = errors.New("order status transition is not allowed")
+var ErrInvalidWebhookEndpoint error = errors.New("invalid webhook endpoint")
+var ErrFeatureDisabled error = errors.New("feature is disabled")
+var ErrWithdrawalLimit error = errors.New("withdrawal sum is out of allowed limits")
@@ -0,0 +1,75 @@
+package expiration
+
+import (
+	"context"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+	"github.com/rs/zerolog"
+)
+
+// пакет фонового сгорания баллов: остатки начислений старше срока жизни списываются проводкой сгорания
+
+// сколько пользователей обрабатывается за один проход
+const batchSize = 100
+
+type Expirer struct {
+	db     storage.Storage
+	logger zerolog.Logger
+	ttl    time.Duration
+}
+
+// запускает сгорание баллов в горутине, нулевой срок жизни баллов отключает сгорание
+func Run(db storage.Storage, logger zerolog.Logger, cfg config.CfgExpiration) {
+	if cfg.TTL <= 0 {
+		logger.Info().Msg("Сгорание баллов отключено")
+		return
+	}
+	if cfg.Interval <= 0 {
+		logger.Error().Msgf("интервал сгорания баллов должен быть положительным, задан %s, сгорание отключено; err is here 9043323;", cfg.Interval)
+		return
+	}
+	expirer := Expirer{db: db, logger: logger, ttl: cfg.TTL}
+	ticker := time.NewTicker(cfg.Interval)
+	go func() {
+		for range ticker.C {
+			expirer.Expire()
+		}
+	}()
+	logger.Info().Msgf("Сгорание баллов запущено, срок жизни баллов %s", cfg.TTL)
+}
+
+// сжигает все просроченные остатки начислений.
+// пользователи перебираются по возрастанию id, ошибка у одного пользователя не прерывает проход
+func (e *Expirer) Expire() {
+	ctx := context.Background()
+	creditedBefore := time.Now().Add(-e.ttl)
+	expired, failed := 0, 0
+	var afterUserID uint16
+	for {
+		users, err := e.db.GetExpiringUsers(ctx, creditedBefore, afterUserID, batchSize)
+		if err != nil {
+			e.logger.Error().Err(err).Msg("ошибка при выборке пользователей со сгорающими баллами; err is here 9043321;")
+			break
+		}
+		for _, userID := range users {
+			ok, err := e.db.ExpireUserCreditLots(ctx, userID, creditedBefore)
+			if err != nil {
+				failed++
+				e.logger.Error().Err(err).Msgf("ошибка при сгорании баллов пользователя %d; err is here 9043322;", userID)
+				continue
+			}
+			if ok {
+				expired++
+			}
+		}
+		if len(users) < batchSize {
+			break
+		}
+		afterUserID = users[len(users)-1]
+	}
+	if expired > 0 || failed > 0 {
+		e.logger.Info().Msgf("сгорели баллы у пользователей: %d, с ошибкой: %d;", expired, failed)
+	}
+}
@@ -0,0 +1,82 @@
+package expiration
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+	"github.com/rs/zerolog"
+)
+
+// хранилище с пользователями, у которых есть сгорающие баллы; остальные методы не используются
+type memStorage struct {
+	storage.Storage
+	pending map[uint16]bool // пользователи с просроченными партиями
+	failing map[uint16]bool // сгорание у этих пользователей завершается ошибкой
+	empty   map[uint16]bool // выбраны, но сжигать нечего (партии потрачены после выборки)
+	calls   map[uint16]int  // сколько раз вызывалось сгорание пользователя
+}
+
+func newMemStorage(users int) *memStorage {
+	m := &memStorage{
+		pending: make(map[uint16]bool),
+		failing: make(map[uint16]bool),
+		empty:   make(map[uint16]bool),
+		calls:   make(map[uint16]int),
+	}
+	for id := 1; id <= users; id++ {
+		m.pending[uint16(id)] = true
+	}
+	return m
+}
+
+func (m *memStorage) GetExpiringUsers(ctx context.Context, creditedBefore time.Time, afterUserID uint16, limit int) ([]uint16, error) {
+	users := make([]uint16, 0)
+	for userID := range m.pending {
+		if userID > afterUserID {
+			users = append(users, userID)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (m *memStorage) ExpireUserCreditLots(ctx context.Context, userID uint16, creditedBefore time.Time) (bool, error) {
+	m.calls[userID]++
+	if m.failing[userID] {
+		return false, errors.New("deadlock detected")
+	}
+	delete(m.pending, userID)
+	return !m.empty[userID], nil
+}
+
+func TestExpireWalksAllUsers(t *testing.T) {
+	// больше двух пачек; в первой пачке ошибка и пользователь без сгоревших баллов
+	db := newMemStorage(2*batchSize + 5)
+	db.failing[3] = true
+	db.empty[7] = true
+	expirer := Expirer{db: db, logger: zerolog.Nop(), ttl: time.Hour}
+
+	expirer.Expire()
+
+	if len(db.pending) != 1 || !db.pending[3] {
+		t.Errorf("pending users = %v, want only the failing user 3", db.pending)
+	}
+	for userID := uint16(1); userID <= 2*batchSize+5; userID++ {
+		if db.calls[userID] != 1 {
+			t.Errorf("user %d expired %d times, want once", userID, db.calls[userID])
+		}
+	}
+}
+
+func TestRunWithoutInterval(t *testing.T) {
+	// некорректный интервал отключает сгорание вместо паники в time.NewTicker
+	Run(newMemStorage(1), zerolog.Nop(), config.CfgExpiration{TTL: time.Hour})
+}
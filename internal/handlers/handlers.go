@@ -1,34 +1,58 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/accrual/client"
+	"github.com/bubu256/gophermart_pet/internal/accrual/worker"
 	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/health"
 	"github.com/bubu256/gophermart_pet/internal/mediator"
+	"github.com/bubu256/gophermart_pet/internal/metrics"
 	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/internal/tracing"
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
 )
 
 // хендлеры и роутинг
 
+// интервал пустых сообщений в потоке событий пользователя
+const keepAliveInterval = 15 * time.Second
+
 type Handler struct {
-	Mediator *mediator.Mediator
-	logger   zerolog.Logger
-	Router   *chi.Mux
+	Mediator   *mediator.Mediator
+	accrual    *worker.AccrualWorker
+	health     *health.Checker
+	logger     zerolog.Logger
+	Router     *chi.Mux
+	adminToken string
 }
 
-func New(mediator *mediator.Mediator, cfg config.CfgServer, logger zerolog.Logger) *Handler {
-	handler := Handler{Mediator: mediator, logger: logger, Router: chi.NewRouter()}
+func New(mediator *mediator.Mediator, accrual *worker.AccrualWorker, checker *health.Checker, cfg config.CfgServer, logger zerolog.Logger) *Handler {
+	handler := Handler{Mediator: mediator, accrual: accrual, health: checker, logger: logger, Router: chi.NewRouter(), adminToken: cfg.AdminToken}
 	handler.MountBaseRouter()
 	return &handler
 }
 
 func (h *Handler) MountBaseRouter() {
+	// метрики запросов, мидлвар подключается до объявления маршрутов
+	h.Router.Use(tracing.Middleware)
+	h.Router.Use(metrics.Middleware)
+	h.Router.Handle("/metrics", metrics.Handler())
+	// пробы Kubernetes
+	h.Router.Get("/healthz", h.GetHealthz)
+	h.Router.Get("/readyz", h.GetReadyz)
+
 	// хендлеры с проверкой токена в мидлваре
 	privateRouter := chi.NewRouter()
 	privateRouter.Use(h.MiddlewareTokenChecker)
@@ -37,11 +61,30 @@ func (h *Handler) MountBaseRouter() {
 	privateRouter.Get("/api/user/balance", h.GetUserBalance)
 	privateRouter.Post("/api/user/balance/withdraw", h.PostUserBalanceWithdraw)
 	privateRouter.Get("/api/user/withdrawals", h.GetUserWithdrawals)
+	privateRouter.Get("/api/user/events", h.GetUserEvents)
 	h.Router.Mount("/", privateRouter)
 
 	// хендлеры без мидлвара на проверку токена
 	h.Router.Post("/api/user/register", h.UserRegister)
 	h.Router.Post("/api/user/login", h.UserLogin)
+
+	// административные хендлеры с проверкой токена администратора
+	adminRouter := chi.NewRouter()
+	adminRouter.Use(h.MiddlewareAdminChecker)
+	adminRouter.Post("/orders/{number}/cancel", h.PostAdminOrderCancel)
+	adminRouter.Get("/orders/stale", h.GetAdminStaleOrders)
+	adminRouter.Post("/webhooks", h.PostAdminWebhook)
+	adminRouter.Get("/webhooks", h.GetAdminWebhooks)
+	adminRouter.Delete("/webhooks/{id}", h.DeleteAdminWebhook)
+	adminRouter.Post("/webhooks/{id}/replay", h.PostAdminWebhookReplay)
+	adminRouter.Get("/webhooks/deliveries", h.GetAdminWebhookDeliveries)
+	adminRouter.Post("/webhooks/deliveries/{id}/replay", h.PostAdminWebhookDeliveryReplay)
+	h.Router.Mount("/api/admin", adminRouter)
+
+	// статусы заказов от аккрол сервиса, запрос подписывается HMAC
+	h.Router.Post("/internal/accrual/callback", h.PostAccrualCallback)
+	// журнал доменных событий для внутренних потребителей, доступ по токену администратора
+	h.Router.With(h.MiddlewareAdminChecker).Get("/internal/events", h.GetInternalEvents)
 }
 
 // ============Middlewares===============//
@@ -63,6 +106,23 @@ func (h *Handler) MiddlewareTokenChecker(next http.Handler) http.Handler {
 	})
 }
 
+// Проверяет токен администратора из заголовка Authorization: Bearer <token>.
+// Пока токен не задан в конфиге, административное API недоступно
+func (h *Handler) MiddlewareAdminChecker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.adminToken == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 //============Middlewares===============//
 //......................................//
 //============Handlers==================//
@@ -87,19 +147,23 @@ func (h *Handler) UserRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// отдаем медиатору для хеширования и записи в бд
-	err = h.Mediator.SetNewUser(loginPassword)
+	err = h.Mediator.SetNewUser(r.Context(), loginPassword)
 	if err != nil {
 		if errors.Is(err, errorapp.ErrDuplicate) {
 			w.WriteHeader(http.StatusConflict)
 			return
 		}
+		if errors.Is(err, errorapp.ErrFeatureDisabled) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 		h.logger.Error().Err(err).Msg("error is here 65151321")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	// берем токен авторизации и пишем в куки
-	token, err := h.Mediator.GetTokenAuthorization(loginPassword)
+	token, err := h.Mediator.GetTokenAuthorization(r.Context(), loginPassword)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		h.logger.Error().Err(err).Msg("ошибка аутентификации после регистрации пользователя; error is here 3468453;")
@@ -130,7 +194,7 @@ func (h *Handler) UserLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// берем токен авторизации и пишем в куки
-	token, err := h.Mediator.GetTokenAuthorization(loginPassword)
+	token, err := h.Mediator.GetTokenAuthorization(r.Context(), loginPassword)
 	if err != nil {
 		if errors.Is(err, errorapp.ErrWrongLoginPassword) {
 			w.WriteHeader(http.StatusUnauthorized)
@@ -170,7 +234,7 @@ func (h *Handler) PostUserOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// добавляем заказ
-	err = h.Mediator.SetNewOrder(cookieToken.Value, numberOrder)
+	err = h.Mediator.SetNewOrder(r.Context(), cookieToken.Value, numberOrder)
 	switch {
 	case errors.Is(err, errorapp.ErrDuplicate):
 		// номер уже добавлен другим пользователем
@@ -202,7 +266,7 @@ func (h *Handler) GetUserOrders(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// h.logger.Debug().Msg("i am here. 2")
-	orders, err := h.Mediator.GetUserOrders(cookieToken.Value)
+	orders, err := h.Mediator.GetUserOrders(r.Context(), cookieToken.Value)
 	if err != nil {
 		if errors.Is(err, errorapp.ErrEmptyResult) {
 			w.WriteHeader(http.StatusNoContent)
@@ -235,7 +299,7 @@ func (h *Handler) GetUserBalance(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	balance, err := h.Mediator.GetUserBalance(cookieToken.Value)
+	balance, err := h.Mediator.GetUserBalance(r.Context(), cookieToken.Value)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("ошибка при получении баланса; err is here 64815168';")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -282,12 +346,20 @@ func (h *Handler) PostUserBalanceWithdraw(w http.ResponseWriter, r *http.Request
 		return
 	}
 	// списание
-	err = h.Mediator.UserBalanceWithdraw(cookieToken.Value, orderSum)
+	err = h.Mediator.UserBalanceWithdraw(r.Context(), cookieToken.Value, orderSum)
 	if err != nil {
 		if errors.Is(err, errorapp.ErrNotEnoughFunds) {
 			w.WriteHeader(http.StatusPaymentRequired)
 			return
 		}
+		if errors.Is(err, errorapp.ErrWithdrawalLimit) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errorapp.ErrFeatureDisabled) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -304,7 +376,7 @@ func (h *Handler) GetUserWithdrawals(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	withdrawals, err := h.Mediator.GetUserWithdrawals(cookieToken.Value)
+	withdrawals, err := h.Mediator.GetUserWithdrawals(r.Context(), cookieToken.Value)
 	if err != nil {
 		if errors.Is(err, errorapp.ErrEmptyResult) {
 			w.WriteHeader(http.StatusNoContent)
@@ -325,5 +397,390 @@ func (h *Handler) GetUserWithdrawals(w http.ResponseWriter, r *http.Request) {
 	w.Write(byteWithdrawals)
 }
 
+// Поток изменений заказов и баланса пользователя (Server-Sent Events).
+// Первым событием отправляется текущий баланс, дальше события по мере изменений
+// Хендлер: GET /api/user/events
+func (h *Handler) GetUserEvents(w http.ResponseWriter, r *http.Request) {
+	cookieToken, err := r.Cookie("token")
+	if err != nil {
+		h.logger.Error().Err(err).Msg("ошибка при чтении токена из кук; error is here 16813145689")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.logger.Error().Msg("ResponseWriter не поддерживает потоковую передачу; err is here 4107738;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// подписка до чтения баланса, чтобы не потерять изменения между ними
+	events, unsubscribe, err := h.Mediator.SubscribeUserEvents(r.Context(), cookieToken.Value)
+	if errors.Is(err, errorapp.ErrFeatureDisabled) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Msg("ошибка при подписке на события пользователя; err is here 4107739;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer unsubscribe()
+	balance, err := h.Mediator.GetUserBalance(r.Context(), cookieToken.Value)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("ошибка при получении баланса; err is here 4107740;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := writeEvent(w, schema.UserEvent{Type: schema.UserEventBalance, Balance: &balance}); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	// комментарий раз в keepAliveInterval не дает прокси закрыть простаивающее соединение
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			event.Status = event.Status.UserFacing()
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// пишет событие в формате Server-Sent Events: имя события - тип, данные - json
+func writeEvent(w io.Writer, event schema.UserEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+// Отмена заказа с возвратом начисленных баллов
+// Хендлер: POST /api/admin/orders/{number}/cancel
+func (h *Handler) PostAdminOrderCancel(w http.ResponseWriter, r *http.Request) {
+	numberOrder := chi.URLParam(r, "number")
+	// тело необязательное, в нем можно передать комментарий к отмене
+	cancelRequest := schema.CancelRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("ошибка при чтении тела запроса; err is here 4107731;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &cancelRequest)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := h.Mediator.CancelOrder(r.Context(), numberOrder, cancelRequest.Comment)
+	switch {
+	case errors.Is(err, errorapp.ErrEmptyResult):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, errorapp.ErrAlreadyCancelled):
+		w.WriteHeader(http.StatusConflict)
+		return
+	case err != nil:
+		h.logger.Error().Err(err).Msg("ошибка при отмене заказа; err is here 4107732;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	byteResult, err := json.Marshal(result)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("ошибка кодирования в json; err is here 4107733;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(byteResult)
+}
+
+// Заказы снятые с опроса аккрол сервиса
+// Хендлер: GET /api/admin/orders/stale
+func (h *Handler) GetAdminStaleOrders(w http.ResponseWriter, r *http.Request) {
+	orders, err := h.Mediator.GetStaleOrders(r.Context())
+	if err != nil {
+		if errors.Is(err, errorapp.ErrEmptyResult) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.logger.Error().Err(err).Msg("ошибка при получении списка заказов STALE; err is here 4107734;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ordersByte, err := json.Marshal(orders)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("ошибка кодирования списка заказов в json; err is here 4107735;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ordersByte)
+}
+
+// Регистрация получателя вебхуков, тело - {"url", "secret", "event_types"}.
+// Ответ содержит секрет подписи, больше он нигде не показывается
+// Хендлер: POST /api/admin/webhooks
+func (h *Handler) PostAdminWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	endpoint := schema.WebhookEndpoint{}
+	err := json.NewDecoder(r.Body).Decode(&endpoint)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	endpoint, err = h.Mediator.CreateWebhookEndpoint(r.Context(), endpoint)
+	switch {
+	case errors.Is(err, errorapp.ErrInvalidWebhookEndpoint):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		h.logger.Error().Err(err).Msg("ошибка при регистрации получателя вебхуков; err is here 4107741;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, http.StatusCreated, endpoint)
+}
+
+// Список получателей вебхуков
+// Хендлер: GET /api/admin/webhooks
+func (h *Handler) GetAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	endpoints, err := h.Mediator.GetWebhookEndpoints(r.Context())
+	switch {
+	case errors.Is(err, errorapp.ErrEmptyResult):
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case err != nil:
+		h.logger.Error().Err(err).Msg("ошибка при получении получателей вебхуков; err is here 4107742;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, endpoints)
+}
+
+// Удаление получателя вебхуков вместе с его доставками
+// Хендлер: DELETE /api/admin/webhooks/{id}
+func (h *Handler) DeleteAdminWebhook(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = h.Mediator.DeleteWebhookEndpoint(r.Context(), endpointID)
+	switch {
+	case errors.Is(err, errorapp.ErrEmptyResult):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		h.logger.Error().Err(err).Msg("ошибка при удалении получателя вебхуков; err is here 4107743;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Повтор всех неудачных доставок получателю
+// Хендлер: POST /api/admin/webhooks/{id}/replay
+func (h *Handler) PostAdminWebhookReplay(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	replayed, err := h.Mediator.ReplayWebhookEndpoint(r.Context(), endpointID)
+	switch {
+	case errors.Is(err, errorapp.ErrEmptyResult):
+		// получателя нет; без неудачных доставок ответ 200 с нулем
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		h.logger.Error().Err(err).Msg("ошибка при повторе доставок вебхуков; err is here 4107744;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, map[string]int{"replayed": replayed})
+}
+
+// Последние доставки вебхуков, ?status=PENDING|DELIVERED|FAILED, по умолчанию FAILED
+// Хендлер: GET /api/admin/webhooks/deliveries
+func (h *Handler) GetAdminWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := h.Mediator.GetWebhookDeliveries(r.Context(), r.URL.Query().Get("status"))
+	switch {
+	case errors.Is(err, errorapp.ErrInvalidWebhookEndpoint):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errorapp.ErrEmptyResult):
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case err != nil:
+		h.logger.Error().Err(err).Msg("ошибка при получении доставок вебхуков; err is here 4107745;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, deliveries)
+}
+
+// Повтор неудачной доставки вебхука
+// Хендлер: POST /api/admin/webhooks/deliveries/{id}/replay
+func (h *Handler) PostAdminWebhookDeliveryReplay(w http.ResponseWriter, r *http.Request) {
+	deliveryID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = h.Mediator.ReplayWebhookDelivery(r.Context(), deliveryID)
+	switch {
+	case errors.Is(err, errorapp.ErrEmptyResult):
+		// доставки нет или она не в статусе FAILED
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		h.logger.Error().Err(err).Msg("ошибка при повторе доставки вебхука; err is here 4107746;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// События журнала после смещения, ?offset=N&limit=M.
+// Потребитель продолжает чтение со смещения последнего полученного события
+// Хендлер: GET /internal/events
+func (h *Handler) GetInternalEvents(w http.ResponseWriter, r *http.Request) {
+	var offset int64
+	var limit int
+	var err error
+	if value := r.URL.Query().Get("offset"); value != "" {
+		offset, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	events, err := h.Mediator.GetEvents(r.Context(), offset, limit)
+	switch {
+	case errors.Is(err, errorapp.ErrEmptyResult):
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case err != nil:
+		h.logger.Error().Err(err).Msg("ошибка при чтении журнала событий; err is here 4107748;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, events)
+}
+
+// Живость процесса
+// Хендлер: GET /healthz
+func (h *Handler) GetHealthz(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, http.StatusOK, h.health.Live())
+}
+
+// Готовность принимать запросы: БД, миграции, воркер аккрол и выключатель аккрол сервиса.
+// 503, если хотя бы одна проверка провалена
+// Хендлер: GET /readyz
+func (h *Handler) GetReadyz(w http.ResponseWriter, r *http.Request) {
+	report, ready := h.health.Ready(r.Context())
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	h.writeJSON(w, status, report)
+}
+
+// пишет ответ в json
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, value any) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("ошибка кодирования в json; err is here 4107747;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Статус заказа от аккрол сервиса, тело - schema.AnswerAccrualService,
+// подпись - hex HMAC-SHA256 тела в заголовке X-Signature.
+// Пока ключ подписи не задан в конфиге, хендлер недоступен
+// Хендлер: POST /internal/accrual/callback
+func (h *Handler) PostAccrualCallback(w http.ResponseWriter, r *http.Request) {
+	if h.accrual == nil || !h.accrual.CallbackEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("ошибка при чтении тела запроса; err is here 4107736;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !h.accrual.VerifySignature(body, r.Header.Get("X-Signature")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	answer := schema.AnswerAccrualService{}
+	err = json.Unmarshal(body, &answer)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := client.Validate(answer.Order, answer); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = h.accrual.ApplyAnswer(r.Context(), answer)
+	switch {
+	case errors.Is(err, errorapp.ErrEmptyResult):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, errorapp.ErrInvalidTransition), errors.Is(err, errorapp.ErrAlreadyCancelled):
+		w.WriteHeader(http.StatusConflict)
+		return
+	case err != nil:
+		h.logger.Error().Err(err).Msg("ошибка при обновлении статуса заказа по callback; err is here 4107737;")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 //============Handlers==================//
 //......................................//
@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/accrual/worker"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/breaker"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+)
+
+// пакет проверок живости и готовности приложения для /healthz и /readyz.
+// приложение не готово, если недоступна БД, схема БД не совпадает с миграциями приложения
+// или воркер аккрол перестал обращаться к очереди. разомкнутый выключатель аккрол сервиса
+// только понижает статус до degraded: внешний сервис недоступен для всех экземпляров сразу
+
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+	StatusFail     = "fail"
+)
+
+type Checker struct {
+	db     storage.Storage
+	worker *worker.AccrualWorker
+	cfg    config.CfgHealth
+}
+
+func New(db storage.Storage, accrual *worker.AccrualWorker, cfg config.CfgHealth) *Checker {
+	return &Checker{db: db, worker: accrual, cfg: cfg}
+}
+
+// живость: процесс отвечает на запросы
+func (c *Checker) Live() schema.HealthReport {
+	return schema.HealthReport{Status: StatusOK}
+}
+
+// готовность принимать запросы; ready false - хотя бы одна проверка провалена
+func (c *Checker) Ready(ctx context.Context) (report schema.HealthReport, ready bool) {
+	report = schema.HealthReport{Status: StatusOK, Checks: map[string]schema.HealthCheck{
+		"database":       c.checkDatabase(ctx),
+		"migrations":     c.checkMigrations(ctx),
+		"accrual_worker": c.checkWorker(),
+	}}
+	if c.worker != nil {
+		if state, ok := c.worker.BreakerState(); ok {
+			report.Checks["accrual_breaker"] = checkBreaker(state)
+		}
+	}
+	for _, check := range report.Checks {
+		switch {
+		case check.Status == StatusFail:
+			report.Status = StatusFail
+		case check.Status == StatusDegraded && report.Status == StatusOK:
+			report.Status = StatusDegraded
+		}
+	}
+	return report, report.Status != StatusFail
+}
+
+func (c *Checker) checkDatabase(ctx context.Context) schema.HealthCheck {
+	start := time.Now()
+	err := c.db.Ping(ctx)
+	details := map[string]any{"latency_ms": time.Since(start).Milliseconds()}
+	if err != nil {
+		return schema.HealthCheck{Status: StatusFail, Error: err.Error(), Details: details}
+	}
+	return schema.HealthCheck{Status: StatusOK, Details: details}
+}
+
+func (c *Checker) checkMigrations(ctx context.Context) schema.HealthCheck {
+	status, err := c.db.GetMigrationStatus(ctx)
+	if err != nil {
+		return schema.HealthCheck{Status: StatusFail, Error: err.Error()}
+	}
+	details := map[string]any{"version": status.Version, "expected": status.Expected, "dirty": status.Dirty}
+	switch {
+	case status.Dirty:
+		return schema.HealthCheck{Status: StatusFail, Error: "migration was interrupted", Details: details}
+	case status.Version < status.Expected:
+		return schema.HealthCheck{Status: StatusFail, Error: "migrations are not applied", Details: details}
+	}
+	// версия схемы новее миграций приложения допустима: так бывает при раскатке новой версии
+	return schema.HealthCheck{Status: StatusOK, Details: details}
+}
+
+func (c *Checker) checkWorker() schema.HealthCheck {
+	if c.worker == nil {
+		return schema.HealthCheck{Status: StatusOK, Details: map[string]any{"enabled": false}}
+	}
+	lastTick := c.worker.LastTick()
+	details := map[string]any{"last_tick": lastTick.Format(time.RFC3339)}
+	if age := time.Since(lastTick); c.cfg.WorkerMaxAge > 0 && age > c.cfg.WorkerMaxAge {
+		return schema.HealthCheck{Status: StatusFail, Error: fmt.Sprintf("no successful tick for %s", age.Round(time.Second)), Details: details}
+	}
+	return schema.HealthCheck{Status: StatusOK, Details: details}
+}
+
+func checkBreaker(state breaker.State) schema.HealthCheck {
+	details := map[string]any{"state": state.String()}
+	if state == breaker.StateOpen {
+		return schema.HealthCheck{Status: StatusDegraded, Error: "accrual service is unavailable", Details: details}
+	}
+	return schema.HealthCheck{Status: StatusOK, Details: details}
+}
@@ -0,0 +1,171 @@
+package ledger
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+)
+
+// пакет формирует проводки журнала двойной записи и проверяет их инварианты.
+// каждая проводка состоит из движений по счетам, сумма которых всегда равна 0,
+// поэтому сумма по всему журналу тоже всегда равна 0.
+
+// коды системных счетов
+const (
+	AccountAccrual    = "ACCRUAL"    // источник начисленных баллов
+	AccountWithdrawal = "WITHDRAWAL" // получатель списанных баллов
+	AccountAdjustment = "ADJUSTMENT" // корректировки баланса вручную
+	AccountExpiration = "EXPIRATION" // получатель сгоревших баллов
+)
+
+// счет пользователя
+func UserAccount(userID uint16) schema.LedgerAccount {
+	return schema.LedgerAccount{UserID: userID}
+}
+
+// системный счет
+func SystemAccount(code string) schema.LedgerAccount {
+	return schema.LedgerAccount{Code: code}
+}
+
+// начисление баллов пользователю за заказ
+func Accrual(userID uint16, orderNumber string, amount float32) schema.LedgerEntry {
+	return schema.LedgerEntry{
+		Kind:        schema.LedgerEntryAccrual,
+		OrderNumber: orderNumber,
+		Postings: []schema.Posting{
+			{Account: UserAccount(userID), Amount: amount},
+			{Account: SystemAccount(AccountAccrual), Amount: -amount},
+		},
+	}
+}
+
+// списание баллов пользователя в счет оплаты заказа
+func Withdrawal(userID uint16, orderNumber string, sum float32) schema.LedgerEntry {
+	return schema.LedgerEntry{
+		Kind:        schema.LedgerEntryWithdrawal,
+		OrderNumber: orderNumber,
+		Postings: []schema.Posting{
+			{Account: UserAccount(userID), Amount: -sum},
+			{Account: SystemAccount(AccountWithdrawal), Amount: sum},
+		},
+	}
+}
+
+// корректировка баланса пользователя на amount (может быть отрицательной)
+func Adjustment(userID uint16, amount float32, comment string) schema.LedgerEntry {
+	return schema.LedgerEntry{
+		Kind:    schema.LedgerEntryAdjustment,
+		Comment: comment,
+		Postings: []schema.Posting{
+			{Account: UserAccount(userID), Amount: amount},
+			{Account: SystemAccount(AccountAdjustment), Amount: -amount},
+		},
+	}
+}
+
+// сгорание баллов пользователя
+func Expiration(userID uint16, amount float32) schema.LedgerEntry {
+	return schema.LedgerEntry{
+		Kind: schema.LedgerEntryExpiration,
+		Postings: []schema.Posting{
+			{Account: UserAccount(userID), Amount: -amount},
+			{Account: SystemAccount(AccountExpiration), Amount: amount},
+		},
+	}
+}
+
+// сгорание баллов пользователя на точную сумму в десятичной записи.
+// сумма остатков партий читается из БД и не округляется до float32,
+// иначе проводка разойдется с обнуленными партиями
+func ExpirationDecimal(userID uint16, amount string) (schema.LedgerEntry, error) {
+	value, ok := new(big.Rat).SetString(amount)
+	if !ok || value.Sign() <= 0 {
+		return schema.LedgerEntry{}, fmt.Errorf("%w: invalid expiration amount %q", errorapp.ErrInvalidEntry, amount)
+	}
+	approx, _ := value.Float32()
+	entry := Expiration(userID, approx)
+	entry.Postings[0].Exact = "-" + amount
+	entry.Postings[1].Exact = amount
+	return entry, nil
+}
+
+// сторнирующая проводка: те же счета с противоположными суммами
+func Reversal(entry schema.LedgerEntry, comment string) schema.LedgerEntry {
+	postings := make([]schema.Posting, 0, len(entry.Postings))
+	for _, p := range entry.Postings {
+		postings = append(postings, schema.Posting{Account: p.Account, Amount: -p.Amount})
+	}
+	return schema.LedgerEntry{
+		Kind:        schema.LedgerEntryReversal,
+		OrderNumber: entry.OrderNumber,
+		ReversesID:  entry.ID,
+		Comment:     comment,
+		Postings:    postings,
+	}
+}
+
+// проверяет проводку перед записью в журнал:
+// не меньше двух движений, без нулевых сумм и повторов счетов, сумма движений равна 0
+func Validate(entry schema.LedgerEntry) error {
+	switch entry.Kind {
+	case schema.LedgerEntryAccrual, schema.LedgerEntryWithdrawal, schema.LedgerEntryAdjustment, schema.LedgerEntryExpiration:
+	case schema.LedgerEntryReversal:
+		if entry.ReversesID == 0 {
+			return fmt.Errorf("%w: reversal without reversed entry", errorapp.ErrInvalidEntry)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", errorapp.ErrInvalidEntry, entry.Kind)
+	}
+	if len(entry.Postings) < 2 {
+		return fmt.Errorf("%w: at least two postings required", errorapp.ErrInvalidEntry)
+	}
+	accounts := make(map[schema.LedgerAccount]struct{}, len(entry.Postings))
+	for _, p := range entry.Postings {
+		if (p.Account.UserID == 0) == (p.Account.Code == "") {
+			return fmt.Errorf("%w: posting account must be either user or system account", errorapp.ErrInvalidEntry)
+		}
+		if _, ok := accounts[p.Account]; ok {
+			return fmt.Errorf("%w: duplicate account in postings", errorapp.ErrInvalidEntry)
+		}
+		accounts[p.Account] = struct{}{}
+		amount, ok := new(big.Rat).SetString(PostingDecimal(p))
+		if !ok {
+			return fmt.Errorf("%w: invalid posting amount %q", errorapp.ErrInvalidEntry, PostingDecimal(p))
+		}
+		if amount.Sign() == 0 {
+			return fmt.Errorf("%w: zero posting amount", errorapp.ErrInvalidEntry)
+		}
+	}
+	if Sum(entry.Postings).Sign() != 0 {
+		return errorapp.ErrUnbalancedEntry
+	}
+	return nil
+}
+
+// точная сумма движений.
+// суммы переводятся в десятичную запись так же, как они сохраняются в БД (см. PostingDecimal)
+func Sum(postings []schema.Posting) *big.Rat {
+	sum := new(big.Rat)
+	for _, p := range postings {
+		amount, _ := new(big.Rat).SetString(PostingDecimal(p))
+		sum.Add(sum, amount)
+	}
+	return sum
+}
+
+// кратчайшая десятичная запись суммы, в таком виде суммы пишутся в NUMERIC колонки
+func Decimal(amount float32) string {
+	return strconv.FormatFloat(float64(amount), 'f', -1, 32)
+}
+
+// десятичная запись суммы движения: точная сумма, если задана, иначе запись Amount
+func PostingDecimal(p schema.Posting) string {
+	if p.Exact != "" {
+		return p.Exact
+	}
+	return Decimal(p.Amount)
+}
@@ -0,0 +1,161 @@
+package ledger
+
+import (
+	"errors"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+)
+
+func TestEntriesAreBalanced(t *testing.T) {
+	entries := map[string]schema.LedgerEntry{
+		"accrual":             Accrual(1, "12345678903", 729.98),
+		"withdrawal":          Withdrawal(1, "2377225624", 751),
+		"positive adjustment": Adjustment(1, 0.1, "compensation"),
+		"negative adjustment": Adjustment(1, -0.3, "mistaken accrual"),
+		"expiration":          Expiration(1, 12.5),
+	}
+	for name, entry := range entries {
+		if err := Validate(entry); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		entry.ID = 42
+		reversal := Reversal(entry, "")
+		if err := Validate(reversal); err != nil {
+			t.Errorf("%s reversal: unexpected error: %v", name, err)
+		}
+		// проводка вместе со сторно обнуляет каждый счет
+		for account, balance := range balances(entry, reversal) {
+			if balance.Sign() != 0 {
+				t.Errorf("%s: account %+v is not zero after reversal: %s", name, account, balance.FloatString(2))
+			}
+		}
+	}
+}
+
+func TestValidateRejectsBrokenEntries(t *testing.T) {
+	unbalanced := Accrual(1, "12345678903", 100)
+	unbalanced.Postings[1].Amount = -99.99
+
+	zero := Accrual(1, "12345678903", 0)
+
+	single := Accrual(1, "12345678903", 100)
+	single.Postings = single.Postings[:1]
+
+	duplicate := schema.LedgerEntry{Kind: schema.LedgerEntryAdjustment, Postings: []schema.Posting{
+		{Account: UserAccount(1), Amount: 10},
+		{Account: UserAccount(1), Amount: -10},
+	}}
+
+	noAccount := Adjustment(0, 10, "")
+
+	reversal := Reversal(Accrual(1, "12345678903", 100), "")
+
+	unknown := Accrual(1, "12345678903", 100)
+	unknown.Kind = "BONUS"
+
+	// точная сумма расходится с приближением, баланс проверяется по точной
+	inexact, _ := ExpirationDecimal(1, "9000000.75")
+	inexact.Postings[1].Exact = "9000000.5"
+
+	brokenExact, _ := ExpirationDecimal(1, "10")
+	brokenExact.Postings[0].Exact = "ten"
+
+	cases := map[string]struct {
+		entry schema.LedgerEntry
+		err   error
+	}{
+		"unbalanced":           {unbalanced, errorapp.ErrUnbalancedEntry},
+		"zero amount":          {zero, errorapp.ErrInvalidEntry},
+		"single posting":       {single, errorapp.ErrInvalidEntry},
+		"duplicate account":    {duplicate, errorapp.ErrInvalidEntry},
+		"posting without user": {noAccount, errorapp.ErrInvalidEntry},
+		"reversal without id":  {reversal, errorapp.ErrInvalidEntry},
+		"unknown kind":         {unknown, errorapp.ErrInvalidEntry},
+		"unbalanced exact":     {inexact, errorapp.ErrUnbalancedEntry},
+		"broken exact":         {brokenExact, errorapp.ErrInvalidEntry},
+	}
+	for name, c := range cases {
+		if err := Validate(c.entry); !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", name, c.err, err)
+		}
+	}
+}
+
+// случайный журнал из начислений, списаний, корректировок и сторно всегда в сумме равен 0
+func TestJournalSumsToZero(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	journal := make([]schema.LedgerEntry, 0)
+	for i := 0; i < 10000; i++ {
+		userID := uint16(rnd.Intn(50) + 1)
+		amount := float32(rnd.Intn(100000)+1) / 100
+		var entry schema.LedgerEntry
+		switch rnd.Intn(5) {
+		case 0:
+			entry = Accrual(userID, "12345678903", amount)
+		case 1:
+			entry = Withdrawal(userID, "2377225624", amount)
+		case 2:
+			entry = Adjustment(userID, -amount, "")
+		case 3:
+			entry = Expiration(userID, amount)
+		case 4:
+			if len(journal) == 0 {
+				continue
+			}
+			entry = Reversal(journal[rnd.Intn(len(journal))], "")
+		}
+		entry.ID = int64(i + 1)
+		if err := Validate(entry); err != nil {
+			t.Fatalf("entry %d: unexpected error: %v", i, err)
+		}
+		journal = append(journal, entry)
+	}
+
+	total := new(big.Rat)
+	for _, balance := range balances(journal...) {
+		total.Add(total, balance)
+	}
+	if total.Sign() != 0 {
+		t.Fatalf("journal does not sum to zero: %s", total.FloatString(2))
+	}
+}
+
+// балансы счетов по набору проводок
+func balances(entries ...schema.LedgerEntry) map[schema.LedgerAccount]*big.Rat {
+	result := make(map[schema.LedgerAccount]*big.Rat)
+	for _, entry := range entries {
+		for _, p := range entry.Postings {
+			if _, ok := result[p.Account]; !ok {
+				result[p.Account] = new(big.Rat)
+			}
+			result[p.Account].Add(result[p.Account], Sum([]schema.Posting{p}))
+		}
+	}
+	return result
+}
+
+func TestExpirationDecimal(t *testing.T) {
+	// 9000000.75 не помещается во float32, в проводку попадает точная сумма
+	entry, err := ExpirationDecimal(1, "9000000.75")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := Validate(entry); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got := PostingDecimal(entry.Postings[0]); got != "-9000000.75" {
+		t.Errorf("user posting = %s, want -9000000.75", got)
+	}
+	if got := PostingDecimal(entry.Postings[1]); got != "9000000.75" {
+		t.Errorf("expiration posting = %s, want 9000000.75", got)
+	}
+	for _, amount := range []string{"0", "0.000", "-5", "", "abc"} {
+		if _, err := ExpirationDecimal(1, amount); !errors.Is(err, errorapp.ErrInvalidEntry) {
+			t.Errorf("ExpirationDecimal(%q) error = %v, want ErrInvalidEntry", amount, err)
+		}
+	}
+}
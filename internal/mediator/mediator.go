@@ -1,15 +1,23 @@
 package mediator
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/bubu256/gophermart_pet/config"
 	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/metrics"
+	"github.com/bubu256/gophermart_pet/internal/pubsub"
 	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/internal/tracing"
 	"github.com/bubu256/gophermart_pet/pkg/helpfunc"
 	"github.com/bubu256/gophermart_pet/pkg/storage"
 	"github.com/rs/zerolog"
@@ -17,13 +25,23 @@ import (
 
 // реализация бизнес логики приложения, условно посредник между БД и хендлерами
 
+// сколько доставок вебхуков возвращает GetWebhookDeliveries
+const webhookDeliveriesLimit = 100
+
+// сколько событий журнала возвращает GetEvents за раз
+const eventsMaxLimit = 1000
+
 type Mediator struct {
-	db     storage.Storage
-	logger zerolog.Logger
-	key    []byte
+	db           storage.Storage
+	logger       zerolog.Logger
+	key          []byte
+	expiration   config.CfgExpiration
+	cancelPolicy schema.CancelPolicy
+	broker       *pubsub.Broker
+	live         *config.Live // лимиты списаний и выключатели функций меняются без перезапуска
 }
 
-func New(db storage.Storage, cfg config.CfgMediator, logger zerolog.Logger) *Mediator {
+func New(db storage.Storage, broker *pubsub.Broker, cfg config.CfgMediator, expiration config.CfgExpiration, live *config.Live, logger zerolog.Logger) *Mediator {
 	if cfg.SecretKey == "" {
 		cfg.SecretKey = "Need_Generate_Key"
 	}
@@ -34,22 +52,39 @@ func New(db storage.Storage, cfg config.CfgMediator, logger zerolog.Logger) *Med
 		if err != nil {
 			logger.Fatal().Err(err).Msg("не удалось сгенерировать набор байт для ключа; error is here 334654654;")
 		}
-		logger.Warn().Msgf("Сгенерирован новый секретный ключ %x", key)
+		// сам ключ в лог не пишется: токены, подписанные им, действуют только до перезапуска
+		logger.Warn().Msg("Сгенерирован новый секретный ключ, задайте KEY чтобы токены не сбрасывались при перезапуске")
+	}
+	cancelPolicy := schema.CancelPolicy(cfg.CancelPolicy)
+	if cancelPolicy != schema.CancelPolicyNegative && cancelPolicy != schema.CancelPolicyClawback {
+		logger.Warn().Msgf("неизвестная политика отмены заказа %q, используется %q;", cfg.CancelPolicy, schema.CancelPolicyNegative)
+		cancelPolicy = schema.CancelPolicyNegative
 	}
-	return &Mediator{db: db, logger: logger, key: key}
+	return &Mediator{db: db, logger: logger, key: key, expiration: expiration, cancelPolicy: cancelPolicy, broker: broker, live: live}
 }
 
 // принимает структуру логин_пароль, хеширует пароль и пишет базу
-func (m *Mediator) SetNewUser(loginPassword schema.LoginPassword) error {
+func (m *Mediator) SetNewUser(ctx context.Context, loginPassword schema.LoginPassword) error {
+	ctx, span := tracing.Start(ctx, "Mediator.SetNewUser")
+	defer span.End()
+	if !m.live.Load().Features.Registration {
+		return fmt.Errorf("%w: registration", errorapp.ErrFeatureDisabled)
+	}
 	hash := getStringHash256(loginPassword.Password)
-	err := m.db.SetUser(loginPassword.Login, hash)
-	return err
+	err := m.db.SetUser(ctx, loginPassword.Login, hash)
+	if err != nil {
+		return err
+	}
+	metrics.IncRegistrations()
+	return nil
 }
 
 // принимает LoginPassword структуру, проверяет логин пароль и возвращает токен
-func (m *Mediator) GetTokenAuthorization(loginPassword schema.LoginPassword) (string, error) {
+func (m *Mediator) GetTokenAuthorization(ctx context.Context, loginPassword schema.LoginPassword) (string, error) {
+	ctx, span := tracing.Start(ctx, "Mediator.GetTokenAuthorization")
+	defer span.End()
 	hashString := getStringHash256(loginPassword.Password)
-	userID, err := m.db.GetUserID(loginPassword.Login, hashString)
+	userID, err := m.db.GetUserID(ctx, loginPassword.Login, hashString)
 	if err != nil {
 		m.logger.Debug().Err(err).Msg("error from m.DB.GetUserID(loginPassword.Login, hashString)")
 		return "", err
@@ -65,16 +100,18 @@ func (m *Mediator) GetTokenAuthorization(loginPassword schema.LoginPassword) (st
 
 // принимает токен и номер заказа для добавления
 // добавляет заказ в БД для пользователя и устанавливает статус NEW
-func (m *Mediator) SetNewOrder(token string, numberOrder string) error {
+func (m *Mediator) SetNewOrder(ctx context.Context, token string, numberOrder string) error {
+	ctx, span := tracing.Start(ctx, "Mediator.SetNewOrder")
+	defer span.End()
 	userID, err := m.getUserIDfromToken(token)
 	if err != nil {
 		return err
 	}
-	err = m.db.SetOrder(userID, numberOrder)
+	err = m.db.SetOrder(ctx, userID, numberOrder)
 	if err != nil {
 		// если запись не добавлена по причине дупликации проверяем кому принадлежит заказ
 		if errors.Is(err, errorapp.ErrDuplicate) {
-			userOrder, err := m.db.GetUserIDfromOrders(numberOrder)
+			userOrder, err := m.db.GetUserIDfromOrders(ctx, numberOrder)
 			if err != nil {
 				return err
 			}
@@ -86,58 +123,237 @@ func (m *Mediator) SetNewOrder(token string, numberOrder string) error {
 		}
 	}
 
-	err = m.db.SetOrderStatus(numberOrder, schema.StatusOrderNew, 0)
+	err = m.db.SetOrderStatus(ctx, numberOrder, schema.StatusOrderNew, 0)
 	if err != nil {
 		m.logger.Error().Err(err).Msg("ошибка при добавлении заказа со статусом NEW; err is here 64654654;")
 		return err
 	}
+	metrics.IncOrdersUploaded()
 
 	return nil
 }
 
 // Возвращает инфо по загруженным заказам пользователя
-func (m *Mediator) GetUserOrders(token string) ([]schema.Order, error) {
+func (m *Mediator) GetUserOrders(ctx context.Context, token string) ([]schema.Order, error) {
+	ctx, span := tracing.Start(ctx, "Mediator.GetUserOrders")
+	defer span.End()
 	userID, err := m.getUserIDfromToken(token)
 	if err != nil {
 		return nil, err
 	}
-	return m.db.GetOrders(userID)
+	orders, err := m.db.GetOrders(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range orders {
+		orders[i].Status = string(schema.StatusOrder(orders[i].Status).UserFacing())
+	}
+	return orders, nil
 }
 
-func (m *Mediator) GetUserBalance(token string) (schema.Balance, error) {
+// возвращает баланс пользователя и баллы, которые сгорят в ближайшее время
+func (m *Mediator) GetUserBalance(ctx context.Context, token string) (schema.Balance, error) {
+	ctx, span := tracing.Start(ctx, "Mediator.GetUserBalance")
+	defer span.End()
 	userID, err := m.getUserIDfromToken(token)
 	if err != nil {
 		return schema.Balance{}, err
 	}
-	return m.db.GetBalance(userID)
+	balance, err := m.db.GetBalance(ctx, userID)
+	if err != nil {
+		return balance, err
+	}
+	if m.expiration.TTL <= 0 {
+		return balance, nil
+	}
+	// сгорят до now + ExpiringSoon партии начисленные до now + ExpiringSoon - TTL
+	lots, err := m.db.GetCreditLots(ctx, userID, time.Now().Add(m.expiration.ExpiringSoon-m.expiration.TTL))
+	if err != nil {
+		return balance, err
+	}
+	for _, lot := range lots {
+		expiresAt := lot.CreditedAt.Add(m.expiration.TTL)
+		last := len(balance.ExpiringSoon) - 1
+		if last >= 0 && balance.ExpiringSoon[last].ExpiresAt.Equal(expiresAt) {
+			balance.ExpiringSoon[last].Amount += lot.Remaining
+			continue
+		}
+		balance.ExpiringSoon = append(balance.ExpiringSoon, schema.ExpiringPoints{
+			Amount:    lot.Remaining,
+			ExpiresAt: schema.TimeRFC3339{Time: expiresAt},
+		})
+	}
+	return balance, nil
 }
 
-func (m *Mediator) UserBalanceWithdraw(token string, orderSum schema.OrderSum) error {
+func (m *Mediator) UserBalanceWithdraw(ctx context.Context, token string, orderSum schema.OrderSum) error {
+	ctx, span := tracing.Start(ctx, "Mediator.UserBalanceWithdraw")
+	defer span.End()
 	if orderSum.Sum < 0 {
 		return errors.New("сумма подлежащая списанию должна быть больше 0; err is here 312184;")
 	}
+	runtime := m.live.Load()
+	if !runtime.Features.Withdrawals {
+		return fmt.Errorf("%w: withdrawals", errorapp.ErrFeatureDisabled)
+	}
+	if limits := runtime.Withdrawal; orderSum.Sum < limits.MinSum || (limits.MaxSum > 0 && orderSum.Sum > limits.MaxSum) {
+		return fmt.Errorf("%w: sum %v, min %v, max %v", errorapp.ErrWithdrawalLimit, orderSum.Sum, limits.MinSum, limits.MaxSum)
+	}
 	userID, err := m.getUserIDfromToken(token)
 	if err != nil {
 		return err
 	}
-	// проверка на достаточность средств
-	balance, err := m.db.GetBalance(userID)
+	// проверка на достаточность средств и списание выполняются в одной транзакции
+	err = m.db.Withdraw(ctx, userID, orderSum.Order, orderSum.Sum)
 	if err != nil {
 		return err
 	}
-	if balance.Current < orderSum.Sum {
-		return errorapp.ErrNotEnoughFunds
-	}
-	// записываем в базу движение средств с минусом
-	return m.db.SetBonusFlow(userID, orderSum.Order, -orderSum.Sum)
+	metrics.AddPointsWithdrawn(orderSum.Sum)
+	return nil
 }
 
-func (m *Mediator) GetUserWithdrawals(token string) ([]schema.OrderSum, error) {
+func (m *Mediator) GetUserWithdrawals(ctx context.Context, token string) ([]schema.OrderSum, error) {
+	ctx, span := tracing.Start(ctx, "Mediator.GetUserWithdrawals")
+	defer span.End()
 	userID, err := m.getUserIDfromToken(token)
 	if err != nil {
 		return nil, err
 	}
-	return m.db.GetBonusFlow(userID)
+	return m.db.GetBonusFlow(ctx, userID)
+}
+
+// подписывает пользователя на изменения его заказов и баланса.
+// возвращает канал событий и функцию отписки
+func (m *Mediator) SubscribeUserEvents(ctx context.Context, token string) (<-chan schema.UserEvent, func(), error) {
+	ctx, span := tracing.Start(ctx, "Mediator.SubscribeUserEvents")
+	defer span.End()
+	if !m.live.Load().Features.UserEvents {
+		return nil, nil, fmt.Errorf("%w: user events", errorapp.ErrFeatureDisabled)
+	}
+	userID, err := m.getUserIDfromToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	events, unsubscribe := m.broker.Subscribe(userID)
+	return events, unsubscribe, nil
+}
+
+// отменяет заказ (административная операция) и возвращает начисленные за него баллы по политике отмены
+func (m *Mediator) CancelOrder(ctx context.Context, numberOrder string, comment string) (schema.OrderCancellation, error) {
+	ctx, span := tracing.Start(ctx, "Mediator.CancelOrder")
+	defer span.End()
+	result, err := m.db.CancelOrder(ctx, numberOrder, comment, m.cancelPolicy)
+	if err != nil {
+		return result, err
+	}
+	m.logger.Info().Msgf("заказ %s отменен, возвращено баллов: %v;", numberOrder, result.Reversed)
+	return result, nil
+}
+
+// возвращает заказы снятые с опроса аккрол сервиса со статусом STALE
+func (m *Mediator) GetStaleOrders(ctx context.Context) ([]schema.Order, error) {
+	ctx, span := tracing.Start(ctx, "Mediator.GetStaleOrders")
+	defer span.End()
+	return m.db.GetOrdersByStatus(ctx, schema.StatusOrderStale)
+}
+
+// регистрирует получателя вебхуков; пустой секрет генерируется.
+// секрет возвращается только здесь, дальше получатель проверяет им подписи
+func (m *Mediator) CreateWebhookEndpoint(ctx context.Context, endpoint schema.WebhookEndpoint) (schema.WebhookEndpoint, error) {
+	ctx, span := tracing.Start(ctx, "Mediator.CreateWebhookEndpoint")
+	defer span.End()
+	target, err := url.Parse(endpoint.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return endpoint, fmt.Errorf("%w: url must be absolute http(s) url", errorapp.ErrInvalidWebhookEndpoint)
+	}
+	for _, eventType := range endpoint.EventTypes {
+		if eventType != schema.WebhookEventOrderAccrued && eventType != schema.WebhookEventPointsWithdrawn {
+			return endpoint, fmt.Errorf("%w: unknown event type %q", errorapp.ErrInvalidWebhookEndpoint, eventType)
+		}
+	}
+	if endpoint.Secret == "" {
+		secret, err := helpfunc.GenerateRandomBytes(32)
+		if err != nil {
+			return endpoint, err
+		}
+		endpoint.Secret = hex.EncodeToString(secret)
+	}
+	if endpoint.EventTypes == nil {
+		endpoint.EventTypes = make([]schema.WebhookEventType, 0)
+	}
+	endpoint, err = m.db.CreateWebhookEndpoint(ctx, endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+	m.logger.Info().Msgf("зарегистрирован получатель вебхуков %d: %s;", endpoint.ID, endpoint.URL)
+	return endpoint, nil
+}
+
+func (m *Mediator) GetWebhookEndpoints(ctx context.Context) ([]schema.WebhookEndpoint, error) {
+	ctx, span := tracing.Start(ctx, "Mediator.GetWebhookEndpoints")
+	defer span.End()
+	return m.db.GetWebhookEndpoints(ctx)
+}
+
+func (m *Mediator) DeleteWebhookEndpoint(ctx context.Context, endpointID int64) error {
+	ctx, span := tracing.Start(ctx, "Mediator.DeleteWebhookEndpoint")
+	defer span.End()
+	return m.db.DeleteWebhookEndpoint(ctx, endpointID)
+}
+
+// возвращает последние доставки вебхуков со статусом status, по умолчанию неудачные
+func (m *Mediator) GetWebhookDeliveries(ctx context.Context, status string) ([]schema.WebhookDelivery, error) {
+	ctx, span := tracing.Start(ctx, "Mediator.GetWebhookDeliveries")
+	defer span.End()
+	deliveryStatus := schema.WebhookDeliveryStatus(strings.ToUpper(status))
+	switch deliveryStatus {
+	case "":
+		deliveryStatus = schema.WebhookDeliveryFailed
+	case schema.WebhookDeliveryPending, schema.WebhookDeliveryDelivered, schema.WebhookDeliveryFailed:
+	default:
+		return nil, fmt.Errorf("%w: unknown delivery status %q", errorapp.ErrInvalidWebhookEndpoint, status)
+	}
+	return m.db.GetWebhookDeliveries(ctx, deliveryStatus, webhookDeliveriesLimit)
+}
+
+// повторяет неудачную доставку вебхука
+func (m *Mediator) ReplayWebhookDelivery(ctx context.Context, deliveryID int64) error {
+	ctx, span := tracing.Start(ctx, "Mediator.ReplayWebhookDelivery")
+	defer span.End()
+	replayed, err := m.db.ReplayWebhookDeliveries(ctx, deliveryID, 0)
+	if err != nil {
+		return err
+	}
+	// доставка есть, но не в статусе FAILED: повторять нечего
+	if replayed == 0 {
+		return errorapp.ErrEmptyResult
+	}
+	return nil
+}
+
+// повторяет все неудачные доставки получателю, возвращает их количество
+func (m *Mediator) ReplayWebhookEndpoint(ctx context.Context, endpointID int64) (int, error) {
+	ctx, span := tracing.Start(ctx, "Mediator.ReplayWebhookEndpoint")
+	defer span.End()
+	replayed, err := m.db.ReplayWebhookDeliveries(ctx, 0, endpointID)
+	if err != nil {
+		return 0, err
+	}
+	m.logger.Info().Msgf("повторно поставлено в очередь доставок получателю %d: %d;", endpointID, replayed)
+	return replayed, nil
+}
+
+// возвращает события журнала после смещения offset, limit ограничивается eventsMaxLimit
+func (m *Mediator) GetEvents(ctx context.Context, offset int64, limit int) ([]schema.DomainEvent, error) {
+	ctx, span := tracing.Start(ctx, "Mediator.GetEvents")
+	defer span.End()
+	if limit <= 0 || limit > eventsMaxLimit {
+		limit = eventsMaxLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return m.db.GetEvents(ctx, offset, limit)
 }
 
 // генерирует новый токен для userID
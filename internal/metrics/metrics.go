@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/accrual/client"
+	"github.com/bubu256/gophermart_pet/pkg/breaker"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// пакет метрик приложения для Prometheus, отдаются хендлером GET /metrics
+
+const namespace = "gophermart"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	accrualRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accrual_requests_total",
+		Help:      "Accrual service calls by outcome: 200, 204, 429, 500, timeout, invalid, breaker_open, error.",
+	}, []string{"outcome"})
+	accrualQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "accrual_queue_depth",
+		Help:      "Orders waiting for a final accrual status.",
+	})
+	accrualBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "accrual_breaker_state",
+		Help:      "Accrual client circuit breaker state: 0 closed, 1 open, 2 half-open.",
+	})
+	accrualBreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accrual_breaker_transitions_total",
+		Help:      "Accrual client circuit breaker state changes by target state.",
+	}, []string{"to"})
+	workerTickDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "accrual_worker_tick_duration_seconds",
+		Help:      "Duration of one accrual worker pass over the queue.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	registrations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registrations_total",
+		Help:      "Registered users.",
+	})
+	ordersUploaded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_uploaded_total",
+		Help:      "Orders uploaded by users.",
+	})
+	pointsCredited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "points_credited_total",
+		Help:      "Points credited for processed orders.",
+	})
+	pointsWithdrawn = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "points_withdrawn_total",
+		Help:      "Points withdrawn by users.",
+	})
+)
+
+// хендлер GET /metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// мидлвар считает запросы и их длительность по шаблону маршрута chi,
+// чтобы номера заказов и id в пути не плодили отдельные ряды
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if routeContext := chi.RouteContext(r.Context()); routeContext != nil && routeContext.RoutePattern() != "" {
+			route = routeContext.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// учитывает результат обращения к аккрол сервису по ошибке клиента
+func ObserveAccrual(err error) {
+	accrualRequests.WithLabelValues(accrualOutcome(err)).Inc()
+}
+
+func accrualOutcome(err error) string {
+	var tooManyRequests *client.TooManyRequestsError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return "200"
+	case errors.Is(err, client.ErrNotRegistered):
+		return "204"
+	case errors.As(err, &tooManyRequests):
+		return "429"
+	case errors.Is(err, client.ErrServer):
+		return "500"
+	case errors.Is(err, client.ErrInvalidResponse):
+		return "invalid"
+	case errors.Is(err, breaker.ErrOpen):
+		return "breaker_open"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "error"
+}
+
+// учитывает смену состояния выключателя клиента аккрол, передается в client.NewHTTP
+func ObserveBreakerState(from, to breaker.State) {
+	accrualBreakerState.Set(float64(to))
+	accrualBreakerTransitions.WithLabelValues(to.String()).Inc()
+}
+
+func ObserveWorkerTick(duration time.Duration) {
+	workerTickDuration.Observe(duration.Seconds())
+}
+
+func SetAccrualQueueDepth(depth int) {
+	accrualQueueDepth.Set(float64(depth))
+}
+
+func IncRegistrations() {
+	registrations.Inc()
+}
+
+func IncOrdersUploaded() {
+	ordersUploaded.Inc()
+}
+
+func AddPointsCredited(amount float32) {
+	pointsCredited.Add(float64(amount))
+}
+
+func AddPointsWithdrawn(amount float32) {
+	pointsWithdrawn.Add(float64(amount))
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// метрики пула соединений с БД, снимаются с pgxpool при каждом запросе /metrics
+
+// регистрирует метрики пула соединений с БД (gophermart_db_pool_*)
+func RegisterDB(pool *pgxpool.Pool) {
+	prometheus.MustRegister(poolCollector{pool: pool})
+}
+
+func poolDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+}
+
+var (
+	poolMaxConns         = poolDesc("max_conns", "Maximum size of the pool.")
+	poolTotalConns       = poolDesc("total_conns", "Connections currently in the pool.")
+	poolAcquiredConns    = poolDesc("acquired_conns", "Connections currently in use.")
+	poolIdleConns        = poolDesc("idle_conns", "Idle connections in the pool.")
+	poolConstructing     = poolDesc("constructing_conns", "Connections being established.")
+	poolAcquires         = poolDesc("acquires_total", "Successful connection acquires.")
+	poolAcquireSeconds   = poolDesc("acquire_duration_seconds_total", "Total time spent acquiring connections.")
+	poolEmptyAcquires    = poolDesc("empty_acquires_total", "Acquires that had to wait for a connection.")
+	poolCanceledAcquires = poolDesc("canceled_acquires_total", "Acquires canceled by context.")
+	poolNewConns         = poolDesc("new_conns_total", "Connections opened.")
+	poolLifetimeDestroys = poolDesc("max_lifetime_destroys_total", "Connections closed after DB_MAX_CONN_LIFETIME.")
+	poolIdleDestroys     = poolDesc("max_idle_destroys_total", "Connections closed after DB_MAX_CONN_IDLE_TIME.")
+)
+
+type poolCollector struct {
+	pool *pgxpool.Pool
+}
+
+func (c poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		poolMaxConns, poolTotalConns, poolAcquiredConns, poolIdleConns, poolConstructing,
+		poolAcquires, poolAcquireSeconds, poolEmptyAcquires, poolCanceledAcquires,
+		poolNewConns, poolLifetimeDestroys, poolIdleDestroys,
+	} {
+		ch <- desc
+	}
+}
+
+func (c poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+	gauge := func(desc *prometheus.Desc, value int32) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value))
+	}
+	counter := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value)
+	}
+	gauge(poolMaxConns, stat.MaxConns())
+	gauge(poolTotalConns, stat.TotalConns())
+	gauge(poolAcquiredConns, stat.AcquiredConns())
+	gauge(poolIdleConns, stat.IdleConns())
+	gauge(poolConstructing, stat.ConstructingConns())
+	counter(poolAcquires, float64(stat.AcquireCount()))
+	counter(poolAcquireSeconds, stat.AcquireDuration().Seconds())
+	counter(poolEmptyAcquires, float64(stat.EmptyAcquireCount()))
+	counter(poolCanceledAcquires, float64(stat.CanceledAcquireCount()))
+	counter(poolNewConns, float64(stat.NewConnsCount()))
+	counter(poolLifetimeDestroys, float64(stat.MaxLifetimeDestroyCount()))
+	counter(poolIdleDestroys, float64(stat.MaxIdleDestroyCount()))
+}
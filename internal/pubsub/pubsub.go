@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+	"github.com/rs/zerolog"
+)
+
+// пакет раздает события пользователей подписчикам внутри процесса.
+// события приходят из БД через LISTEN/NOTIFY, поэтому подписчик получает и изменения,
+// сделанные другими экземплярами приложения
+
+// размер буфера подписки, события медленного подписчика сверх буфера отбрасываются
+const subscriptionBuffer = 16
+
+// пауза перед повторной подпиской на события БД после ошибки
+const reconnectDelay = 5 * time.Second
+
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[uint16]map[chan schema.UserEvent]struct{}
+}
+
+func New() *Broker {
+	return &Broker{subscribers: make(map[uint16]map[chan schema.UserEvent]struct{})}
+}
+
+// подписывает на события пользователя userID.
+// возвращает канал событий и функцию отписки, после отписки канал закрывается
+func (b *Broker) Subscribe(userID uint16) (<-chan schema.UserEvent, func()) {
+	ch := make(chan schema.UserEvent, subscriptionBuffer)
+	b.mu.Lock()
+	if _, ok := b.subscribers[userID]; !ok {
+		b.subscribers[userID] = make(map[chan schema.UserEvent]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers[userID], ch)
+			if len(b.subscribers[userID]) == 0 {
+				delete(b.subscribers, userID)
+			}
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, unsubscribe
+}
+
+// отправляет событие всем подписчикам пользователя без ожидания
+func (b *Broker) Publish(event schema.UserEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[event.UserID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// запускает в горутине прием событий из БД и раздачу их подписчикам.
+// при обрыве соединения подписка на события БД возобновляется
+func Run(db storage.Storage, broker *Broker, logger zerolog.Logger) {
+	go func() {
+		for {
+			err := db.ListenUserEvents(context.Background(), broker.Publish)
+			logger.Error().Err(err).Msg("прервано получение событий пользователей из БД; err is here 5510231;")
+			time.Sleep(reconnectDelay)
+		}
+	}()
+}
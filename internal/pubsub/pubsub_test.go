@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/schema"
+)
+
+func orderEvent(userID uint16, number string) schema.UserEvent {
+	return schema.UserEvent{Type: schema.UserEventOrder, UserID: userID, Order: number, Status: schema.StatusOrderProcessed}
+}
+
+// ждет событие из канала не дольше секунды
+func receive(t *testing.T, events <-chan schema.UserEvent) (schema.UserEvent, bool) {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		return event, ok
+	case <-time.After(time.Second):
+		t.Fatal("no event within 1s")
+	}
+	return schema.UserEvent{}, false
+}
+
+func assertEmpty(t *testing.T, events <-chan schema.UserEvent) {
+	t.Helper()
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	default:
+	}
+}
+
+func TestPublishPerUser(t *testing.T) {
+	b := New()
+	first, unsubscribeFirst := b.Subscribe(1)
+	defer unsubscribeFirst()
+	second, unsubscribeSecond := b.Subscribe(1)
+	defer unsubscribeSecond()
+	other, unsubscribeOther := b.Subscribe(2)
+	defer unsubscribeOther()
+
+	b.Publish(orderEvent(1, "12345678903"))
+
+	// событие получают все подписки пользователя и только они
+	for _, events := range []<-chan schema.UserEvent{first, second} {
+		if event, _ := receive(t, events); event.Order != "12345678903" {
+			t.Errorf("event = %+v, want order 12345678903", event)
+		}
+	}
+	assertEmpty(t, other)
+
+	// события пользователя без подписчиков отбрасываются
+	b.Publish(orderEvent(3, "2377225624"))
+	assertEmpty(t, first)
+	assertEmpty(t, other)
+}
+
+func TestUnsubscribeClosesChannel(t *testing.T) {
+	b := New()
+	events, unsubscribe := b.Subscribe(1)
+	unsubscribe()
+	if _, ok := receive(t, events); ok {
+		t.Error("channel is open after unsubscribe")
+	}
+	// повторная отписка и публикация после отписки не паникуют
+	unsubscribe()
+	b.Publish(orderEvent(1, "12345678903"))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subscribers) != 0 {
+		t.Errorf("subscribers = %v, want none after unsubscribe", b.subscribers)
+	}
+}
+
+func TestSlowSubscriberDoesNotBlockPublish(t *testing.T) {
+	b := New()
+	slow, unsubscribeSlow := b.Subscribe(1)
+	defer unsubscribeSlow()
+	fast, unsubscribeFast := b.Subscribe(1)
+	defer unsubscribeFast()
+
+	received := make(chan int)
+	go func() {
+		count := 0
+		for range fast {
+			count++
+		}
+		received <- count
+	}()
+
+	// медленный подписчик не читает канал: после заполнения буфера его события отбрасываются
+	const published = 3 * subscriptionBuffer
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < published; i++ {
+			b.Publish(orderEvent(1, "12345678903"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a slow subscriber")
+	}
+	if len(slow) != subscriptionBuffer {
+		t.Errorf("slow subscriber buffered %d events, want %d", len(slow), subscriptionBuffer)
+	}
+
+	unsubscribeFast()
+	if count := <-received; count == 0 {
+		t.Error("fast subscriber received no events")
+	}
+}
@@ -0,0 +1,96 @@
+package reload
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/pkg/logger"
+	"github.com/rs/zerolog"
+)
+
+// перечитывание конфигурации без перезапуска: по SIGHUP и при изменении файла конфигурации.
+// новые Runtime настройки заменяют текущие в config.Live, остальные изменения применятся после перезапуска
+
+type Reloader struct {
+	args    []string
+	live    *config.Live
+	logger  zerolog.Logger
+	current config.Configuration
+	modTime time.Time
+}
+
+// запускает перечитывание конфигурации; args - аргументы запуска, с которыми загружалась cfg
+func Run(cfg config.Configuration, args []string, live *config.Live, logger zerolog.Logger) *Reloader {
+	reloader := &Reloader{args: args, live: live, logger: logger, current: cfg}
+	reloader.modTime = reloader.fileModTime()
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	var watch <-chan time.Time
+	if cfg.File != "" && cfg.Reload.WatchInterval > 0 {
+		watch = time.NewTicker(cfg.Reload.WatchInterval).C
+	}
+	go func() {
+		for {
+			select {
+			case <-hangup:
+				logger.Info().Msg("получен SIGHUP, конфигурация перечитывается;")
+				reloader.Reload()
+			case <-watch:
+				modTime := reloader.fileModTime()
+				if modTime.Equal(reloader.modTime) {
+					continue
+				}
+				reloader.modTime = modTime
+				logger.Info().Msgf("файл конфигурации %s изменен, конфигурация перечитывается;", cfg.File)
+				reloader.Reload()
+			}
+		}
+	}()
+	logger.Info().Msg("Перечитывание конфигурации по SIGHUP запущено")
+	return reloader
+}
+
+// загружает конфигурацию заново и применяет Runtime настройки.
+// некорректная конфигурация не применяется, остаются прежние настройки
+func (r *Reloader) Reload() {
+	cfg, err := config.Load(r.args, os.Environ())
+	if err != nil {
+		r.logger.Error().Err(err).Msg("новая конфигурация не применена; err is here 8812301;")
+		return
+	}
+	changes := config.Changes(r.current, cfg)
+	if len(changes) == 0 {
+		r.logger.Info().Msg("конфигурация не изменилась;")
+		return
+	}
+	runtime := cfg.Runtime()
+	if err := logger.SetLevel(runtime.LogLevel); err != nil {
+		r.logger.Error().Err(err).Msg("новая конфигурация не применена; err is here 8812302;")
+		return
+	}
+	r.live.Store(runtime)
+	for _, change := range changes {
+		if change.Runtime {
+			r.logger.Info().Msgf("настройка изменена: %s;", change)
+			continue
+		}
+		r.logger.Warn().Msgf("настройка изменена, применится после перезапуска: %s;", change)
+	}
+	r.current = cfg
+}
+
+func (r *Reloader) fileModTime() time.Time {
+	if r.current.File == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(r.current.File)
+	if err != nil {
+		r.logger.Warn().Err(err).Msgf("не удалось проверить файл конфигурации %s;", r.current.File)
+		return r.modTime
+	}
+	return info.ModTime()
+}
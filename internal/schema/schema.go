@@ -1,6 +1,7 @@
 package schema
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -16,6 +17,47 @@ const (
 	StatusOrderProcessing StatusOrder = "PROCESSING"
 	StatusOrderInvalid    StatusOrder = "INVALID"
 	StatusOrderProcessed  StatusOrder = "PROCESSED"
+	StatusOrderCancelled  StatusOrder = "CANCELLED"
+	// аккрол сервис так и не вернул конечный статус, заказ снят с опроса
+	StatusOrderStale StatusOrder = "STALE"
+)
+
+// допустимые переходы статусов заказа при обновлении по ответу аккрол сервиса.
+// PROCESSED, INVALID и CANCELLED конечные, STALE заказ возвращается к расчету по поздно пришедшему ответу
+var orderTransitions = map[StatusOrder][]StatusOrder{
+	"":                    {StatusOrderNew},
+	StatusOrderNew:        {StatusOrderProcessing, StatusOrderProcessed, StatusOrderInvalid, StatusOrderStale},
+	StatusOrderProcessing: {StatusOrderProcessed, StatusOrderInvalid, StatusOrderStale},
+	StatusOrderStale:      {StatusOrderProcessing, StatusOrderProcessed, StatusOrderInvalid},
+}
+
+// можно ли перевести заказ из статуса s в статус next
+func (s StatusOrder) CanBecome(next StatusOrder) bool {
+	for _, status := range orderTransitions[s] {
+		if status == next {
+			return true
+		}
+	}
+	return false
+}
+
+// статус заказа, который видит пользователь: STALE служебный статус для операторов,
+// для пользователя такой заказ остается в расчете
+func (s StatusOrder) UserFacing() StatusOrder {
+	if s == StatusOrderStale {
+		return StatusOrderProcessing
+	}
+	return s
+}
+
+// политика возврата начисленных баллов при отмене заказа
+type CancelPolicy string
+
+const (
+	// начисление сторнируется полностью, баланс может уйти в минус
+	CancelPolicyNegative CancelPolicy = "negative"
+	// списывается не больше текущего баланса, баланс не уходит в минус
+	CancelPolicyClawback CancelPolicy = "clawback"
 )
 
 // возможные статусы ответа от аккрол сервиса
@@ -59,8 +101,22 @@ type Order struct {
 
 // структура для ответа БД о кол-ве бонусов, а так для записи ответа сервера в виде json
 type Balance struct {
-	Current   float32 `json:"current"`
-	Withdrawn float32 `json:"withdrawn"`
+	Current      float32          `json:"current"`
+	Withdrawn    float32          `json:"withdrawn"`
+	ExpiringSoon []ExpiringPoints `json:"expiring_soon,omitempty"`
+	Version      int64            `json:"-"` // версия снимка баланса, растет с каждым движением по счету
+}
+
+// баллы, которые скоро сгорят
+type ExpiringPoints struct {
+	Amount    float32     `json:"amount"`
+	ExpiresAt TimeRFC3339 `json:"expires_at"`
+}
+
+// партия начисленных баллов; списания и сгорание расходуют партии в порядке начисления (FIFO)
+type CreditLot struct {
+	Remaining  float32
+	CreditedAt time.Time
 }
 
 // структура для json запроса на списание средств
@@ -81,3 +137,202 @@ type LoginPassword struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 }
+
+// тип проводки в журнале двойной записи
+type LedgerEntryKind string
+
+const (
+	LedgerEntryAccrual    LedgerEntryKind = "ACCRUAL"
+	LedgerEntryWithdrawal LedgerEntryKind = "WITHDRAWAL"
+	LedgerEntryReversal   LedgerEntryKind = "REVERSAL"
+	LedgerEntryAdjustment LedgerEntryKind = "ADJUSTMENT"
+	LedgerEntryExpiration LedgerEntryKind = "EXPIRATION"
+)
+
+// счет журнала: счет пользователя (UserID) либо системный счет (Code)
+type LedgerAccount struct {
+	UserID uint16 `json:"user_id,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+// движение по счету в рамках проводки; положительная сумма увеличивает баланс счета
+type Posting struct {
+	Account LedgerAccount `json:"account"`
+	Amount  float32       `json:"amount"`
+	// точная сумма в десятичной записи, если сумма пришла из БД и не помещается во float32;
+	// тогда в БД пишется она, а Amount - ее приближение
+	Exact string `json:"-"`
+}
+
+// проводка журнала; сумма всех движений проводки равна 0
+type LedgerEntry struct {
+	ID          int64           `json:"id"`
+	Kind        LedgerEntryKind `json:"kind"`
+	OrderNumber string          `json:"order_number,omitempty"`
+	ReversesID  int64           `json:"reverses_id,omitempty"` // заполняется только для REVERSAL
+	Comment     string          `json:"comment,omitempty"`
+	Postings    []Posting       `json:"postings"`
+	CreatedAt   TimeRFC3339     `json:"created_at"`
+}
+
+// расхождение снимка баланса пользователя с пересчетом по журналу
+type BalanceDrift struct {
+	UserID          uint16  `json:"user_id"`
+	Current         float32 `json:"current"`
+	Withdrawn       float32 `json:"withdrawn"`
+	LedgerCurrent   float32 `json:"ledger_current"`
+	LedgerWithdrawn float32 `json:"ledger_withdrawn"`
+}
+
+// результат отмены заказа
+type OrderCancellation struct {
+	Order    string      `json:"order"`
+	Status   StatusOrder `json:"status"`
+	Reversed float32     `json:"reversed"` // сколько начисленных баллов возвращено с баланса пользователя
+}
+
+type CancelRequest struct {
+	Comment string `json:"comment"`
+}
+
+// тип события пользователя
+type UserEventType string
+
+const (
+	UserEventOrder   UserEventType = "order"   // изменился статус заказа
+	UserEventBalance UserEventType = "balance" // изменился баланс
+)
+
+// событие для потока GET /api/user/events
+type UserEvent struct {
+	Type    UserEventType `json:"type"`
+	UserID  uint16        `json:"-"`
+	Order   string        `json:"order,omitempty"`
+	Status  StatusOrder   `json:"status,omitempty"`
+	Accrual float32       `json:"accrual,omitempty"`
+	Balance *Balance      `json:"balance,omitempty"`
+}
+
+// тип исходящего бизнес события
+type WebhookEventType string
+
+const (
+	WebhookEventOrderAccrued    WebhookEventType = "order.accrued"    // за заказ начислены баллы
+	WebhookEventPointsWithdrawn WebhookEventType = "points.withdrawn" // баллы списаны в счет оплаты заказа
+)
+
+// статус доставки вебхука
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "PENDING"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "DELIVERED"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "FAILED" // попытки исчерпаны, доставку можно повторить через админ API
+)
+
+// данные событий order.accrued и points.withdrawn
+type WebhookOrderData struct {
+	UserID  uint16  `json:"user_id"`
+	Order   string  `json:"order"`
+	Accrual float32 `json:"accrual,omitempty"`
+	Sum     float32 `json:"sum,omitempty"`
+}
+
+// получатель вебхуков; секрет показывается только при регистрации
+type WebhookEndpoint struct {
+	ID         int64              `json:"id"`
+	URL        string             `json:"url"`
+	Secret     string             `json:"secret,omitempty"`
+	EventTypes []WebhookEventType `json:"event_types"` // пустой список - все события
+	CreatedAt  TimeRFC3339        `json:"created_at"`
+}
+
+// доставка события получателю
+type WebhookDelivery struct {
+	ID            int64                 `json:"id"`
+	EventID       int64                 `json:"event_id"`
+	EventType     WebhookEventType      `json:"event_type"`
+	EndpointID    int64                 `json:"endpoint_id"`
+	URL           string                `json:"url"`
+	Status        WebhookDeliveryStatus `json:"status"`
+	Attempts      int                   `json:"attempts"`
+	LastError     string                `json:"last_error,omitempty"`
+	NextAttemptAt TimeRFC3339           `json:"next_attempt_at"`
+	CreatedAt     TimeRFC3339           `json:"created_at"` // время события
+	Secret        string                `json:"-"`
+	Payload       []byte                `json:"-"` // данные события в json
+}
+
+// тело вебхука
+type WebhookMessage struct {
+	ID        int64            `json:"id"`
+	Type      WebhookEventType `json:"type"`
+	CreatedAt TimeRFC3339      `json:"created_at"`
+	Data      json.RawMessage  `json:"data"`
+}
+
+// тип доменного события
+type DomainEventType string
+
+const (
+	DomainEventOrderUploaded      DomainEventType = "order.uploaded"
+	DomainEventOrderStatusChanged DomainEventType = "order.status_changed"
+	DomainEventPointsCredited     DomainEventType = "points.credited"  // баланс пользователя увеличен
+	DomainEventPointsDebited      DomainEventType = "points.debited"   // баланс уменьшен не списанием: сторно, корректировка, сгорание
+	DomainEventPointsWithdrawn    DomainEventType = "points.withdrawn" // баллы списаны в счет оплаты заказа
+)
+
+// доменное событие из журнала событий; Offset растет с каждым событием
+type DomainEvent struct {
+	Offset      int64           `json:"offset"`
+	Type        DomainEventType `json:"type"`
+	UserID      uint16          `json:"user_id,omitempty"`
+	OrderNumber string          `json:"order,omitempty"`
+	Data        json.RawMessage `json:"data"`
+	CreatedAt   TimeRFC3339     `json:"created_at"`
+}
+
+// данные события order.status_changed
+type OrderStatusChange struct {
+	From    StatusOrder `json:"from,omitempty"`
+	To      StatusOrder `json:"to"`
+	Accrual float32     `json:"accrual,omitempty"`
+}
+
+// данные событий движения баллов
+type PointsMovement struct {
+	EntryID int64           `json:"entry_id"`
+	Kind    LedgerEntryKind `json:"kind"`
+	Amount  float32         `json:"amount"` // со знаком, как движение по счету пользователя
+	Current float32         `json:"current"`
+}
+
+// версия схемы БД
+type MigrationStatus struct {
+	Version  uint `json:"version"`
+	Dirty    bool `json:"dirty"`    // миграция прервана, схема требует ручного исправления
+	Expected uint `json:"expected"` // последняя версия среди миграций приложения
+}
+
+// результат проверки зависимости для /readyz
+type HealthCheck struct {
+	Status  string         `json:"status"` // ok, degraded или fail
+	Error   string         `json:"error,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// ответ /healthz и /readyz
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// задача опроса аккрол сервиса по заказу
+type AccrualJob struct {
+	OrderNumber string
+	Status      StatusOrder // последний статус заказа
+	Attempts    int         // сколько раз задача захватывалась воркером, включая текущий захват
+	Failures    int         // сколько опросов подряд завершились ошибкой
+	LastError   string
+	CreatedAt   time.Time
+}
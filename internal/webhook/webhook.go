@@ -0,0 +1,146 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/helpfunc"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+	"github.com/rs/zerolog"
+)
+
+// пакет доставляет исходящие вебхуки из outbox получателям.
+// тело запроса - schema.WebhookMessage, подпись - hex HMAC-SHA256 тела на секрете получателя
+// в заголовке X-Webhook-Signature. получатель отвечает 2xx, иначе доставка повторяется
+
+// доля случайного разброса задержки повтора
+const retryJitter = 0.2
+
+// запас времени на запись результата одной доставки в БД
+const deliverySlack = time.Second
+
+type Dispatcher struct {
+	db     storage.Storage
+	logger zerolog.Logger
+	http   *http.Client
+	cfg    config.CfgWebhook
+	rnd    *rand.Rand
+}
+
+// запускает разбор очереди доставок в горутине
+func Run(db storage.Storage, logger zerolog.Logger, cfg config.CfgWebhook) {
+	dispatcher := Dispatcher{
+		db:     db,
+		logger: logger,
+		http:   &http.Client{Timeout: cfg.Timeout},
+		cfg:    cfg,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	go func() {
+		for range ticker.C {
+			dispatcher.Dispatch()
+		}
+	}()
+	logger.Info().Msgf("Доставка вебхуков запущена, интервал %s", cfg.Interval)
+}
+
+// отправляет готовые доставки, пока очередь не опустеет
+func (d *Dispatcher) Dispatch() {
+	ctx := context.Background()
+	for {
+		// пачка отправляется последовательно, поэтому захватывается на время всех ее запросов
+		// с запасом на запись результатов, чтобы до конца разбора ее не взял другой экземпляр
+		deliveries, err := d.db.ClaimWebhookDeliveries(ctx, d.cfg.BatchSize, d.lease())
+		if err != nil {
+			d.logger.Error().Err(err).Msg("ошибка при захвате доставок вебхуков; err is here 6630141;")
+			return
+		}
+		for _, delivery := range deliveries {
+			d.deliver(ctx, delivery)
+		}
+		if len(deliveries) < d.cfg.BatchSize {
+			return
+		}
+	}
+}
+
+// время захвата пачки доставок
+func (d *Dispatcher) lease() time.Duration {
+	return time.Duration(d.cfg.BatchSize) * (d.cfg.Timeout + deliverySlack)
+}
+
+// отправляет одну доставку и записывает результат
+func (d *Dispatcher) deliver(ctx context.Context, delivery schema.WebhookDelivery) {
+	err := d.send(ctx, delivery)
+	if err == nil {
+		if err := d.db.CompleteWebhookDelivery(ctx, delivery.ID); err != nil {
+			d.logger.Error().Err(err).Msgf("ошибка при записи доставки вебхука %d; err is here 6630142;", delivery.ID)
+		}
+		d.logger.Debug().Msgf("вебхук %s события %d доставлен на %s;", delivery.EventType, delivery.EventID, delivery.URL)
+		return
+	}
+
+	final := delivery.Attempts >= d.cfg.MaxAttempts
+	delay := helpfunc.Backoff(delivery.Attempts, d.cfg.RetryBaseDelay, d.cfg.RetryMaxDelay, retryJitter*d.rnd.Float64())
+	if err := d.db.FailWebhookDelivery(ctx, delivery.ID, time.Now().Add(delay), err.Error(), final); err != nil {
+		d.logger.Error().Err(err).Msgf("ошибка при записи доставки вебхука %d; err is here 6630143;", delivery.ID)
+	}
+	if final {
+		d.logger.Warn().Err(err).Msgf("вебхук %d на %s не доставлен после %d попыток;", delivery.ID, delivery.URL, delivery.Attempts)
+		return
+	}
+	d.logger.Debug().Err(err).Msgf("вебхук %d на %s не доставлен, повтор через %s;", delivery.ID, delivery.URL, delay)
+}
+
+// отправляет подписанный вебхук получателю
+func (d *Dispatcher) send(ctx context.Context, delivery schema.WebhookDelivery) error {
+	body, err := json.Marshal(schema.WebhookMessage{
+		ID:        delivery.EventID,
+		Type:      delivery.EventType,
+		CreatedAt: delivery.CreatedAt,
+		Data:      delivery.Payload,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-ID", strconv.FormatInt(delivery.EventID, 10))
+	request.Header.Set("X-Webhook-Event", string(delivery.EventType))
+	request.Header.Set("X-Webhook-Signature", Sign(body, delivery.Secret))
+	resp, err := d.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("получатель ответил %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// подпись тела вебхука: hex HMAC-SHA256 на секрете получателя
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,214 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+	"github.com/rs/zerolog"
+)
+
+// хранилище с очередью доставок в памяти, остальные методы не используются
+type memStorage struct {
+	storage.Storage
+	mu        sync.Mutex
+	pending   []schema.WebhookDelivery
+	leases    []time.Duration
+	delivered []int64
+	failures  map[int64]failedDelivery
+}
+
+type failedDelivery struct {
+	nextAttemptAt time.Time
+	final         bool
+}
+
+func newMemStorage(deliveries ...schema.WebhookDelivery) *memStorage {
+	return &memStorage{pending: deliveries, failures: make(map[int64]failedDelivery)}
+}
+
+func (m *memStorage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]schema.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leases = append(m.leases, lease)
+	if limit > len(m.pending) {
+		limit = len(m.pending)
+	}
+	claimed := m.pending[:limit]
+	m.pending = m.pending[limit:]
+	for i := range claimed {
+		claimed[i].Attempts++
+	}
+	return claimed, nil
+}
+
+func (m *memStorage) CompleteWebhookDelivery(ctx context.Context, deliveryID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delivered = append(m.delivered, deliveryID)
+	return nil
+}
+
+func (m *memStorage) FailWebhookDelivery(ctx context.Context, deliveryID int64, nextAttemptAt time.Time, failure string, final bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[deliveryID] = failedDelivery{nextAttemptAt: nextAttemptAt, final: final}
+	return nil
+}
+
+func testConfig() config.CfgWebhook {
+	return config.CfgWebhook{
+		Interval:       time.Second,
+		BatchSize:      2,
+		Timeout:        time.Second,
+		RetryBaseDelay: 10 * time.Second,
+		RetryMaxDelay:  time.Hour,
+		MaxAttempts:    3,
+	}
+}
+
+func newTestDispatcher(db storage.Storage, cfg config.CfgWebhook) *Dispatcher {
+	return &Dispatcher{
+		db:     db,
+		logger: zerolog.Nop(),
+		http:   &http.Client{Timeout: cfg.Timeout},
+		cfg:    cfg,
+		rnd:    rand.New(rand.NewSource(1)),
+	}
+}
+
+// доставка с attempts неудачных попыток до текущей
+func newDelivery(id int64, url string, attempts int) schema.WebhookDelivery {
+	return schema.WebhookDelivery{
+		ID:        id,
+		EventID:   100 + id,
+		EventType: schema.WebhookEventOrderAccrued,
+		URL:       url,
+		Status:    schema.WebhookDeliveryPending,
+		Attempts:  attempts,
+		CreatedAt: schema.TimeRFC3339{Time: time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)},
+		Secret:    "secret",
+		Payload:   []byte(`{"order":"12345678903","accrual":729.98}`),
+	}
+}
+
+func TestDeliverySigned(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if signature := r.Header.Get("X-Webhook-Signature"); signature != hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("signature = %q, want HMAC-SHA256 of body", signature)
+		}
+		if signature := r.Header.Get("X-Webhook-Signature"); signature != Sign(body, "secret") {
+			t.Errorf("signature = %q, want Sign(body)", signature)
+		}
+		if r.Header.Get("X-Webhook-ID") != "101" || r.Header.Get("X-Webhook-Event") != "order.accrued" {
+			t.Errorf("headers = %v, want event 101 order.accrued", r.Header)
+		}
+		var message schema.WebhookMessage
+		if err := json.Unmarshal(body, &message); err != nil {
+			t.Errorf("body %s: %v", body, err)
+		}
+		if message.ID != 101 || string(message.Data) != `{"order":"12345678903","accrual":729.98}` {
+			t.Errorf("message = %+v", message)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	db := newMemStorage(newDelivery(1, server.URL, 0))
+	newTestDispatcher(db, testConfig()).Dispatch()
+	if requests != 1 {
+		t.Fatalf("requests = %d, want 1", requests)
+	}
+	if len(db.delivered) != 1 || db.delivered[0] != 1 || len(db.failures) != 0 {
+		t.Errorf("delivered = %v, failures = %v, want delivery 1 completed", db.delivered, db.failures)
+	}
+}
+
+func TestFailedDeliveryBacksOff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	cfg := testConfig()
+	db := newMemStorage(newDelivery(1, server.URL, 0), newDelivery(2, server.URL, 1))
+	start := time.Now()
+	newTestDispatcher(db, cfg).Dispatch()
+	if len(db.delivered) != 0 {
+		t.Errorf("delivered = %v, want none", db.delivered)
+	}
+	// первая неудача - базовая задержка, вторая - вдвое больше, разброс только уменьшает задержку
+	for id, delay := range map[int64]time.Duration{1: cfg.RetryBaseDelay, 2: 2 * cfg.RetryBaseDelay} {
+		f, ok := db.failures[id]
+		if !ok {
+			t.Fatalf("delivery %d was not failed", id)
+		}
+		if f.final {
+			t.Errorf("delivery %d failed finally after %d attempts", id, id)
+		}
+		min := start.Add(delay - time.Duration(retryJitter*float64(delay)))
+		if f.nextAttemptAt.Before(min) || f.nextAttemptAt.After(time.Now().Add(delay)) {
+			t.Errorf("delivery %d next attempt in %s, want about %s", id, f.nextAttemptAt.Sub(start), delay)
+		}
+	}
+}
+
+func TestDeliveryFailsAfterMaxAttempts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	cfg := testConfig()
+	db := newMemStorage(newDelivery(1, server.URL, cfg.MaxAttempts-2), newDelivery(2, server.URL, cfg.MaxAttempts-1))
+	newTestDispatcher(db, cfg).Dispatch()
+	if db.failures[1].final {
+		t.Errorf("delivery 1 failed finally before MaxAttempts")
+	}
+	if !db.failures[2].final {
+		t.Errorf("delivery 2 is not FAILED after MaxAttempts")
+	}
+}
+
+func TestBatchLeaseCoversSequentialDelivery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	cfg := testConfig()
+	cfg.BatchSize = 3
+	db := newMemStorage()
+	for id := int64(1); id <= 4; id++ {
+		db.pending = append(db.pending, newDelivery(id, server.URL, 0))
+	}
+	newTestDispatcher(db, cfg).Dispatch()
+	if len(db.delivered) != 4 {
+		t.Errorf("delivered = %v, want all 4", db.delivered)
+	}
+	// полная пачка забирает следующую, неполная завершает разбор
+	if len(db.leases) != 2 {
+		t.Fatalf("claims = %d, want 2", len(db.leases))
+	}
+	// каждая доставка пачки может занять весь таймаут запроса
+	for _, lease := range db.leases {
+		if lease < time.Duration(cfg.BatchSize)*cfg.Timeout {
+			t.Errorf("lease = %s, shorter than %d sequential requests of %s", lease, cfg.BatchSize, cfg.Timeout)
+		}
+	}
+}
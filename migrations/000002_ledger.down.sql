@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS trg_postings_balanced ON postings;
+DROP FUNCTION IF EXISTS check_journal_entry_balanced();
+ALTER TABLE bonus_flow DROP CONSTRAINT IF EXISTS fk_bonus_flow_journal_entries;
+ALTER TABLE bonus_flow DROP COLUMN IF EXISTS entry_id;
+DROP TABLE IF EXISTS user_balances;
+DROP TABLE IF EXISTS postings;
+DROP TABLE IF EXISTS journal_entries;
+DROP TABLE IF EXISTS accounts;
@@ -0,0 +1,98 @@
+BEGIN;
+-- счета двойной записи: счет пользователя (user_id) либо системный счет (code)
+CREATE TABLE IF NOT EXISTS accounts(
+    account_id serial PRIMARY KEY,
+    user_id INT UNIQUE,
+    code TEXT UNIQUE,
+    CONSTRAINT fk_accounts_users FOREIGN KEY(user_id) REFERENCES users(user_id),
+    CONSTRAINT chk_accounts_owner CHECK ((user_id IS NULL) <> (code IS NULL))
+);
+
+INSERT INTO accounts(code)
+VALUES ('ACCRUAL'), ('WITHDRAWAL'), ('ADJUSTMENT');
+
+INSERT INTO accounts(user_id)
+SELECT user_id FROM users;
+
+-- журнал проводок
+CREATE TABLE IF NOT EXISTS journal_entries(
+    entry_id serial PRIMARY KEY,
+    kind TEXT NOT NULL,
+    order_number TEXT,
+    reverses_entry_id INT UNIQUE,
+    comment TEXT,
+    datetime TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT fk_journal_entries_reverses FOREIGN KEY(reverses_entry_id) REFERENCES journal_entries(entry_id),
+    CONSTRAINT chk_journal_entries_kind CHECK (kind IN ('ACCRUAL', 'WITHDRAWAL', 'REVERSAL', 'ADJUSTMENT'))
+);
+
+-- движения по счетам в рамках проводки, сумма движений проводки всегда равна 0
+CREATE TABLE IF NOT EXISTS postings(
+    posting_id serial PRIMARY KEY,
+    entry_id INT NOT NULL,
+    account_id INT NOT NULL,
+    amount NUMERIC NOT NULL,
+    UNIQUE (entry_id, account_id),
+    CONSTRAINT fk_postings_journal_entries FOREIGN KEY(entry_id) REFERENCES journal_entries(entry_id),
+    CONSTRAINT fk_postings_accounts FOREIGN KEY(account_id) REFERENCES accounts(account_id),
+    CONSTRAINT chk_postings_amount CHECK (amount <> 0)
+);
+
+-- материализованный баланс пользователя, обновляется в одной транзакции с проводкой
+CREATE TABLE IF NOT EXISTS user_balances(
+    user_id INT PRIMARY KEY,
+    current NUMERIC NOT NULL DEFAULT 0,
+    CONSTRAINT fk_user_balances_users FOREIGN KEY(user_id) REFERENCES users(user_id)
+);
+
+-- перенос истории bonus_flow в журнал: одна проводка на каждую запись
+ALTER TABLE bonus_flow ADD COLUMN IF NOT EXISTS entry_id INT;
+
+INSERT INTO journal_entries(entry_id, kind, order_number, datetime)
+SELECT bonus_flow_id,
+    CASE WHEN amount >= 0 THEN 'ACCRUAL' ELSE 'WITHDRAWAL' END,
+    order_number,
+    datetime
+FROM bonus_flow
+WHERE amount <> 0;
+
+SELECT setval(pg_get_serial_sequence('journal_entries', 'entry_id'), coalesce(max(entry_id), 0) + 1, false)
+FROM journal_entries;
+
+UPDATE bonus_flow SET entry_id = bonus_flow_id WHERE amount <> 0;
+
+INSERT INTO postings(entry_id, account_id, amount)
+SELECT bf.bonus_flow_id, a.account_id, bf.amount::numeric
+FROM bonus_flow bf JOIN accounts a ON a.user_id = bf.user_id
+WHERE bf.amount <> 0;
+
+INSERT INTO postings(entry_id, account_id, amount)
+SELECT bf.bonus_flow_id, a.account_id, -(bf.amount::numeric)
+FROM bonus_flow bf JOIN accounts a ON a.code = CASE WHEN bf.amount >= 0 THEN 'ACCRUAL' ELSE 'WITHDRAWAL' END
+WHERE bf.amount <> 0;
+
+INSERT INTO user_balances(user_id, current)
+SELECT a.user_id, coalesce(sum(p.amount), 0)
+FROM accounts a LEFT JOIN postings p ON p.account_id = a.account_id
+WHERE a.user_id IS NOT NULL
+GROUP BY a.user_id;
+
+ALTER TABLE bonus_flow
+    ADD CONSTRAINT fk_bonus_flow_journal_entries FOREIGN KEY(entry_id) REFERENCES journal_entries(entry_id);
+
+-- проверка баланса проводки выполняется при коммите транзакции
+CREATE OR REPLACE FUNCTION check_journal_entry_balanced() RETURNS trigger AS $$
+BEGIN
+    IF (SELECT coalesce(sum(amount), 0) FROM postings WHERE entry_id = NEW.entry_id) <> 0 THEN
+        RAISE EXCEPTION 'journal entry % is not balanced', NEW.entry_id USING ERRCODE = 'check_violation';
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER trg_postings_balanced
+    AFTER INSERT ON postings
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION check_journal_entry_balanced();
+
+COMMIT;
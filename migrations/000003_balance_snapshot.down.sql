@@ -0,0 +1,4 @@
+ALTER TABLE user_balances
+    DROP COLUMN IF EXISTS withdrawn,
+    DROP COLUMN IF EXISTS version,
+    DROP COLUMN IF EXISTS updated_at;
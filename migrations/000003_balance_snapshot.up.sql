@@ -0,0 +1,23 @@
+BEGIN;
+-- снимок баланса пользователя: текущий баланс, сумма списаний и версия снимка
+ALTER TABLE user_balances
+    ADD COLUMN IF NOT EXISTS withdrawn NUMERIC NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT NOW();
+
+-- пересчет по журналу: списания и сторно списаний
+UPDATE user_balances b
+SET withdrawn = q.withdrawn, version = q.version
+FROM (
+    SELECT a.user_id,
+        coalesce(sum(CASE WHEN je.kind = 'WITHDRAWAL' OR rev.kind = 'WITHDRAWAL' THEN -p.amount END), 0) withdrawn,
+        count(*) version
+    FROM postings p
+        JOIN accounts a ON a.account_id = p.account_id AND a.user_id IS NOT NULL
+        JOIN journal_entries je ON je.entry_id = p.entry_id
+        LEFT JOIN journal_entries rev ON rev.entry_id = je.reverses_entry_id
+    GROUP BY a.user_id
+    ) q
+WHERE q.user_id = b.user_id;
+
+COMMIT;
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS credit_lots;
+ALTER TABLE journal_entries DROP CONSTRAINT IF EXISTS chk_journal_entries_kind;
+ALTER TABLE journal_entries ADD CONSTRAINT chk_journal_entries_kind
+    CHECK (kind IN ('ACCRUAL', 'WITHDRAWAL', 'REVERSAL', 'ADJUSTMENT'));
+DELETE FROM accounts WHERE code = 'EXPIRATION';
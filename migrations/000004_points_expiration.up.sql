@@ -0,0 +1,37 @@
+BEGIN;
+INSERT INTO accounts(code) VALUES ('EXPIRATION');
+
+ALTER TABLE journal_entries DROP CONSTRAINT IF EXISTS chk_journal_entries_kind;
+ALTER TABLE journal_entries ADD CONSTRAINT chk_journal_entries_kind
+    CHECK (kind IN ('ACCRUAL', 'WITHDRAWAL', 'REVERSAL', 'ADJUSTMENT', 'EXPIRATION'));
+
+-- партии начисленных баллов: списания и сгорание расходуют партии начиная с самых старых
+CREATE TABLE IF NOT EXISTS credit_lots(
+    lot_id serial PRIMARY KEY,
+    user_id INT NOT NULL,
+    entry_id INT NOT NULL,
+    amount NUMERIC NOT NULL,
+    remaining NUMERIC NOT NULL,
+    credited_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT fk_credit_lots_users FOREIGN KEY(user_id) REFERENCES users(user_id),
+    CONSTRAINT fk_credit_lots_journal_entries FOREIGN KEY(entry_id) REFERENCES journal_entries(entry_id),
+    CONSTRAINT chk_credit_lots_remaining CHECK (remaining >= 0 AND remaining <= amount)
+);
+
+-- партии для уже начисленных баллов: текущий баланс покрывается самыми новыми начислениями
+INSERT INTO credit_lots(user_id, entry_id, amount, remaining, credited_at)
+SELECT user_id, entry_id, amount, least(amount, greatest(current - newer, 0)), datetime
+FROM (
+    SELECT a.user_id, je.entry_id, p.amount, je.datetime, b.current,
+        coalesce(sum(p.amount) OVER (
+            PARTITION BY a.user_id ORDER BY je.datetime DESC, je.entry_id DESC
+            ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING
+            ), 0) newer
+    FROM postings p
+        JOIN accounts a ON a.account_id = p.account_id AND a.user_id IS NOT NULL
+        JOIN journal_entries je ON je.entry_id = p.entry_id
+        JOIN user_balances b ON b.user_id = a.user_id
+    WHERE p.amount > 0
+    ) q;
+
+COMMIT;
@@ -0,0 +1 @@
+DELETE FROM status WHERE name = 'CANCELLED';
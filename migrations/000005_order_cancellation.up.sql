@@ -0,0 +1 @@
+INSERT INTO status(name) VALUES ('CANCELLED') ON CONFLICT (name) DO NOTHING;
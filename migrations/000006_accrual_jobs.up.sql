@@ -0,0 +1,26 @@
+BEGIN;
+-- очередь опроса аккрол сервиса: заказ находится в очереди пока не получит конечный статус
+CREATE TABLE IF NOT EXISTS accrual_jobs(
+    order_id INT PRIMARY KEY,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    attempts INT NOT NULL DEFAULT 0,
+    lease_owner TEXT,
+    lease_until TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT fk_accrual_jobs_orders FOREIGN KEY(order_id) REFERENCES orders(order_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_accrual_jobs_next_attempt_at ON accrual_jobs(next_attempt_at);
+
+-- в очередь попадают заказы ожидающие расчета
+INSERT INTO accrual_jobs(order_id, created_at)
+SELECT order_id, upload FROM (
+    SELECT DISTINCT ON (os.order_id) os.order_id, s.name stat, o.datetime upload
+    FROM orders o JOIN order_status os ON o.order_id = os.order_id
+        JOIN status s ON s.status_id = os.status_id
+    ORDER BY os.order_id, os.datetime DESC
+    ) q
+WHERE stat IN ('PROCESSING', 'NEW')
+ON CONFLICT (order_id) DO NOTHING;
+
+COMMIT;
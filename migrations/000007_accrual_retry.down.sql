@@ -0,0 +1,4 @@
+ALTER TABLE accrual_jobs
+    DROP COLUMN IF EXISTS failures,
+    DROP COLUMN IF EXISTS last_error;
+DELETE FROM status WHERE name = 'STALE';
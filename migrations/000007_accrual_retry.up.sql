@@ -0,0 +1,8 @@
+BEGIN;
+INSERT INTO status(name) VALUES ('STALE') ON CONFLICT (name) DO NOTHING;
+
+-- состояние повторов: число неудачных опросов подряд и последняя ошибка
+ALTER TABLE accrual_jobs
+    ADD COLUMN IF NOT EXISTS failures INT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_error TEXT;
+COMMIT;
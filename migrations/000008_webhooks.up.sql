@@ -0,0 +1,38 @@
+BEGIN;
+-- получатели вебхуков; пустой список event_types - все события
+CREATE TABLE IF NOT EXISTS webhook_endpoints(
+    endpoint_id SERIAL PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    event_types TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- исходящие бизнес события, пишутся в транзакции изменения (transactional outbox)
+CREATE TABLE IF NOT EXISTS outbox(
+    event_id BIGSERIAL PRIMARY KEY,
+    event_type TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- доставка события получателю, создается вместе с событием для каждого подписанного получателя
+CREATE TABLE IF NOT EXISTS webhook_deliveries(
+    delivery_id BIGSERIAL PRIMARY KEY,
+    event_id BIGINT NOT NULL,
+    endpoint_id INT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'PENDING',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_error TEXT,
+    delivered_at TIMESTAMP,
+    CONSTRAINT fk_webhook_deliveries_outbox FOREIGN KEY(event_id) REFERENCES outbox(event_id),
+    CONSTRAINT fk_webhook_deliveries_endpoints FOREIGN KEY(endpoint_id) REFERENCES webhook_endpoints(endpoint_id) ON DELETE CASCADE,
+    CONSTRAINT webhook_deliveries_status_check CHECK (status IN ('PENDING', 'DELIVERED', 'FAILED')),
+    UNIQUE(event_id, endpoint_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON webhook_deliveries(next_attempt_at) WHERE status = 'PENDING';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_endpoint ON webhook_deliveries(endpoint_id, status);
+
+COMMIT;
@@ -0,0 +1,27 @@
+BEGIN;
+-- журнал доменных событий, только добавление. event_id служит смещением для читателей.
+-- created_at - время записи события (а не начала транзакции), по нему читатель отличает
+-- пропуск в смещениях от отката от события еще не завершенной транзакции
+CREATE TABLE IF NOT EXISTS events(
+    event_id BIGSERIAL PRIMARY KEY,
+    event_type TEXT NOT NULL,
+    user_id INT,
+    order_number TEXT,
+    payload JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT clock_timestamp(),
+    CONSTRAINT events_type_check CHECK (event_type IN (
+        'order.uploaded', 'order.status_changed', 'points.credited', 'points.debited', 'points.withdrawn'
+    ))
+);
+
+CREATE OR REPLACE FUNCTION events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'events table is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_events_append_only
+    BEFORE UPDATE OR DELETE ON events
+    FOR EACH ROW EXECUTE FUNCTION events_append_only();
+
+COMMIT;
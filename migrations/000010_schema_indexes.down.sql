@@ -0,0 +1,31 @@
+BEGIN;
+ALTER TABLE bonus_flow DROP CONSTRAINT IF EXISTS fk_bonus_flow_orders;
+ALTER TABLE bonus_flow DROP COLUMN IF EXISTS order_id;
+
+ALTER TABLE order_status DROP CONSTRAINT IF EXISTS chk_order_status_accrual;
+ALTER TABLE user_balances DROP CONSTRAINT IF EXISTS chk_user_balances_withdrawn;
+ALTER TABLE accrual_jobs DROP CONSTRAINT IF EXISTS chk_accrual_jobs_attempts;
+
+ALTER TABLE orders ALTER COLUMN datetime TYPE TIMESTAMP;
+ALTER TABLE order_status ALTER COLUMN datetime TYPE TIMESTAMP;
+ALTER TABLE bonus_flow ALTER COLUMN datetime TYPE TIMESTAMP;
+ALTER TABLE journal_entries ALTER COLUMN datetime TYPE TIMESTAMP;
+ALTER TABLE user_balances ALTER COLUMN updated_at TYPE TIMESTAMP;
+ALTER TABLE credit_lots ALTER COLUMN credited_at TYPE TIMESTAMP;
+ALTER TABLE accrual_jobs
+    ALTER COLUMN next_attempt_at TYPE TIMESTAMP,
+    ALTER COLUMN lease_until TYPE TIMESTAMP,
+    ALTER COLUMN created_at TYPE TIMESTAMP;
+ALTER TABLE webhook_endpoints ALTER COLUMN created_at TYPE TIMESTAMP;
+ALTER TABLE outbox ALTER COLUMN created_at TYPE TIMESTAMP;
+ALTER TABLE webhook_deliveries
+    ALTER COLUMN next_attempt_at TYPE TIMESTAMP,
+    ALTER COLUMN delivered_at TYPE TIMESTAMP;
+ALTER TABLE events ALTER COLUMN created_at TYPE TIMESTAMP;
+
+DROP INDEX IF EXISTS idx_orders_user_id;
+DROP INDEX IF EXISTS idx_order_status_order_id_datetime;
+DROP INDEX IF EXISTS idx_bonus_flow_user_id;
+DROP INDEX IF EXISTS idx_journal_entries_order_number;
+DROP INDEX IF EXISTS idx_credit_lots_user_id;
+COMMIT;
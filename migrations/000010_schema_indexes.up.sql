@@ -0,0 +1,41 @@
+BEGIN;
+-- индексы под частые запросы: заказы пользователя (GetOrders), последний статус заказа
+-- (GetOrders, GetOrdersByStatus), движения и лоты пользователя (GetBonusFlow, списание и сгорание)
+CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders(user_id);
+CREATE INDEX IF NOT EXISTS idx_order_status_order_id_datetime ON order_status(order_id, datetime DESC, order_status_id DESC);
+CREATE INDEX IF NOT EXISTS idx_bonus_flow_user_id ON bonus_flow(user_id, datetime);
+CREATE INDEX IF NOT EXISTS idx_journal_entries_order_number ON journal_entries(order_number);
+CREATE INDEX IF NOT EXISTS idx_credit_lots_user_id ON credit_lots(user_id, credited_at) WHERE remaining > 0;
+
+-- время с часовым поясом; прежние значения записаны NOW() в часовом поясе сессии
+-- и переводятся в нем же (поведение приведения типа по умолчанию)
+ALTER TABLE orders ALTER COLUMN datetime TYPE TIMESTAMPTZ;
+ALTER TABLE order_status ALTER COLUMN datetime TYPE TIMESTAMPTZ;
+ALTER TABLE bonus_flow ALTER COLUMN datetime TYPE TIMESTAMPTZ;
+ALTER TABLE journal_entries ALTER COLUMN datetime TYPE TIMESTAMPTZ;
+ALTER TABLE user_balances ALTER COLUMN updated_at TYPE TIMESTAMPTZ;
+ALTER TABLE credit_lots ALTER COLUMN credited_at TYPE TIMESTAMPTZ;
+ALTER TABLE accrual_jobs
+    ALTER COLUMN next_attempt_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN lease_until TYPE TIMESTAMPTZ,
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+ALTER TABLE webhook_endpoints ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+ALTER TABLE outbox ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+ALTER TABLE webhook_deliveries
+    ALTER COLUMN next_attempt_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN delivered_at TYPE TIMESTAMPTZ;
+ALTER TABLE events ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+
+-- начисление не бывает отрицательным, сумма списаний и счетчики попыток тоже
+ALTER TABLE order_status ADD CONSTRAINT chk_order_status_accrual CHECK (accrual IS NULL OR accrual >= 0);
+ALTER TABLE user_balances ADD CONSTRAINT chk_user_balances_withdrawn CHECK (withdrawn >= 0);
+ALTER TABLE accrual_jobs ADD CONSTRAINT chk_accrual_jobs_attempts CHECK (attempts >= 0 AND failures >= 0);
+
+-- движение по начислению ссылается на заказ; у списаний номер заказа произвольный, ссылки нет
+ALTER TABLE bonus_flow ADD COLUMN IF NOT EXISTS order_id INT;
+UPDATE bonus_flow bf SET order_id = o.order_id
+FROM orders o
+WHERE o.number = bf.order_number AND o.user_id = bf.user_id;
+ALTER TABLE bonus_flow ADD CONSTRAINT fk_bonus_flow_orders FOREIGN KEY(order_id) REFERENCES orders(order_id);
+CREATE INDEX IF NOT EXISTS idx_bonus_flow_order_id ON bonus_flow(order_id);
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+-- из повторов статуса остается первая запись
+DELETE FROM order_status os USING order_status prev
+WHERE prev.order_id = os.order_id AND prev.status_id = os.status_id AND prev.order_status_id < os.order_status_id;
+ALTER TABLE order_status ADD CONSTRAINT order_status_order_id_status_id_key UNIQUE (order_id, status_id);
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+-- заказ может вернуться в уже пройденный статус (NEW -> PROCESSING -> STALE -> PROCESSING),
+-- повтор текущего статуса отсекает SetOrderStatus под блокировкой заказа
+ALTER TABLE order_status DROP CONSTRAINT IF EXISTS order_status_order_id_status_id_key;
+COMMIT;
@@ -0,0 +1,13 @@
+package migrations
+
+import "embed"
+
+// миграции схемы Postgres, встроены в бинарник и не зависят от рабочего каталога
+
+//go:embed *.sql
+var FS embed.FS
+
+// миграции схемы SQLite, лежат в каталоге sqlite
+
+//go:embed sqlite/*.sql
+var SQLiteFS embed.FS
@@ -0,0 +1,15 @@
+DROP TABLE IF EXISTS events;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS outbox;
+DROP TABLE IF EXISTS webhook_endpoints;
+DROP TABLE IF EXISTS accrual_jobs;
+DROP TABLE IF EXISTS credit_lots;
+DROP TABLE IF EXISTS bonus_flow;
+DROP TABLE IF EXISTS user_balances;
+DROP TABLE IF EXISTS postings;
+DROP TABLE IF EXISTS journal_entries;
+DROP TABLE IF EXISTS accounts;
+DROP TABLE IF EXISTS order_status;
+DROP TABLE IF EXISTS status;
+DROP TABLE IF EXISTS orders;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,201 @@
+-- схема SQLite, повторяет схему Postgres на момент миграции 000010.
+-- мигратор сам оборачивает каждый файл в транзакцию, поэтому BEGIN и COMMIT здесь не нужны.
+-- время хранится целым числом микросекунд от начала эпохи (UTC), суммы журнала, балансов и партий
+-- начислений - целым числом миллионных долей балла: в SQLite нет точного NUMERIC
+CREATE TABLE IF NOT EXISTS users(
+    user_id INTEGER PRIMARY KEY,
+    login TEXT UNIQUE NOT NULL,
+    password_hash TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS orders(
+    order_id INTEGER PRIMARY KEY,
+    number TEXT UNIQUE NOT NULL,
+    user_id INTEGER NOT NULL,
+    datetime INTEGER NOT NULL,
+    CONSTRAINT fk_order_users FOREIGN KEY(user_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders(user_id);
+
+CREATE TABLE IF NOT EXISTS status(
+    status_id INTEGER PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL
+);
+
+INSERT INTO status(name)
+VALUES ('NEW'), ('PROCESSING'), ('INVALID'), ('PROCESSED'), ('CANCELLED'), ('STALE');
+
+CREATE TABLE IF NOT EXISTS order_status(
+    order_status_id INTEGER PRIMARY KEY,
+    status_id INTEGER NOT NULL,
+    order_id INTEGER NOT NULL,
+    datetime INTEGER NOT NULL,
+    accrual REAL,
+    UNIQUE (order_id, status_id),
+    CONSTRAINT fk_order_status_status FOREIGN KEY(status_id) REFERENCES status(status_id),
+    CONSTRAINT fk_order_status_orders FOREIGN KEY(order_id) REFERENCES orders(order_id),
+    CONSTRAINT chk_order_status_accrual CHECK (accrual IS NULL OR accrual >= 0)
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_status_order_id_datetime ON order_status(order_id, datetime DESC, order_status_id DESC);
+
+-- счета двойной записи: счет пользователя (user_id) либо системный счет (code)
+CREATE TABLE IF NOT EXISTS accounts(
+    account_id INTEGER PRIMARY KEY,
+    user_id INTEGER UNIQUE,
+    code TEXT UNIQUE,
+    CONSTRAINT fk_accounts_users FOREIGN KEY(user_id) REFERENCES users(user_id),
+    CONSTRAINT chk_accounts_owner CHECK ((user_id IS NULL) <> (code IS NULL))
+);
+
+INSERT INTO accounts(code)
+VALUES ('ACCRUAL'), ('WITHDRAWAL'), ('ADJUSTMENT'), ('EXPIRATION');
+
+-- журнал проводок
+CREATE TABLE IF NOT EXISTS journal_entries(
+    entry_id INTEGER PRIMARY KEY,
+    kind TEXT NOT NULL,
+    order_number TEXT,
+    reverses_entry_id INTEGER UNIQUE,
+    comment TEXT,
+    datetime INTEGER NOT NULL,
+    CONSTRAINT fk_journal_entries_reverses FOREIGN KEY(reverses_entry_id) REFERENCES journal_entries(entry_id),
+    CONSTRAINT chk_journal_entries_kind CHECK (kind IN ('ACCRUAL', 'WITHDRAWAL', 'REVERSAL', 'ADJUSTMENT', 'EXPIRATION'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_journal_entries_order_number ON journal_entries(order_number);
+
+-- движения по счетам в рамках проводки. в SQLite нет отложенных триггеров,
+-- поэтому равенство суммы движений проводки нулю проверяет только приложение (ledger.Validate)
+CREATE TABLE IF NOT EXISTS postings(
+    posting_id INTEGER PRIMARY KEY,
+    entry_id INTEGER NOT NULL,
+    account_id INTEGER NOT NULL,
+    amount INTEGER NOT NULL,
+    UNIQUE (entry_id, account_id),
+    CONSTRAINT fk_postings_journal_entries FOREIGN KEY(entry_id) REFERENCES journal_entries(entry_id),
+    CONSTRAINT fk_postings_accounts FOREIGN KEY(account_id) REFERENCES accounts(account_id),
+    CONSTRAINT chk_postings_amount CHECK (amount <> 0)
+);
+
+-- снимок баланса пользователя: текущий баланс, сумма списаний и версия снимка
+CREATE TABLE IF NOT EXISTS user_balances(
+    user_id INTEGER PRIMARY KEY,
+    current INTEGER NOT NULL DEFAULT 0,
+    withdrawn INTEGER NOT NULL DEFAULT 0,
+    version INTEGER NOT NULL DEFAULT 0,
+    updated_at INTEGER NOT NULL,
+    CONSTRAINT fk_user_balances_users FOREIGN KEY(user_id) REFERENCES users(user_id),
+    CONSTRAINT chk_user_balances_withdrawn CHECK (withdrawn >= 0)
+);
+
+-- движение бонусов: начисления за заказы и списания
+CREATE TABLE IF NOT EXISTS bonus_flow(
+    bonus_flow_id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    order_number TEXT NOT NULL,
+    amount REAL NOT NULL,
+    datetime INTEGER NOT NULL,
+    entry_id INTEGER,
+    order_id INTEGER,
+    CONSTRAINT fk_bonus_flow_users FOREIGN KEY(user_id) REFERENCES users(user_id),
+    CONSTRAINT fk_bonus_flow_journal_entries FOREIGN KEY(entry_id) REFERENCES journal_entries(entry_id),
+    CONSTRAINT fk_bonus_flow_orders FOREIGN KEY(order_id) REFERENCES orders(order_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_bonus_flow_user_id ON bonus_flow(user_id, datetime);
+CREATE INDEX IF NOT EXISTS idx_bonus_flow_order_id ON bonus_flow(order_id);
+
+-- партии начисленных баллов: списания и сгорание расходуют партии начиная с самых старых
+CREATE TABLE IF NOT EXISTS credit_lots(
+    lot_id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    entry_id INTEGER NOT NULL,
+    amount INTEGER NOT NULL,
+    remaining INTEGER NOT NULL,
+    credited_at INTEGER NOT NULL,
+    CONSTRAINT fk_credit_lots_users FOREIGN KEY(user_id) REFERENCES users(user_id),
+    CONSTRAINT fk_credit_lots_journal_entries FOREIGN KEY(entry_id) REFERENCES journal_entries(entry_id),
+    CONSTRAINT chk_credit_lots_remaining CHECK (remaining >= 0 AND remaining <= amount)
+);
+
+CREATE INDEX IF NOT EXISTS idx_credit_lots_user_id ON credit_lots(user_id, credited_at) WHERE remaining > 0;
+
+-- очередь опроса аккрол сервиса: заказ находится в очереди пока не получит конечный статус
+CREATE TABLE IF NOT EXISTS accrual_jobs(
+    order_id INTEGER PRIMARY KEY,
+    next_attempt_at INTEGER NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    lease_owner TEXT,
+    lease_until INTEGER,
+    created_at INTEGER NOT NULL,
+    CONSTRAINT fk_accrual_jobs_orders FOREIGN KEY(order_id) REFERENCES orders(order_id),
+    CONSTRAINT chk_accrual_jobs_attempts CHECK (attempts >= 0 AND failures >= 0)
+);
+
+CREATE INDEX IF NOT EXISTS idx_accrual_jobs_next_attempt_at ON accrual_jobs(next_attempt_at);
+
+-- получатели вебхуков; event_types - типы событий через запятую, пустая строка - все события
+CREATE TABLE IF NOT EXISTS webhook_endpoints(
+    endpoint_id INTEGER PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    event_types TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL
+);
+
+-- исходящие бизнес события, пишутся в транзакции изменения (transactional outbox)
+CREATE TABLE IF NOT EXISTS outbox(
+    event_id INTEGER PRIMARY KEY,
+    event_type TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+
+-- доставка события получателю, создается вместе с событием для каждого подписанного получателя
+CREATE TABLE IF NOT EXISTS webhook_deliveries(
+    delivery_id INTEGER PRIMARY KEY,
+    event_id INTEGER NOT NULL,
+    endpoint_id INTEGER NOT NULL,
+    status TEXT NOT NULL DEFAULT 'PENDING',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at INTEGER NOT NULL,
+    last_error TEXT,
+    delivered_at INTEGER,
+    CONSTRAINT fk_webhook_deliveries_outbox FOREIGN KEY(event_id) REFERENCES outbox(event_id),
+    CONSTRAINT fk_webhook_deliveries_endpoints FOREIGN KEY(endpoint_id) REFERENCES webhook_endpoints(endpoint_id) ON DELETE CASCADE,
+    CONSTRAINT webhook_deliveries_status_check CHECK (status IN ('PENDING', 'DELIVERED', 'FAILED')),
+    UNIQUE(event_id, endpoint_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON webhook_deliveries(next_attempt_at) WHERE status = 'PENDING';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_endpoint ON webhook_deliveries(endpoint_id, status);
+
+-- журнал доменных событий, только добавление. event_id служит смещением для читателей:
+-- транзакции записи в SQLite выполняются по одной, поэтому события фиксируются в порядке смещений без пропусков
+CREATE TABLE IF NOT EXISTS events(
+    event_id INTEGER PRIMARY KEY,
+    event_type TEXT NOT NULL,
+    user_id INTEGER,
+    order_number TEXT,
+    payload TEXT NOT NULL DEFAULT '{}',
+    created_at INTEGER NOT NULL,
+    CONSTRAINT events_type_check CHECK (event_type IN (
+        'order.uploaded', 'order.status_changed', 'points.credited', 'points.debited', 'points.withdrawn'
+    ))
+);
+
+CREATE TRIGGER IF NOT EXISTS trg_events_append_only_update
+    BEFORE UPDATE ON events
+BEGIN
+    SELECT RAISE(ABORT, 'events table is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS trg_events_append_only_delete
+    BEFORE DELETE ON events
+BEGIN
+    SELECT RAISE(ABORT, 'events table is append-only');
+END;
@@ -0,0 +1,8 @@
+-- из повторов статуса остается первая запись
+DELETE FROM order_status
+WHERE EXISTS (
+    SELECT 1 FROM order_status prev
+    WHERE prev.order_id = order_status.order_id AND prev.status_id = order_status.status_id
+        AND prev.order_status_id < order_status.order_status_id
+    );
+CREATE UNIQUE INDEX IF NOT EXISTS order_status_order_id_status_id_key ON order_status(order_id, status_id);
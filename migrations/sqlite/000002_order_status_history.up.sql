@@ -0,0 +1,16 @@
+-- повторяет миграцию Postgres 000011: заказ может вернуться в уже пройденный статус.
+-- ограничение таблицы в SQLite не удаляется, поэтому таблица пересоздается без UNIQUE (order_id, status_id)
+CREATE TABLE order_status_new(
+    order_status_id INTEGER PRIMARY KEY,
+    status_id INTEGER NOT NULL,
+    order_id INTEGER NOT NULL,
+    datetime INTEGER NOT NULL,
+    accrual REAL,
+    CONSTRAINT fk_order_status_status FOREIGN KEY(status_id) REFERENCES status(status_id),
+    CONSTRAINT fk_order_status_orders FOREIGN KEY(order_id) REFERENCES orders(order_id),
+    CONSTRAINT chk_order_status_accrual CHECK (accrual IS NULL OR accrual >= 0)
+);
+INSERT INTO order_status_new SELECT order_status_id, status_id, order_id, datetime, accrual FROM order_status;
+DROP TABLE order_status;
+ALTER TABLE order_status_new RENAME TO order_status;
+CREATE INDEX IF NOT EXISTS idx_order_status_order_id_datetime ON order_status(order_id, datetime DESC, order_status_id DESC);
@@ -0,0 +1,143 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// пакет реализует автоматический выключатель (circuit breaker) для вызовов внешних сервисов.
+// closed - вызовы проходят, ошибки подряд считаются;
+// open - после FailureThreshold ошибок подряд вызовы отклоняются без обращения к сервису;
+// half-open - по истечении OpenTimeout пропускается HalfOpenRequests пробных вызовов,
+// их успех закрывает выключатель, любая ошибка снова открывает
+
+type State int
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+var ErrOpen error = errors.New("circuit breaker is open")
+
+type Settings struct {
+	FailureThreshold int           // ошибок подряд для размыкания
+	OpenTimeout      time.Duration // сколько выключатель остается разомкнутым
+	HalfOpenRequests int           // пробных вызовов в полуоткрытом состоянии
+}
+
+type Breaker struct {
+	mu            sync.Mutex
+	settings      Settings
+	state         State
+	failures      int
+	halfOpenCalls int // пробных вызовов выдано в полуоткрытом состоянии
+	successes     int // успешных пробных вызовов
+	openedAt      time.Time
+	onStateChange func(from, to State)
+}
+
+// onStateChange вызывается при каждой смене состояния под блокировкой выключателя, может быть nil
+func New(settings Settings, onStateChange func(from, to State)) *Breaker {
+	if settings.FailureThreshold <= 0 {
+		settings.FailureThreshold = 1
+	}
+	if settings.HalfOpenRequests <= 0 {
+		settings.HalfOpenRequests = 1
+	}
+	return &Breaker{settings: settings, onStateChange: onStateChange}
+}
+
+// текущее состояние выключателя
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checkOpenTimeout()
+	return b.state
+}
+
+// разрешает вызов либо возвращает ErrOpen.
+// после разрешенного вызова нужно сообщить результат через Success или Failure
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checkOpenTimeout()
+	switch b.state {
+	case StateOpen:
+		return ErrOpen
+	case StateHalfOpen:
+		if b.halfOpenCalls >= b.settings.HalfOpenRequests {
+			return ErrOpen
+		}
+		b.halfOpenCalls++
+	}
+	return nil
+}
+
+// успешный вызов
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case StateClosed:
+		b.failures = 0
+	case StateHalfOpen:
+		b.successes++
+		if b.successes >= b.settings.HalfOpenRequests {
+			b.setState(StateClosed)
+		}
+	}
+}
+
+// неудачный вызов
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case StateClosed:
+		b.failures++
+		if b.failures >= b.settings.FailureThreshold {
+			b.setState(StateOpen)
+		}
+	case StateHalfOpen:
+		b.setState(StateOpen)
+	}
+}
+
+// переводит разомкнутый выключатель в полуоткрытое состояние по истечении OpenTimeout
+func (b *Breaker) checkOpenTimeout() {
+	if b.state == StateOpen && time.Since(b.openedAt) >= b.settings.OpenTimeout {
+		b.setState(StateHalfOpen)
+	}
+}
+
+func (b *Breaker) setState(state State) {
+	if b.state == state {
+		return
+	}
+	from := b.state
+	b.state = state
+	b.failures = 0
+	b.halfOpenCalls = 0
+	b.successes = 0
+	if state == StateOpen {
+		b.openedAt = time.Now()
+	}
+	if b.onStateChange != nil {
+		b.onStateChange(from, state)
+	}
+}
@@ -0,0 +1,128 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// выключатель с записью смен состояния
+func newTestBreaker(settings Settings) (*Breaker, *[]State) {
+	var transitions []State
+	b := New(settings, func(from, to State) {
+		transitions = append(transitions, to)
+	})
+	return b, &transitions
+}
+
+func assertState(t *testing.T, b *Breaker, want State) {
+	t.Helper()
+	if state := b.State(); state != want {
+		t.Errorf("state = %s, want %s", state, want)
+	}
+}
+
+func TestOpensAtFailureThreshold(t *testing.T) {
+	b, transitions := newTestBreaker(Settings{FailureThreshold: 3, OpenTimeout: time.Hour, HalfOpenRequests: 1})
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("Allow: %v", err)
+		}
+		b.Failure()
+	}
+	assertState(t, b, StateClosed)
+
+	// успех сбрасывает счетчик ошибок подряд
+	b.Success()
+	for i := 0; i < 2; i++ {
+		b.Failure()
+	}
+	assertState(t, b, StateClosed)
+
+	b.Failure()
+	assertState(t, b, StateOpen)
+	if err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Errorf("Allow in open state = %v, want ErrOpen", err)
+	}
+	if len(*transitions) != 1 || (*transitions)[0] != StateOpen {
+		t.Errorf("transitions = %v, want [open]", *transitions)
+	}
+}
+
+func TestHalfOpenAfterOpenTimeout(t *testing.T) {
+	b, transitions := newTestBreaker(Settings{FailureThreshold: 1, OpenTimeout: 20 * time.Millisecond, HalfOpenRequests: 2})
+	b.Failure()
+	assertState(t, b, StateOpen)
+
+	time.Sleep(30 * time.Millisecond)
+	assertState(t, b, StateHalfOpen)
+
+	// в полуоткрытом состоянии пропускается не больше HalfOpenRequests вызовов
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("Allow %d in half-open state: %v", i+1, err)
+		}
+	}
+	if err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Errorf("Allow over half-open limit = %v, want ErrOpen", err)
+	}
+
+	// выключатель закрывается только после успеха всех пробных вызовов
+	b.Success()
+	assertState(t, b, StateHalfOpen)
+	b.Success()
+	assertState(t, b, StateClosed)
+	if err := b.Allow(); err != nil {
+		t.Errorf("Allow after recovery: %v", err)
+	}
+
+	want := []State{StateOpen, StateHalfOpen, StateClosed}
+	if len(*transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", *transitions, want)
+	}
+	for i := range want {
+		if (*transitions)[i] != want[i] {
+			t.Errorf("transitions = %v, want %v", *transitions, want)
+			break
+		}
+	}
+}
+
+func TestHalfOpenFailureReopens(t *testing.T) {
+	b, transitions := newTestBreaker(Settings{FailureThreshold: 1, OpenTimeout: 20 * time.Millisecond, HalfOpenRequests: 1})
+	b.Failure()
+	time.Sleep(30 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow in half-open state: %v", err)
+	}
+	b.Failure()
+	assertState(t, b, StateOpen)
+	if err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Errorf("Allow after re-open = %v, want ErrOpen", err)
+	}
+
+	// после повторного размыкания таймаут отсчитывается заново
+	time.Sleep(30 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow in second half-open state: %v", err)
+	}
+	b.Success()
+	assertState(t, b, StateClosed)
+
+	want := []State{StateOpen, StateHalfOpen, StateOpen, StateHalfOpen, StateClosed}
+	if len(*transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", *transitions, want)
+	}
+	for i := range want {
+		if (*transitions)[i] != want[i] {
+			t.Errorf("transitions = %v, want %v", *transitions, want)
+			break
+		}
+	}
+}
+
+func TestDefaultSettings(t *testing.T) {
+	b := New(Settings{OpenTimeout: time.Hour}, nil)
+	b.Failure()
+	assertState(t, b, StateOpen)
+}
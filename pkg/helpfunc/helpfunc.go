@@ -1,6 +1,9 @@
 package helpfunc
 
-import "crypto/rand"
+import (
+	"crypto/rand"
+	"time"
+)
 
 // пакет с вспомогательными функциями
 
@@ -13,3 +16,19 @@ func GenerateRandomBytes(size int) ([]byte, error) {
 	}
 	return b, nil
 }
+
+// задержка перед повтором после failures ошибок подряд:
+// base * 2^(failures-1), не больше max, уменьшенная на долю jitter
+func Backoff(failures int, base, max time.Duration, jitter float64) time.Duration {
+	delay := base
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if jitter > 0 {
+		delay -= time.Duration(jitter * float64(delay))
+	}
+	return delay
+}
@@ -0,0 +1,43 @@
+package helpfunc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	cases := map[string]struct {
+		failures int
+		jitter   float64
+		want     time.Duration
+	}{
+		"first failure":       {1, 0, 10 * time.Second},
+		"no failures":         {0, 0, 10 * time.Second},
+		"second failure":      {2, 0, 20 * time.Second},
+		"fourth failure":      {4, 0, 80 * time.Second},
+		"capped":              {5, 0, 2 * time.Minute},
+		"capped far past max": {1000, 0, 2 * time.Minute},
+		"jitter":              {2, 0.25, 15 * time.Second},
+		"jitter of capped":    {10, 0.5, time.Minute},
+		"negative jitter":     {2, -1, 20 * time.Second},
+	}
+	for name, tc := range cases {
+		if got := Backoff(tc.failures, 10*time.Second, 2*time.Minute, tc.jitter); got != tc.want {
+			t.Errorf("%s: Backoff(%d, jitter %v) = %s, want %s", name, tc.failures, tc.jitter, got, tc.want)
+		}
+	}
+}
+
+// разброс только уменьшает задержку и не больше чем на долю jitter
+func TestBackoffJitterBounds(t *testing.T) {
+	const jitter = 0.2
+	for failures := 1; failures <= 10; failures++ {
+		delay := Backoff(failures, time.Second, time.Minute, 0)
+		for _, random := range []float64{0, 0.01, 0.5, 0.99} {
+			got := Backoff(failures, time.Second, time.Minute, jitter*random)
+			if got > delay || got < delay-time.Duration(jitter*float64(delay)) {
+				t.Errorf("Backoff(%d) with jitter %v = %s, want at most %v less than %s", failures, jitter*random, got, jitter, delay)
+			}
+		}
+	}
+}
@@ -2,28 +2,88 @@ package logger
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/bubu256/gophermart_pet/config"
 	"github.com/rs/zerolog"
 )
 
+// форматы логов
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+// логгер до загрузки конфигурации: JSON в stdout, уровень info, с маскированием секретов
 func New() zerolog.Logger {
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
-	output.FormatLevel = func(i interface{}) string {
-		return strings.ToUpper(fmt.Sprintf("| %-6s|", i))
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	return zerolog.New(NewRedactWriter(os.Stdout)).With().Timestamp().Logger()
+}
+
+// логгер по конфигурации: формат, уровень, вывод и семплирование.
+// уровень выставляется глобально, чтобы его можно было менять у уже созданных логгеров
+func NewWithConfig(cfg config.CfgLog) (zerolog.Logger, error) {
+	level, err := parseLevel(cfg.Level)
+	if err != nil {
+		return zerolog.Nop(), err
+	}
+	out, err := openOutput(cfg.Output)
+	if err != nil {
+		return zerolog.Nop(), err
+	}
+
+	var writer io.Writer
+	switch strings.ToLower(cfg.Format) {
+	case FormatJSON:
+		writer = out
+	case FormatConsole:
+		writer = zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339, NoColor: out != os.Stdout && out != os.Stderr}
+	default:
+		return zerolog.Nop(), fmt.Errorf("неизвестный формат логов %q", cfg.Format)
 	}
-	output.FormatMessage = func(i interface{}) string {
-		return fmt.Sprintf("***%s****", i)
+	// маскирование идет до форматирования, чтобы секреты не попали и в консольный вывод
+	log := zerolog.New(NewRedactWriter(writer)).With().Timestamp().Logger()
+	if cfg.SampleEvery > 1 {
+		// семплируются только debug и info, предупреждения и ошибки пишутся всегда
+		sampler := &zerolog.BasicSampler{N: cfg.SampleEvery}
+		log = log.Sample(&zerolog.LevelSampler{DebugSampler: sampler, InfoSampler: sampler})
 	}
-	output.FormatFieldName = func(i interface{}) string {
-		return fmt.Sprintf("%s:", i)
+	zerolog.SetGlobalLevel(level)
+	return log, nil
+}
+
+// меняет уровень логирования всех логгеров приложения
+func SetLevel(level string) error {
+	parsed, err := parseLevel(level)
+	if err != nil {
+		return err
 	}
-	output.FormatFieldValue = func(i interface{}) string {
-		return strings.ToUpper(fmt.Sprintf("%s", i))
+	zerolog.SetGlobalLevel(parsed)
+	return nil
+}
+
+func parseLevel(level string) (zerolog.Level, error) {
+	parsed, err := zerolog.ParseLevel(strings.ToLower(level))
+	if err != nil || parsed == zerolog.NoLevel {
+		return zerolog.NoLevel, fmt.Errorf("неизвестный уровень логирования %q", level)
 	}
+	return parsed, nil
+}
 
-	log := zerolog.New(output).With().Timestamp().Logger()
-	return log
+// stdout, stderr или путь к файлу, файл дописывается
+func openOutput(output string) (io.Writer, error) {
+	switch strings.ToLower(output) {
+	case "", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось открыть файл логов: %w", err)
+	}
+	return file, nil
 }
@@ -0,0 +1,136 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// маскирование секретов в логах: значения полей с паролями, токенами и ключами заменяются на redactedValue.
+// поля ищутся по имени на любом уровне вложенности, текст сообщений не проверяется
+
+const redactedValue = "[REDACTED]"
+
+// части имен полей с секретами
+var sensitiveKeys = []string{"password", "passwd", "token", "secret", "authorization", "cookie", "api_key", "apikey"}
+
+// имена полей, секретные только целиком, чтобы не задеть например "order_key_count"
+var sensitiveExactKeys = map[string]bool{"key": true, "private_key": true, "secret_key": true}
+
+type redactWriter struct {
+	next io.Writer
+}
+
+// оборачивает вывод JSON записей zerolog маскированием секретных полей
+func NewRedactWriter(next io.Writer) io.Writer {
+	return redactWriter{next: next}
+}
+
+func (w redactWriter) Write(p []byte) (int, error) {
+	if !mayContainSecret(p) {
+		return w.next.Write(p)
+	}
+	redacted, ok := redact(p)
+	if !ok {
+		return w.next.Write(p)
+	}
+	if _, err := w.next.Write(redacted); err != nil {
+		return 0, err
+	}
+	// zerolog ждет длину исходной записи
+	return len(p), nil
+}
+
+// быстрая проверка без разбора JSON: большинство записей секретов не содержат
+func mayContainSecret(p []byte) bool {
+	lower := bytes.ToLower(p)
+	for _, key := range sensitiveKeys {
+		if bytes.Contains(lower, []byte(key)) {
+			return true
+		}
+	}
+	for key := range sensitiveExactKeys {
+		if bytes.Contains(lower, []byte(`"`+key+`"`)) {
+			return true
+		}
+	}
+	return false
+}
+
+// разбирает запись, маскирует поля и собирает ее обратно с переводом строки.
+// порядок полей сохраняется: объект верхнего уровня читается по токенам
+func redact(p []byte) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(p))
+	decoder.UseNumber()
+	token, err := decoder.Token()
+	if err != nil || token != json.Delim('{') {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for first := true; decoder.More(); first = false {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, false
+		}
+		key, ok := token.(string)
+		if !ok {
+			return nil, false
+		}
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			return nil, false
+		}
+		if isSensitive(key) {
+			value = redactedValue
+		} else {
+			value = redactValue(value)
+		}
+		encodedKey, _ := json.Marshal(key)
+		encodedValue, err := json.Marshal(value)
+		if err != nil {
+			return nil, false
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		buf.Write(encodedValue)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), true
+}
+
+// маскирует секретные поля вложенных объектов
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, nested := range v {
+			if isSensitive(key) {
+				v[key] = redactedValue
+				continue
+			}
+			v[key] = redactValue(nested)
+		}
+	case []any:
+		for i, nested := range v {
+			v[i] = redactValue(nested)
+		}
+	}
+	return value
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	if sensitiveExactKeys[key] {
+		return true
+	}
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
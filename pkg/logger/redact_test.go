@@ -0,0 +1,90 @@
+package logger
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRedactWriter(t *testing.T) {
+	cases := map[string]struct {
+		record string
+		want   string
+	}{
+		"no secrets": {
+			record: `{"level":"info","order":"12345678903","message":"ok"}` + "\n",
+			want:   `{"level":"info","order":"12345678903","message":"ok"}` + "\n",
+		},
+		"top level": {
+			record: `{"level":"info","password":"qwerty","message":"login"}` + "\n",
+			want:   `{"level":"info","password":"[REDACTED]","message":"login"}` + "\n",
+		},
+		"key name is case insensitive": {
+			record: `{"Authorization":"Bearer abc","X-Api-Key-Token":"abc"}` + "\n",
+			want:   `{"Authorization":"[REDACTED]","X-Api-Key-Token":"[REDACTED]"}` + "\n",
+		},
+		"nested object and array": {
+			record: `{"request":{"headers":{"cookie":"token=abc","accept":"*/*"}},"users":[{"login":"a","password_hash":"h"}]}` + "\n",
+			want:   `{"request":{"headers":{"accept":"*/*","cookie":"[REDACTED]"}},"users":[{"login":"a","password_hash":"[REDACTED]"}]}` + "\n",
+		},
+		"secret object is replaced whole": {
+			record: `{"secret":{"value":"abc"},"n":1}` + "\n",
+			want:   `{"secret":"[REDACTED]","n":1}` + "\n",
+		},
+		"exact key": {
+			record: `{"key":"abc","private_key":"pem","order_key_count":3}` + "\n",
+			want:   `{"key":"[REDACTED]","private_key":"[REDACTED]","order_key_count":3}` + "\n",
+		},
+		"key as part of name": {
+			record: `{"order_key_count":3,"keys":2}` + "\n",
+			want:   `{"order_key_count":3,"keys":2}` + "\n",
+		},
+		"numbers keep precision": {
+			record: `{"token":"abc","accrual":729.98,"id":12345678901234567890}` + "\n",
+			want:   `{"token":"[REDACTED]","accrual":729.98,"id":12345678901234567890}` + "\n",
+		},
+		"message text is not checked": {
+			record: `{"message":"password is wrong"}` + "\n",
+			want:   `{"message":"password is wrong"}` + "\n",
+		},
+		"not json": {
+			record: "password=qwerty\n",
+			want:   "password=qwerty\n",
+		},
+		"broken json": {
+			record: `{"password":"qwerty",` + "\n",
+			want:   `{"password":"qwerty",` + "\n",
+		},
+		"json array": {
+			record: `[{"password":"qwerty"}]` + "\n",
+			want:   `[{"password":"qwerty"}]` + "\n",
+		},
+	}
+	for name, tc := range cases {
+		var out bytes.Buffer
+		n, err := NewRedactWriter(&out).Write([]byte(tc.record))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		// zerolog считает запись неполной, если длина отличается от исходной
+		if n != len(tc.record) {
+			t.Errorf("%s: Write returned %d, want length of the original record %d", name, n, len(tc.record))
+		}
+		if out.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", name, out.String(), tc.want)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, bytes.ErrTooLarge
+}
+
+func TestRedactWriterError(t *testing.T) {
+	n, err := NewRedactWriter(failingWriter{}).Write([]byte(`{"password":"qwerty"}` + "\n"))
+	if err != bytes.ErrTooLarge || n != 0 {
+		t.Errorf("Write = %d, %v, want 0 and the error of the next writer", n, err)
+	}
+}
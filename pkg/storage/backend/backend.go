@@ -0,0 +1,35 @@
+package backend
+
+import (
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+	"github.com/bubu256/gophermart_pet/pkg/storage/postgres"
+	"github.com/bubu256/gophermart_pet/pkg/storage/sqlite"
+	"github.com/rs/zerolog"
+)
+
+// выбор реализации хранилища по схеме DATABASE_URI (см. config.CfgDataBase.Driver)
+
+// открывает хранилище и применяет или проверяет миграции, как и реализации хранилища
+func New(cfg config.CfgDataBase, logger zerolog.Logger) storage.Storage {
+	if cfg.Driver() == config.DriverSQLite {
+		return sqlite.New(cfg, logger)
+	}
+	return postgres.New(cfg, logger)
+}
+
+// мигратор схемы БД выбранной реализации хранилища
+func NewMigrator(cfg config.CfgDataBase) (storage.Migrator, error) {
+	if cfg.Driver() == config.DriverSQLite {
+		migrator, err := sqlite.NewMigrator(cfg.DataBaseURI)
+		if err != nil {
+			return nil, err
+		}
+		return migrator, nil
+	}
+	migrator, err := postgres.NewMigrator(cfg.DataBaseURI)
+	if err != nil {
+		return nil, err
+	}
+	return migrator, nil
+}
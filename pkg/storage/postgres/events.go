@@ -0,0 +1,129 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/jackc/pgx/v5"
+)
+
+// журнал доменных событий и события пользователей через LISTEN/NOTIFY.
+// и событие, и уведомление пишутся в транзакции изменения, уведомление доставляется слушателям только после коммита
+
+// событие без закрывающего пропуска в смещениях отдается читателю только спустя это время:
+// пропуск - либо откат, либо еще не завершенная транзакция, а транзакции изменений короче
+const eventsSettleDelay = 10 * time.Second
+
+const userEventsChannel = "user_events"
+
+// тело уведомления: UserID события не попадает в json для клиента, поэтому передается отдельно
+type userEventNotification struct {
+	UserID uint16           `json:"user_id"`
+	Event  schema.UserEvent `json:"event"`
+}
+
+// ставит в пачку добавление доменного события в журнал событий; data кодируется в json, nil - пустой объект
+func queueEvent(batch *pgx.Batch, eventType schema.DomainEventType, userID uint16, orderNumber string, data any) error {
+	payload := []byte("{}")
+	if data != nil {
+		var err error
+		payload, err = json.Marshal(data)
+		if err != nil {
+			return err
+		}
+	}
+	query := `
+	INSERT INTO events(event_type, user_id, order_number, payload)
+	VALUES ($1, NULLIF($2::int, 0), NULLIF($3, ''), $4::jsonb)
+	`
+	batch.Queue(query, eventType, userID, orderNumber, string(payload))
+	return nil
+}
+
+// возвращает до limit событий со смещением больше offset в порядке смещений.
+// чтение останавливается на пропуске в смещениях, пока не ясно, что это не событие незавершенной транзакции,
+// поэтому читатель, продолжающий с последнего полученного смещения, не теряет события
+func (p *PosgresDB) GetEvents(ctx context.Context, offset int64, limit int) ([]schema.DomainEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	query := `
+	SELECT event_id, event_type, coalesce(user_id, 0), coalesce(order_number, ''), payload::text, created_at,
+		created_at < clock_timestamp() - make_interval(secs => $3)
+	FROM events
+	WHERE event_id > $1
+	ORDER BY event_id
+	LIMIT $2
+	`
+	rows, err := p.DB.Query(ctx, query, offset, limit, eventsSettleDelay.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.DomainEvent, 0)
+	previous := offset
+	for rows.Next() {
+		event := schema.DomainEvent{}
+		var data string
+		var settled bool
+		err := rows.Scan(&event.Offset, &event.Type, &event.UserID, &event.OrderNumber, &data, &event.CreatedAt.Time, &settled)
+		if err != nil {
+			return nil, err
+		}
+		event.Data = json.RawMessage(data)
+		if event.Offset != previous+1 && !settled {
+			break
+		}
+		previous = event.Offset
+		result = append(result, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// ставит в пачку отправку события пользователя в канал user_events, уведомление уходит при коммите транзакции
+func queueUserEvent(batch *pgx.Batch, event schema.UserEvent) error {
+	payload, err := json.Marshal(userEventNotification{UserID: event.UserID, Event: event})
+	if err != nil {
+		return err
+	}
+	batch.Queue("SELECT pg_notify($1, $2)", userEventsChannel, string(payload))
+	return nil
+}
+
+// слушает канал user_events на отдельном соединении и передает события handler
+func (p *PosgresDB) ListenUserEvents(ctx context.Context, handler func(schema.UserEvent)) error {
+	conn, err := p.DB.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// соединение с подпиской забирается из пула насовсем, чтобы LISTEN не достался другим запросам
+	pgxConn := conn.Hijack()
+	defer pgxConn.Close(context.Background())
+	_, err = pgxConn.Exec(ctx, "LISTEN "+userEventsChannel)
+	if err != nil {
+		return err
+	}
+	p.logger.Info().Msg("Подписка на события пользователей готова;")
+	for {
+		notification, err := pgxConn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		message := userEventNotification{}
+		if err := json.Unmarshal([]byte(notification.Payload), &message); err != nil {
+			p.logger.Error().Err(err).Msg("некорректное уведомление о событии пользователя; err is here 5510232;")
+			continue
+		}
+		message.Event.UserID = message.UserID
+		handler(message.Event)
+	}
+}
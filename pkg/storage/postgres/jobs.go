@@ -0,0 +1,148 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/jackc/pgx/v5"
+)
+
+// очередь опроса аккрол сервиса
+
+// захватывает до limit готовых к опросу заказов на время lease.
+// заказы захваченные другим воркером пропускаются (SKIP LOCKED), поэтому несколько экземпляров
+// приложения делят очередь без повторных опросов
+func (p *PosgresDB) ClaimAccrualJobs(ctx context.Context, owner string, limit int, lease time.Duration) ([]schema.AccrualJob, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	WITH claimed AS (
+		SELECT order_id FROM accrual_jobs
+		WHERE next_attempt_at <= NOW() AND (lease_until IS NULL OR lease_until < NOW())
+		ORDER BY next_attempt_at
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED
+		),
+	upd AS (
+		UPDATE accrual_jobs j
+		SET lease_owner = $1, lease_until = NOW() + make_interval(secs => $2), attempts = j.attempts + 1
+		FROM claimed WHERE j.order_id = claimed.order_id
+		RETURNING j.order_id, j.attempts, j.failures, coalesce(j.last_error, '') last_error, j.created_at
+		)
+	SELECT o.number,
+		coalesce((
+			SELECT s.name FROM order_status os JOIN status s ON s.status_id = os.status_id
+			WHERE os.order_id = upd.order_id
+			ORDER BY os.datetime DESC, os.order_status_id DESC
+			LIMIT 1
+			), ''),
+		upd.attempts, upd.failures, upd.last_error, upd.created_at
+	FROM upd JOIN orders o ON o.order_id = upd.order_id
+	`
+	rows, err := p.DB.Query(ctx, query, owner, lease.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.AccrualJob, 0)
+	for rows.Next() {
+		job := schema.AccrualJob{}
+		err := rows.Scan(&job.OrderNumber, &job.Status, &job.Attempts, &job.Failures, &job.LastError, &job.CreatedAt)
+		if err != nil {
+			p.logger.Error().Err(err).Msg("err is here 8812094;")
+			continue
+		}
+		result = append(result, job)
+	}
+	if err := rows.Err(); err != nil {
+		p.logger.Error().Err(err).Msg("error is here 8812095")
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// снимает захват заказа владельцем owner и назначает время следующего опроса.
+// непустой failure засчитывается как очередной неудачный опрос, пустой сбрасывает счетчик неудач
+func (p *PosgresDB) RescheduleAccrualJob(ctx context.Context, number string, owner string, nextAttemptAt time.Time, failure string) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	UPDATE accrual_jobs j
+	SET next_attempt_at = $3, lease_owner = NULL, lease_until = NULL,
+		failures = CASE WHEN $4 = '' THEN 0 ELSE j.failures + 1 END,
+		last_error = NULLIF($4, '')
+	FROM orders o
+	WHERE o.order_id = j.order_id AND o.number = $1 AND j.lease_owner = $2
+	`
+	_, err := p.DB.Exec(ctx, query, number, owner, nextAttemptAt, failure)
+	return err
+}
+
+// количество заказов в очереди опроса
+func (p *PosgresDB) GetAccrualQueueDepth(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	var depth int
+	err := p.DB.QueryRow(ctx, "SELECT count(*) FROM accrual_jobs").Scan(&depth)
+	return depth, err
+}
+
+// заказы, последний статус которых равен заданному
+const queryOrdersByStatus = `
+	SELECT num, stat, acc, upload FROM (
+		SELECT distinct on (os.order_id)
+			o.number num,
+			s.name stat,
+			os.accrual acc,
+			o.datetime upload
+		FROM orders o JOIN order_status os ON o.order_id = os.order_id
+			JOIN status s ON s.status_id = os.status_id
+		ORDER BY os.order_id, os.datetime desc, os.order_status_id desc
+		) q
+	WHERE stat = $1
+	ORDER BY upload
+	`
+
+// возвращает заказы всех пользователей, последний статус которых status
+func (p *PosgresDB) GetOrdersByStatus(ctx context.Context, status schema.StatusOrder) ([]schema.Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	rows, err := p.DB.Query(ctx, queryOrdersByStatus, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.Order, 0)
+	for rows.Next() {
+		order := schema.Order{}
+		err := rows.Scan(&order.Number, &order.Status, &order.Accrual, &order.UploadedAt.Time)
+		if err != nil {
+			p.logger.Error().Err(err).Msg("err is here 8812096;")
+			continue
+		}
+		result = append(result, order)
+	}
+	if err := rows.Err(); err != nil {
+		p.logger.Error().Err(err).Msg("error is here 8812097")
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// ставит в пачку постановку заказа в очередь опроса либо удаление из нее, если статус конечный
+func queueAccrualJob(batch *pgx.Batch, orderID int64, status schema.StatusOrder) {
+	switch status {
+	case schema.StatusOrderNew, schema.StatusOrderProcessing:
+		batch.Queue("INSERT INTO accrual_jobs(order_id) VALUES ($1) ON CONFLICT (order_id) DO NOTHING", orderID)
+	default:
+		batch.Queue("DELETE FROM accrual_jobs WHERE order_id = $1", orderID)
+	}
+}
@@ -0,0 +1,482 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/ledger"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/jackc/pgx/v5"
+)
+
+// журнал двойной записи
+
+// записывает проводку в журнал, возвращает id проводки
+func (p *PosgresDB) PostLedgerEntry(ctx context.Context, entry schema.LedgerEntry) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	batch := &pgx.Batch{}
+	entryID, err := p.postLedgerEntry(ctx, tx, batch, entry)
+	if err != nil {
+		return 0, err
+	}
+	if err := sendBatch(ctx, tx, batch); err != nil {
+		return 0, err
+	}
+	return entryID, tx.Commit(ctx)
+}
+
+// сторнирует проводку entryID, возвращает id сторнирующей проводки.
+// повторное сторно и сторно сторнирующей проводки не допускаются
+func (p *PosgresDB) ReverseLedgerEntry(ctx context.Context, entryID int64, comment string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	entry, err := p.getLedgerEntry(ctx, tx, entryID)
+	if err != nil {
+		return 0, err
+	}
+	if entry.Kind == schema.LedgerEntryReversal {
+		return 0, fmt.Errorf("%w: reversal entry can not be reversed", errorapp.ErrInvalidEntry)
+	}
+	batch := &pgx.Batch{}
+	reversalID, err := p.postLedgerEntry(ctx, tx, batch, ledger.Reversal(entry, comment))
+	if err != nil {
+		return 0, err
+	}
+	if err := sendBatch(ctx, tx, batch); err != nil {
+		return 0, err
+	}
+	return reversalID, tx.Commit(ctx)
+}
+
+// возвращает проводки затрагивающие счет пользователя в порядке записи
+func (p *PosgresDB) GetLedgerEntries(ctx context.Context, userID uint16) ([]schema.LedgerEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	SELECT je.entry_id, je.kind, coalesce(je.order_number, ''), coalesce(je.reverses_entry_id, 0),
+		coalesce(je.comment, ''), je.datetime, coalesce(a.user_id, 0), coalesce(a.code, ''), p.amount
+	FROM journal_entries je
+		JOIN postings p ON p.entry_id = je.entry_id
+		JOIN accounts a ON a.account_id = p.account_id
+	WHERE je.entry_id IN (
+		SELECT up.entry_id FROM postings up JOIN accounts ua ON ua.account_id = up.account_id
+		WHERE ua.user_id = $1
+		)
+	ORDER BY je.datetime, je.entry_id, p.posting_id
+	`
+	rows, err := p.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.LedgerEntry, 0)
+	for rows.Next() {
+		entry := schema.LedgerEntry{}
+		posting := schema.Posting{}
+		err := rows.Scan(&entry.ID, &entry.Kind, &entry.OrderNumber, &entry.ReversesID, &entry.Comment,
+			&entry.CreatedAt.Time, &posting.Account.UserID, &posting.Account.Code, &posting.Amount)
+		if err != nil {
+			p.logger.Error().Err(err).Msg("err is here 7730164;")
+			continue
+		}
+		// строки отсортированы по проводкам, движения одной проводки идут подряд
+		if last := len(result) - 1; last >= 0 && result[last].ID == entry.ID {
+			result[last].Postings = append(result[last].Postings, posting)
+			continue
+		}
+		entry.Postings = []schema.Posting{posting}
+		result = append(result, entry)
+	}
+	if err := rows.Err(); err != nil {
+		p.logger.Error().Err(err).Msg("error is here 7730165")
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// сумма всех движений журнала, при корректной работе всегда равна 0
+func (p *PosgresDB) GetLedgerTotal(ctx context.Context) (float32, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	var total float32
+	err := p.DB.QueryRow(ctx, "SELECT coalesce(sum(amount), 0) FROM postings").Scan(&total)
+	return total, err
+}
+
+// сверяет снимки балансов пользователей с пересчетом по журналу, возвращает расхождения
+func (p *PosgresDB) CheckBalances(ctx context.Context) ([]schema.BalanceDrift, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	query := `
+	WITH ledger AS (
+		SELECT a.user_id,
+			sum(p.amount) current,
+			coalesce(sum(CASE WHEN je.kind = 'WITHDRAWAL' OR rev.kind = 'WITHDRAWAL' THEN -p.amount END), 0) withdrawn
+		FROM postings p
+			JOIN accounts a ON a.account_id = p.account_id AND a.user_id IS NOT NULL
+			JOIN journal_entries je ON je.entry_id = p.entry_id
+			LEFT JOIN journal_entries rev ON rev.entry_id = je.reverses_entry_id
+		GROUP BY a.user_id
+		)
+	SELECT coalesce(b.user_id, l.user_id),
+		coalesce(b.current, 0), coalesce(b.withdrawn, 0),
+		coalesce(l.current, 0), coalesce(l.withdrawn, 0)
+	FROM user_balances b FULL JOIN ledger l ON l.user_id = b.user_id
+	WHERE coalesce(b.current, 0) <> coalesce(l.current, 0)
+		OR coalesce(b.withdrawn, 0) <> coalesce(l.withdrawn, 0)
+	ORDER BY 1
+	`
+	rows, err := p.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.BalanceDrift, 0)
+	for rows.Next() {
+		drift := schema.BalanceDrift{}
+		err := rows.Scan(&drift.UserID, &drift.Current, &drift.Withdrawn, &drift.LedgerCurrent, &drift.LedgerWithdrawn)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, drift)
+	}
+	return result, rows.Err()
+}
+
+// пишет проводку в рамках транзакции и обновляет снимки балансов пользователей.
+// движения и снимки балансов отправляются одной пачкой сразу, а события, уведомления и партии начислений
+// ставятся в batch и уходят вместе с остальными запросами вызывающего
+func (p *PosgresDB) postLedgerEntry(ctx context.Context, tx pgx.Tx, batch *pgx.Batch, entry schema.LedgerEntry) (int64, error) {
+	if err := ledger.Validate(entry); err != nil {
+		return 0, err
+	}
+	query := `
+	INSERT INTO journal_entries(kind, order_number, reverses_entry_id, comment)
+	VALUES ($1, NULLIF($2, ''), NULLIF($3::int, 0), NULLIF($4, ''))
+	RETURNING entry_id
+	`
+	var entryID int64
+	err := tx.QueryRow(ctx, query, entry.Kind, entry.OrderNumber, entry.ReversesID, entry.Comment).Scan(&entryID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, errorapp.ErrAlreadyReversed
+		}
+		return 0, err
+	}
+
+	// сторно списания уменьшает сумму списаний пользователя
+	withdrawal := entry.Kind == schema.LedgerEntryWithdrawal
+	if entry.Kind == schema.LedgerEntryReversal {
+		var reversedKind schema.LedgerEntryKind
+		err := tx.QueryRow(ctx, "SELECT kind FROM journal_entries WHERE entry_id = $1", entry.ReversesID).Scan(&reversedKind)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return 0, errorapp.ErrEmptyResult
+			}
+			return 0, err
+		}
+		withdrawal = reversedKind == schema.LedgerEntryWithdrawal
+	}
+
+	balances, err := p.insertPostings(ctx, tx, entryID, entry.Postings, withdrawal)
+	if err != nil {
+		return 0, err
+	}
+	for i, posting := range entry.Postings {
+		if posting.Account.UserID == 0 {
+			continue
+		}
+		balance := balances[i]
+		err = queueUserEvent(batch, schema.UserEvent{Type: schema.UserEventBalance, UserID: posting.Account.UserID, Balance: &balance})
+		if err != nil {
+			return 0, err
+		}
+		eventType := schema.DomainEventPointsCredited
+		switch {
+		case withdrawal && posting.Amount < 0:
+			eventType = schema.DomainEventPointsWithdrawn
+		case posting.Amount < 0:
+			eventType = schema.DomainEventPointsDebited
+		}
+		movement := schema.PointsMovement{EntryID: entryID, Kind: entry.Kind, Amount: posting.Amount, Current: balance.Current}
+		err = queueEvent(batch, eventType, posting.Account.UserID, entry.OrderNumber, movement)
+		if err != nil {
+			return 0, err
+		}
+		queueCreditLots(batch, entry, entryID, posting)
+	}
+	return entryID, nil
+}
+
+// пишет движения проводки одной пачкой и возвращает снимки балансов пользователей после каждого движения.
+// счет пользователя создается при первом обращении
+func (p *PosgresDB) insertPostings(ctx context.Context, tx pgx.Tx, entryID int64, postings []schema.Posting, withdrawal bool) ([]schema.Balance, error) {
+	batch := &pgx.Batch{}
+	for _, posting := range postings {
+		amount := ledger.PostingDecimal(posting)
+		if posting.Account.UserID == 0 {
+			query := `
+			INSERT INTO postings(entry_id, account_id, amount)
+			SELECT $1, account_id, $3::numeric FROM accounts WHERE code = $2
+			`
+			batch.Queue(query, entryID, posting.Account.Code, amount)
+			// балансы системных счетов не материализуются, чтобы не блокировать одну строку на каждую проводку
+			continue
+		}
+		batch.Queue("INSERT INTO accounts(user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING", posting.Account.UserID)
+		query := `
+		INSERT INTO postings(entry_id, account_id, amount)
+		SELECT $1, account_id, $3::numeric FROM accounts WHERE user_id = $2
+		`
+		batch.Queue(query, entryID, posting.Account.UserID, amount)
+		withdrawn := "0"
+		if withdrawal {
+			withdrawn = ledger.Decimal(-posting.Amount)
+		}
+		// CHECK (withdrawn >= 0) проверяется и для вставляемой строки до разрешения конфликта,
+		// поэтому уменьшение суммы списаний (сторно списания) прибавляется только при обновлении:
+		// у пользователя со списанием снимок баланса уже есть
+		query = `
+		INSERT INTO user_balances(user_id, current, withdrawn, version) VALUES ($1, $2::numeric, greatest($3::numeric, 0), 1)
+		ON CONFLICT (user_id) DO UPDATE SET
+			current = user_balances.current + EXCLUDED.current,
+			withdrawn = user_balances.withdrawn + $3::numeric,
+			version = user_balances.version + 1,
+			updated_at = NOW()
+		RETURNING current, withdrawn
+		`
+		batch.Queue(query, posting.Account.UserID, amount, withdrawn)
+	}
+
+	results := tx.SendBatch(ctx, batch)
+	balances, err := scanPostings(results, postings)
+	if closeErr := results.Close(); err == nil {
+		err = closeErr
+	}
+	return balances, err
+}
+
+// читает результаты пачки insertPostings в порядке постановки запросов
+func scanPostings(results pgx.BatchResults, postings []schema.Posting) ([]schema.Balance, error) {
+	balances := make([]schema.Balance, len(postings))
+	for i, posting := range postings {
+		if posting.Account.UserID == 0 {
+			inserted, err := results.Exec()
+			if err != nil {
+				return nil, err
+			}
+			if inserted.RowsAffected() == 0 {
+				return nil, fmt.Errorf("%w: unknown system account %q", errorapp.ErrInvalidEntry, posting.Account.Code)
+			}
+			continue
+		}
+		for j := 0; j < 2; j++ {
+			if _, err := results.Exec(); err != nil {
+				return nil, err
+			}
+		}
+		err := results.QueryRow().Scan(&balances[i].Current, &balances[i].Withdrawn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return balances, nil
+}
+
+// ставит в пачку изменение партий начислений пользователя:
+// поступление на счет создает партию, списание расходует партии начиная с самых старых.
+// сторно начисления в первую очередь расходует партию самого начисления.
+// сгорание обнуляет партии само (см. ExpireUserCreditLots)
+func queueCreditLots(batch *pgx.Batch, entry schema.LedgerEntry, entryID int64, posting schema.Posting) {
+	amount := ledger.Decimal(posting.Amount)
+	if posting.Amount > 0 {
+		query := `
+		INSERT INTO credit_lots(user_id, entry_id, amount, remaining)
+		VALUES ($1, $2, $3::numeric, $3::numeric)
+		`
+		batch.Queue(query, posting.Account.UserID, entryID, amount)
+		return
+	}
+	if entry.Kind == schema.LedgerEntryExpiration {
+		return
+	}
+	// снимок баланса пользователя уже заблокирован этой транзакцией,
+	// поэтому партии пользователя параллельно не изменяются
+	query := `
+	UPDATE credit_lots c
+	SET remaining = c.remaining - least(c.remaining, $3::numeric - q.before)
+	FROM (
+		SELECT lot_id,
+			sum(remaining) OVER (ORDER BY entry_id = $2 DESC, credited_at, lot_id) - remaining before
+		FROM credit_lots
+		WHERE user_id = $1 AND remaining > 0
+		) q
+	WHERE c.lot_id = q.lot_id AND q.before < $3::numeric
+	`
+	batch.Queue(query, posting.Account.UserID, entry.ReversesID, ledger.Decimal(-posting.Amount))
+}
+
+// возвращает непотраченные партии начислений пользователя, начисленные не позже creditedBefore
+func (p *PosgresDB) GetCreditLots(ctx context.Context, userID uint16, creditedBefore time.Time) ([]schema.CreditLot, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	SELECT remaining, credited_at
+	FROM credit_lots
+	WHERE user_id = $1 AND remaining > 0 AND credited_at <= $2
+	ORDER BY credited_at, lot_id
+	`
+	rows, err := p.DB.Query(ctx, query, userID, creditedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.CreditLot, 0)
+	for rows.Next() {
+		lot := schema.CreditLot{}
+		if err := rows.Scan(&lot.Remaining, &lot.CreditedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, lot)
+	}
+	return result, rows.Err()
+}
+
+// возвращает пользователей с непотраченными партиями, начисленными не позже creditedBefore:
+// не больше limit пользователей по возрастанию id, начиная после afterUserID
+func (p *PosgresDB) GetExpiringUsers(ctx context.Context, creditedBefore time.Time, afterUserID uint16, limit int) ([]uint16, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	SELECT DISTINCT user_id FROM credit_lots
+	WHERE remaining > 0 AND credited_at <= $1 AND user_id > $2
+	ORDER BY user_id
+	LIMIT $3
+	`
+	rows, err := p.DB.Query(ctx, query, creditedBefore, afterUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make([]uint16, 0)
+	for rows.Next() {
+		var userID uint16
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+	return users, rows.Err()
+}
+
+// сжигает остатки партий пользователя, начисленных не позже creditedBefore, и пишет проводку сгорания.
+// возвращает false, если сжигать было нечего
+func (p *PosgresDB) ExpireUserCreditLots(ctx context.Context, userID uint16, creditedBefore time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// блокируем снимок баланса до партий, в том же порядке что и при записи проводок
+	_, err = tx.Exec(ctx, "SELECT 1 FROM user_balances WHERE user_id = $1 FOR UPDATE", userID)
+	if err != nil {
+		return false, err
+	}
+	// сумма читается текстом: проводка должна списать ровно то, что обнулено в партиях
+	query := `
+	WITH expired AS (
+		SELECT lot_id, remaining FROM credit_lots
+		WHERE user_id = $1 AND remaining > 0 AND credited_at <= $2
+		FOR UPDATE
+		),
+	upd AS (
+		UPDATE credit_lots c SET remaining = 0
+		FROM expired WHERE c.lot_id = expired.lot_id
+		)
+	SELECT coalesce(sum(remaining), 0)::text, coalesce(sum(remaining), 0) = 0 FROM expired
+	`
+	var amount string
+	var empty bool
+	err = tx.QueryRow(ctx, query, userID, creditedBefore).Scan(&amount, &empty)
+	if err != nil {
+		return false, err
+	}
+	if empty {
+		return false, tx.Commit(ctx)
+	}
+	entry, err := ledger.ExpirationDecimal(userID, amount)
+	if err != nil {
+		return false, err
+	}
+	batch := &pgx.Batch{}
+	_, err = p.postLedgerEntry(ctx, tx, batch, entry)
+	if err != nil {
+		return false, err
+	}
+	if err := sendBatch(ctx, tx, batch); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// читает проводку с движениями, блокируя ее до конца транзакции
+func (p *PosgresDB) getLedgerEntry(ctx context.Context, tx pgx.Tx, entryID int64) (schema.LedgerEntry, error) {
+	entry := schema.LedgerEntry{}
+	query := `
+	SELECT entry_id, kind, coalesce(order_number, ''), coalesce(reverses_entry_id, 0), coalesce(comment, ''), datetime
+	FROM journal_entries WHERE entry_id = $1
+	FOR UPDATE
+	`
+	err := tx.QueryRow(ctx, query, entryID).Scan(&entry.ID, &entry.Kind, &entry.OrderNumber,
+		&entry.ReversesID, &entry.Comment, &entry.CreatedAt.Time)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return entry, errorapp.ErrEmptyResult
+		}
+		return entry, err
+	}
+
+	query = `
+	SELECT coalesce(a.user_id, 0), coalesce(a.code, ''), p.amount
+	FROM postings p JOIN accounts a ON a.account_id = p.account_id
+	WHERE p.entry_id = $1
+	ORDER BY p.posting_id
+	`
+	rows, err := tx.Query(ctx, query, entryID)
+	if err != nil {
+		return entry, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		posting := schema.Posting{}
+		if err := rows.Scan(&posting.Account.UserID, &posting.Account.Code, &posting.Amount); err != nil {
+			return entry, err
+		}
+		entry.Postings = append(entry.Postings, posting)
+	}
+	return entry, rows.Err()
+}
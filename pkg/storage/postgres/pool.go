@@ -0,0 +1,64 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/tracing"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+// пул соединений pgx и подготовленные запросы
+
+// частые запросы, которые подготавливаются на каждом соединении пула при его открытии.
+// имя подготовленного запроса совпадает с его текстом, поэтому вызывающий передает текст запроса:
+// pgx выполняет подготовленный запрос, а если подготовка не удалась - обычный
+var preparedStatements = []string{queryOrders, queryBalance, queryWithdrawals, queryOrdersByStatus}
+
+// настраивает пул по конфигурации; соединения открываются при первом запросе
+func newPool(ctx context.Context, cfg config.CfgDataBase, logger zerolog.Logger) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(cfg.DataBaseURI)
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.MaxConns = cfg.MaxConns
+	poolConfig.MinConns = cfg.MinConns
+	poolConfig.MaxConnLifetime = cfg.MaxConnLifetime
+	poolConfig.MaxConnIdleTime = cfg.MaxConnIdleTime
+	poolConfig.ConnConfig.StatementCacheCapacity = cfg.StatementCacheCapacity
+	if cfg.StatementCacheCapacity == 0 {
+		// без кеша каждый запрос описывается заново, но не остается подготовленным на соединении
+		poolConfig.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeDescribeExec
+	}
+	// каждый запрос к БД - отдельный спан трассировки
+	poolConfig.ConnConfig.Tracer = tracing.QueryTracer{}
+	poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		// схема может отставать от кода, пока не выполнена gophermart migrate up,
+		// поэтому ошибка подготовки не закрывает соединение
+		for _, query := range preparedStatements {
+			if _, err := conn.Prepare(ctx, query, query); err != nil {
+				logger.Warn().Err(err).Msg("не удалось подготовить запрос; err is here 58545347;")
+			}
+		}
+		return nil
+	}
+	return pgxpool.NewWithConfig(ctx, poolConfig)
+}
+
+// отправляет накопленные запросы одним обменом с БД, возвращает первую ошибку
+func sendBatch(ctx context.Context, tx pgx.Tx, batch *pgx.Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	return tx.SendBatch(ctx, batch).Close()
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation
+}
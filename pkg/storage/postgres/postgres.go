@@ -2,20 +2,17 @@ package postgres
 
 import (
 	"context"
-	"database/sql"
 	"errors"
-	"strings"
+	"fmt"
 	"time"
 
 	"github.com/bubu256/gophermart_pet/config"
 	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/ledger"
 	"github.com/bubu256/gophermart_pet/internal/schema"
 	"github.com/bubu256/gophermart_pet/pkg/storage"
-	"github.com/golang-migrate/migrate/v4"
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
-	"github.com/jackc/pgerrcode"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog"
 )
 
@@ -23,40 +20,55 @@ import (
 
 type PosgresDB struct {
 	storage.Storage
-	URI    string
-	DB     *sql.DB
-	logger zerolog.Logger
+	URI string
+	// основная БД
+	DB *pgxpool.Pool
+	// реплики для чтения списков
+	replicas *replicaSet
+	logger   zerolog.Logger
+	// последняя версия среди файлов миграций, с ней сравнивается версия схемы БД
+	expectedVersion uint
 }
 
 func New(cfg config.CfgDataBase, logger zerolog.Logger) storage.Storage {
-	db, err := sql.Open("pgx", cfg.DataBaseURI)
-	if err != nil {
-		logger.Error().Err(err)
-	}
-
 	pdb := &PosgresDB{
-		DB:     db,
 		URI:    cfg.DataBaseURI,
 		logger: logger,
 	}
+	// миграции выполняются до открытия пула, чтобы соединения подготавливали запросы на актуальной схеме
+	if cfg.AutoMigrate {
+		pdb.migrateUp()
+	} else {
+		pdb.checkMigrations()
+	}
 
-	err = pdb.Ping()
+	db, err := newPool(context.Background(), cfg, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid DATABASE_URI; error is here 58545345")
+	}
+	pdb.DB = db
+	err = pdb.Ping(context.Background())
 	if err != nil {
 		logger.Fatal().Err(err).Msg("DB not available; error is here 58545346")
 	}
 	logger.Info().Msg("Подключение с БД готово;")
-
-	pdb.migrateUp()
+	pdb.replicas = newReplicaSet(cfg, logger)
 	return pdb
 }
 
-func (p *PosgresDB) SetUser(user, passwordHash string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+// закрывает пулы соединений реплик и основной БД
+func (p *PosgresDB) Close() {
+	p.replicas.Close()
+	p.DB.Close()
+}
+
+func (p *PosgresDB) SetUser(ctx context.Context, user, passwordHash string) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
 	defer cancel()
 	query := "INSERT INTO users(login, password_hash) VALUES ($1, $2)"
-	_, err := p.DB.ExecContext(ctx, query, user, passwordHash)
+	_, err := p.DB.Exec(ctx, query, user, passwordHash)
 	if err != nil {
-		if strings.Contains(err.Error(), pgerrcode.UniqueViolation) {
+		if isUniqueViolation(err) {
 			return errorapp.ErrDuplicate
 		}
 		return err
@@ -64,14 +76,14 @@ func (p *PosgresDB) SetUser(user, passwordHash string) error {
 	return nil
 }
 
-func (p *PosgresDB) GetUserID(login string, hashPassword string) (userID uint16, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+func (p *PosgresDB) GetUserID(ctx context.Context, login string, hashPassword string) (userID uint16, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
 	defer cancel()
 	query := "select user_id from users where login = $1 and password_hash = $2"
 	var id uint16
-	err = p.DB.QueryRowContext(ctx, query, login, hashPassword).Scan(&id)
+	err = p.DB.QueryRow(ctx, query, login, hashPassword).Scan(&id)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return 0, errorapp.ErrWrongLoginPassword
 		}
 		return 0, err
@@ -80,66 +92,231 @@ func (p *PosgresDB) GetUserID(login string, hashPassword string) (userID uint16,
 }
 
 // добавляет новый заказ для пользователя
-func (p *PosgresDB) SetOrder(userID uint16, number string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+func (p *PosgresDB) SetOrder(ctx context.Context, userID uint16, number string) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
 	defer cancel()
-	query := "INSERT INTO orders(user_id, number) VALUES ($1, $2)"
-	_, err := p.DB.ExecContext(ctx, query, userID, number)
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	batch := &pgx.Batch{}
+	batch.Queue("INSERT INTO orders(user_id, number) VALUES ($1, $2)", userID, number)
+	err = queueEvent(batch, schema.DomainEventOrderUploaded, userID, number, nil)
+	if err != nil {
+		return err
+	}
+	err = sendBatch(ctx, tx, batch)
 	if err != nil {
-		if strings.Contains(err.Error(), pgerrcode.UniqueViolation) {
+		if isUniqueViolation(err) {
 			return errorapp.ErrDuplicate
 		}
 		return err
 	}
-	return nil
+	return tx.Commit(ctx)
 }
 
-// устанавливает статус расчета заказа
-// статус PROCESSED начиляет бонусы
-func (p *PosgresDB) SetOrderStatus(number string, status schema.StatusOrder, accrual float32) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+// устанавливает статус расчета заказа, повтор текущего статуса ничего не меняет и возвращает errorapp.ErrDuplicate.
+// несуществующий заказ - errorapp.ErrEmptyResult, недопустимый переход - errorapp.ErrInvalidTransition.
+// статус PROCESSED начиляет бонусы проводкой в журнале в той же транзакции
+func (p *PosgresDB) SetOrderStatus(ctx context.Context, number string, status schema.StatusOrder, accrual float32) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
 	defer cancel()
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// статус меняется только по допустимому переходу, поэтому конечный статус и начисление
+	// записываются один раз, даже если ответ пришел и опросом, и через callback.
+	// отмененный заказ больше не меняет статус и не получает начислений
+	orderID, userID, current, err := p.lockOrder(ctx, tx, number)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current == schema.StatusOrderCancelled:
+		return errorapp.ErrAlreadyCancelled
+	case current == status:
+		// повтор уже записанного статуса
+		return errorapp.ErrDuplicate
+	case !current.CanBecome(status):
+		return fmt.Errorf("%w: %s -> %s", errorapp.ErrInvalidTransition, current, status)
+	}
+
+	// статус, очередь опроса, события и начисление отправляются одной пачкой;
+	// отдельными обменами с БД выполняются только запросы, результат которых нужен дальше
+	batch := &pgx.Batch{}
 	query := `
 		INSERT INTO order_status(order_id, status_id, accrual)
-		select o.order_id, s.status_id, $3
-		from orders o, status s where s.name = $1 and o.number = $2
+		SELECT $1, status_id, $3 FROM status WHERE name = $2
 		`
-	_, err := p.DB.ExecContext(ctx, query, status, number, accrual)
+	batch.Queue(query, orderID, status, accrual)
+	queueAccrualJob(batch, orderID, status)
+	change := schema.OrderStatusChange{From: current, To: status}
+	if status == schema.StatusOrderProcessed {
+		change.Accrual = accrual
+	}
+	err = queueEvent(batch, schema.DomainEventOrderStatusChanged, userID, number, change)
 	if err != nil {
-		if strings.Contains(err.Error(), pgerrcode.UniqueViolation) {
-			return errorapp.ErrDuplicate
-		}
 		return err
 	}
 	// если статус PROCESSED
 	// зачисляем бонусы на счет
 	if status == schema.StatusOrderProcessed {
-		query2 := `
-			INSERT INTO bonus_flow(user_id, order_number, amount)
-			SELECT user_id, $1, $2
-			FROM orders WHERE number = $1
-			`
-		insertResult, err := p.DB.ExecContext(ctx, query2, number, accrual)
+		err = p.insertBonusFlow(ctx, tx, batch, userID, number, accrual)
 		if err != nil {
 			return err
 		}
-		insertCount, err := insertResult.RowsAffected()
+		err = queueOutboxEvent(batch, schema.WebhookEventOrderAccrued,
+			schema.WebhookOrderData{UserID: userID, Order: number, Accrual: accrual})
 		if err != nil {
 			return err
 		}
-		if insertCount == 0 {
-			return errorapp.ErrEmptyInsert
-		}
 	}
-	return nil
+	err = queueUserEvent(batch, schema.UserEvent{
+		Type: schema.UserEventOrder, UserID: userID, Order: number, Status: status, Accrual: accrual,
+	})
+	if err != nil {
+		return err
+	}
+	// повтор текущего статуса уже отсечен выше, а прежние статусы заказ может пройти снова
+	// (STALE -> PROCESSING), поэтому ошибки пачки возвращаются как есть
+	if err := sendBatch(ctx, tx, batch); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
-// возвращает все заказы в структуре []schema.Order.
-// номер, статус, начисление, датавремя добавления
-func (p *PosgresDB) GetOrders(userID uint16) ([]schema.Order, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+// отменяет заказ: добавляет статус CANCELLED и, если баллы за заказ уже начислены,
+// возвращает их с баланса пользователя по политике policy
+func (p *PosgresDB) CancelOrder(ctx context.Context, number string, comment string, policy schema.CancelPolicy) (schema.OrderCancellation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
 	defer cancel()
+	result := schema.OrderCancellation{Order: number, Status: schema.StatusOrderCancelled}
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback(ctx)
+
+	orderID, userID, current, err := p.lockOrder(ctx, tx, number)
+	if err != nil {
+		return result, err
+	}
+	if current == schema.StatusOrderCancelled {
+		return result, errorapp.ErrAlreadyCancelled
+	}
+	// статус, очередь опроса, события и возврат баллов отправляются одной пачкой перед коммитом
+	batch := &pgx.Batch{}
 	query := `
+		INSERT INTO order_status(order_id, status_id, accrual)
+		SELECT $1, status_id, 0 FROM status WHERE name = $2
+		`
+	batch.Queue(query, orderID, schema.StatusOrderCancelled)
+	queueAccrualJob(batch, orderID, schema.StatusOrderCancelled)
+	err = queueEvent(batch, schema.DomainEventOrderStatusChanged, userID, number,
+		schema.OrderStatusChange{From: current, To: schema.StatusOrderCancelled})
+	if err != nil {
+		return result, err
+	}
+	err = queueUserEvent(batch, schema.UserEvent{
+		Type: schema.UserEventOrder, UserID: userID, Order: number, Status: schema.StatusOrderCancelled,
+	})
+	if err != nil {
+		return result, err
+	}
+	commit := func() (schema.OrderCancellation, error) {
+		if err := sendBatch(ctx, tx, batch); err != nil {
+			return result, err
+		}
+		return result, tx.Commit(ctx)
+	}
+	if current != schema.StatusOrderProcessed {
+		return commit()
+	}
+
+	// ищем несторнированное начисление по заказу
+	query = `
+	SELECT je.entry_id FROM journal_entries je
+	WHERE je.kind = 'ACCRUAL' AND je.order_number = $1
+		AND NOT EXISTS (SELECT 1 FROM journal_entries r WHERE r.reverses_entry_id = je.entry_id)
+	`
+	var entryID int64
+	err = tx.QueryRow(ctx, query, number).Scan(&entryID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// заказ без начисления
+		return commit()
+	}
+	if err != nil {
+		return result, err
+	}
+	entry, err := p.getLedgerEntry(ctx, tx, entryID)
+	if err != nil {
+		return result, err
+	}
+	var accrual float32
+	for _, posting := range entry.Postings {
+		if posting.Account.UserID == userID {
+			accrual = posting.Amount
+		}
+	}
+
+	reversal := ledger.Reversal(entry, comment)
+	result.Reversed = accrual
+	if policy == schema.CancelPolicyClawback {
+		var balance float32
+		query = "SELECT current FROM user_balances WHERE user_id = $1 FOR UPDATE"
+		err = tx.QueryRow(ctx, query, userID).Scan(&balance)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return result, err
+		}
+		if balance < accrual {
+			// возвращаем только то, что осталось на балансе, частичный возврат оформляется корректировкой
+			result.Reversed = balance
+			if balance <= 0 {
+				result.Reversed = 0
+				return commit()
+			}
+			reversal = ledger.Adjustment(userID, -balance, comment)
+			reversal.OrderNumber = number
+		}
+	}
+	_, err = p.postLedgerEntry(ctx, tx, batch, reversal)
+	if err != nil {
+		return result, err
+	}
+	return commit()
+}
+
+// блокирует заказ до конца транзакции и возвращает его id, владельца и последний статус.
+// пустой статус - у заказа еще нет статусов
+func (p *PosgresDB) lockOrder(ctx context.Context, tx pgx.Tx, number string) (orderID int64, userID uint16, status schema.StatusOrder, err error) {
+	query := "SELECT order_id, user_id FROM orders WHERE number = $1 FOR UPDATE"
+	err = tx.QueryRow(ctx, query, number).Scan(&orderID, &userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, 0, "", errorapp.ErrEmptyResult
+		}
+		return 0, 0, "", err
+	}
+	query = `
+	SELECT s.name FROM order_status os JOIN status s ON s.status_id = os.status_id
+	WHERE os.order_id = $1
+	ORDER BY os.datetime DESC, os.order_status_id DESC
+	LIMIT 1
+	`
+	err = tx.QueryRow(ctx, query, orderID).Scan(&status)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return 0, 0, "", err
+	}
+	return orderID, userID, status, nil
+}
+
+// последний статус каждого заказа пользователя
+const queryOrders = `
 	SELECT distinct on (os.order_id) 
 		o.number num, 
 		s.name stat, 
@@ -147,17 +324,30 @@ func (p *PosgresDB) GetOrders(userID uint16) ([]schema.Order, error) {
 		o.datetime upload
 	FROM orders o JOIN order_status os ON o.order_id = os.order_id and o.user_id = $1
 		JOIN status s ON s.status_id = os.status_id
-	ORDER BY os.order_id, os.datetime desc
+	ORDER BY os.order_id, os.datetime desc, os.order_status_id desc
 	`
-	rows, err := p.DB.QueryContext(ctx, query, userID)
+
+// возвращает все заказы в структуре []schema.Order.
+// номер, статус, начисление, датавремя добавления
+func (p *PosgresDB) GetOrders(ctx context.Context, userID uint16) ([]schema.Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	return readReplica(ctx, p, func(db *pgxpool.Pool) ([]schema.Order, error) {
+		return p.getOrders(ctx, db, userID)
+	})
+}
+
+func (p *PosgresDB) getOrders(ctx context.Context, db *pgxpool.Pool, userID uint16) ([]schema.Order, error) {
+	rows, err := db.Query(ctx, queryOrders, userID)
 	// p.logger.Debug().Err(err).Msg("")
 	if err != nil {
 		// это почему то не работает(
-		// if errors.Is(err, sql.ErrNoRows) {
+		// if errors.Is(err, pgx.ErrNoRows) {
 		// 	return nil, errorapp.ErrEmptyResult
 		// }
 		return nil, err
 	}
+	defer rows.Close()
 
 	result := make([]schema.Order, 0)
 	for rows.Next() {
@@ -172,6 +362,7 @@ func (p *PosgresDB) GetOrders(userID uint16) ([]schema.Order, error) {
 	}
 	if err := rows.Err(); err != nil {
 		p.logger.Error().Err(err).Msg("error is here 346842419846")
+		return nil, err
 	}
 	if len(result) == 0 {
 		return result, errorapp.ErrEmptyResult
@@ -179,65 +370,130 @@ func (p *PosgresDB) GetOrders(userID uint16) ([]schema.Order, error) {
 	return result, nil
 }
 
-// возвращает баланс и общую сумму потраченных баллов
-func (p *PosgresDB) GetBalance(userID uint16) (schema.Balance, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+const queryBalance = "SELECT current, withdrawn, version FROM user_balances WHERE user_id = $1"
+
+// возвращает баланс и общую сумму потраченных баллов из снимка баланса.
+// читается на основной БД, чтобы баланс сразу после начисления или списания не отставал
+func (p *PosgresDB) GetBalance(ctx context.Context, userID uint16) (schema.Balance, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
 	defer cancel()
-	query := `
-	SELECT coalesce(sum(bf.amount), 0), 
-		coalesce(sum(
-			CASE
-				WHEN bf.amount < 0 THEN -bf.amount
-			END
-			), 0)
-	FROM bonus_flow bf
-	WHERE bf.user_id = $1
-	`
 	balance := schema.Balance{}
-	err := p.DB.QueryRowContext(ctx, query, userID).Scan(&balance.Current, &balance.Withdrawn)
+	err := p.DB.QueryRow(ctx, queryBalance, userID).Scan(&balance.Current, &balance.Withdrawn, &balance.Version)
 	if err != nil {
+		// движений по счету еще не было
+		if errors.Is(err, pgx.ErrNoRows) {
+			return balance, nil
+		}
 		p.logger.Error().Err(err).Msg("ошибка при получении из базу баланса; err is here 6843545;")
 		return balance, err
 	}
 	return balance, nil
 }
 
-// движение бонусов
-func (p *PosgresDB) SetBonusFlow(userID uint16, orderNumber string, amount float32) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+// списывает баллы в счет заказа, если их достаточно на балансе.
+// снимок баланса блокируется до конца транзакции на основной БД, поэтому параллельные списания не уводят баланс в минус
+func (p *PosgresDB) Withdraw(ctx context.Context, userID uint16, orderNumber string, sum float32) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
 	defer cancel()
-	query := `
-		INSERT INTO bonus_flow(user_id, order_number, amount)
-		VALUES ($1, $2, $3)
-		`
-	insertResult, err := p.DB.ExecContext(ctx, query, userID, orderNumber, amount)
+	tx, err := p.DB.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	insertCount, err := insertResult.RowsAffected()
+	defer tx.Rollback(ctx)
+
+	var current float32
+	err = tx.QueryRow(ctx, "SELECT current FROM user_balances WHERE user_id = $1 FOR UPDATE", userID).Scan(&current)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	if current < sum {
+		return errorapp.ErrNotEnoughFunds
+	}
+	batch := &pgx.Batch{}
+	err = p.insertBonusFlow(ctx, tx, batch, userID, orderNumber, -sum)
 	if err != nil {
 		return err
 	}
-	if insertCount == 0 {
-		return errorapp.ErrEmptyInsert
+	err = queueOutboxEvent(batch, schema.WebhookEventPointsWithdrawn,
+		schema.WebhookOrderData{UserID: userID, Order: orderNumber, Sum: sum})
+	if err != nil {
+		return err
 	}
-	return nil
+	if err := sendBatch(ctx, tx, batch); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
-// возвращает список выводов пользователя
-func (p *PosgresDB) GetBonusFlow(userID uint16) ([]schema.OrderSum, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+// движение бонусов
+// отрицательная сумма записывается в журнал как списание, положительная как начисление
+func (p *PosgresDB) SetBonusFlow(ctx context.Context, userID uint16, orderNumber string, amount float32) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
 	defer cancel()
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	batch := &pgx.Batch{}
+	err = p.insertBonusFlow(ctx, tx, batch, userID, orderNumber, amount)
+	if err != nil {
+		return err
+	}
+	if err := sendBatch(ctx, tx, batch); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// пишет проводку в журнал и ставит в пачку запись в bonus_flow со ссылкой на нее
+func (p *PosgresDB) insertBonusFlow(ctx context.Context, tx pgx.Tx, batch *pgx.Batch, userID uint16, orderNumber string, amount float32) error {
+	var entryID *int64
+	if amount != 0 {
+		entry := ledger.Accrual(userID, orderNumber, amount)
+		if amount < 0 {
+			entry = ledger.Withdrawal(userID, orderNumber, -amount)
+		}
+		id, err := p.postLedgerEntry(ctx, tx, batch, entry)
+		if err != nil {
+			return err
+		}
+		entryID = &id
+	}
+	// начисление ссылается на заказ пользователя, у списания заказа в orders нет
 	query := `
+		INSERT INTO bonus_flow(user_id, order_number, amount, entry_id, order_id)
+		VALUES ($1, $2, $3, $4, (SELECT order_id FROM orders WHERE number = $2 AND user_id = $1))
+		`
+	batch.Queue(query, userID, orderNumber, amount, entryID)
+	return nil
+}
+
+// списания пользователя без сторнированных
+const queryWithdrawals = `
 	select order_number, amount * (-1), datetime
 	from bonus_flow bf 
 	where user_id = $1 and amount < 0
+		and not exists (select 1 from journal_entries r where r.reverses_entry_id = bf.entry_id)
 	order by datetime 
 	`
-	rows, err := p.DB.QueryContext(ctx, query, userID)
+
+// возвращает список выводов пользователя, без сторнированных
+func (p *PosgresDB) GetBonusFlow(ctx context.Context, userID uint16) ([]schema.OrderSum, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	return readReplica(ctx, p, func(db *pgxpool.Pool) ([]schema.OrderSum, error) {
+		return p.getBonusFlow(ctx, db, userID)
+	})
+}
+
+func (p *PosgresDB) getBonusFlow(ctx context.Context, db *pgxpool.Pool, userID uint16) ([]schema.OrderSum, error) {
+	rows, err := db.Query(ctx, queryWithdrawals, userID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	result := make([]schema.OrderSum, 0)
 	for rows.Next() {
@@ -251,6 +507,7 @@ func (p *PosgresDB) GetBonusFlow(userID uint16) ([]schema.OrderSum, error) {
 	}
 	if err := rows.Err(); err != nil {
 		p.logger.Error().Err(err).Msg("error is here 3468423419846")
+		return nil, err
 	}
 	if len(result) == 0 {
 		return result, errorapp.ErrEmptyResult
@@ -260,16 +517,16 @@ func (p *PosgresDB) GetBonusFlow(userID uint16) ([]schema.OrderSum, error) {
 }
 
 // возвращает айди юзера добавившего заказ
-func (p *PosgresDB) GetUserIDfromOrders(numberOrder string) (uint16, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+func (p *PosgresDB) GetUserIDfromOrders(ctx context.Context, numberOrder string) (uint16, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
 	defer cancel()
 	query := `
 	SELECT user_id FROM orders WHERE number = $1 LIMIT 1
 	`
 	var userID uint16
-	err := p.DB.QueryRowContext(ctx, query, numberOrder).Scan(&userID)
+	err := p.DB.QueryRow(ctx, query, numberOrder).Scan(&userID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return 0, errorapp.ErrEmptyResult
 		}
 		return 0, err
@@ -278,78 +535,22 @@ func (p *PosgresDB) GetUserIDfromOrders(numberOrder string) (uint16, error) {
 }
 
 // проверка доступности БД
-func (p *PosgresDB) Ping() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+// берет соединение из пула и проверяет его
+func (p *PosgresDB) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
 	defer cancel()
-	db, err := sql.Open("pgx", p.URI)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-	return db.PingContext(ctx)
+	return p.DB.Ping(ctx)
 }
 
-// up миграции БД
-func (p *PosgresDB) migrateUp() error {
-	m, err := migrate.New(
-		"file://migrations",
-		p.URI,
-	)
-	if err != nil {
-		p.logger.Fatal().Err(err).Msg("удалось подключиться к БД для выполнения миграции; err is here 9879516;")
-		return err
-	}
-	defer m.Close()
-	err = m.Up()
-	if errors.Is(err, migrate.ErrNoChange) {
-		p.logger.Info().Msg("Миграция БД не требуется;")
-		return nil
-	}
-	if err != nil {
-		p.logger.Error().Err(err).Msg("ошибка при выполнении миграции; err is here 0321518")
-	}
-	p.logger.Info().Msgf("Миграция применена к БД; %v", m)
-	return nil
-}
-
-// возвращает номера и статусы заказов ожидающих расчета начисления (только заказы в статусе NEW и PROCESSING)
-func (p *PosgresDB) GetWaitingOrders() ([]schema.Order, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+// версия схемы БД и последняя версия среди файлов миграций
+func (p *PosgresDB) GetMigrationStatus(ctx context.Context) (schema.MigrationStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
 	defer cancel()
-	query := `
-	SELECT num, stat FROM (
-		SELECT distinct on (os.order_id) 
-			o.number num, 
-			s.name stat, 
-			os.accrual acc, 
-			o.datetime upload
-		FROM orders o JOIN order_status os ON o.order_id = os.order_id
-			JOIN status s ON s.status_id = os.status_id
-		ORDER BY os.order_id, os.datetime desc
-		) q
-	WHERE stat IN ('PROCESSING', 'NEW')
-	`
-	rows, err := p.DB.QueryContext(ctx, query)
-	if err != nil {
-		return nil, err
+	status := schema.MigrationStatus{Expected: p.expectedVersion}
+	query := "SELECT version, dirty FROM schema_migrations LIMIT 1"
+	err := p.DB.QueryRow(ctx, query).Scan(&status.Version, &status.Dirty)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return status, err
 	}
-
-	result := make([]schema.Order, 0)
-	for rows.Next() {
-		order := schema.Order{}
-		err := rows.Scan(&order.Number, &order.Status)
-		if err != nil {
-			p.logger.Error().Err(err).Msg("err is here 6516541321;")
-			continue
-		}
-		result = append(result, order)
-	}
-	if err := rows.Err(); err != nil {
-		p.logger.Error().Err(err).Msg("error is here 346546842419846")
-	}
-	if len(result) == 0 {
-		return result, errorapp.ErrEmptyResult
-	}
-
-	return result, nil
+	return status, nil
 }
@@ -0,0 +1,157 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+// реплики для чтения списков. запись, баланс, списания с проверкой баланса и все остальные запросы
+// выполняются на основной БД. реплика, не прошедшая проверку или вернувшая ошибку,
+// не используется до следующей успешной проверки, чтение в это время идет на основную БД
+
+type replica struct {
+	// адрес без пароля для логов
+	name    string
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+}
+
+type replicaSet struct {
+	replicas []*replica
+	maxLag   time.Duration
+	next     atomic.Uint32
+	logger   zerolog.Logger
+	// закрывается в Close и останавливает проверку реплик
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// открывает пулы реплик и запускает их проверку; недоступная при запуске реплика подключится позже
+func newReplicaSet(cfg config.CfgDataBase, logger zerolog.Logger) *replicaSet {
+	set := &replicaSet{maxLag: cfg.ReplicaMaxLag, logger: logger, done: make(chan struct{})}
+	for _, uri := range cfg.ReplicaURIs {
+		replicaCfg := cfg
+		replicaCfg.DataBaseURI = uri
+		pool, err := newPool(context.Background(), replicaCfg, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("некорректная строка подключения к реплике; err is here 58545348;")
+			continue
+		}
+		set.replicas = append(set.replicas, &replica{name: replicaName(uri), pool: pool})
+	}
+	if len(set.replicas) == 0 {
+		return set
+	}
+	set.check()
+	go func() {
+		ticker := time.NewTicker(cfg.ReplicaCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-set.done:
+				return
+			case <-ticker.C:
+				set.check()
+			}
+		}
+	}()
+	return set
+}
+
+// останавливает проверку реплик и закрывает их пулы
+func (s *replicaSet) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		for _, r := range s.replicas {
+			r.healthy.Store(false)
+			r.pool.Close()
+		}
+	})
+}
+
+// проверяет доступность и отставание каждой реплики
+func (s *replicaSet) check() {
+	for _, r := range s.replicas {
+		err := s.probe(r)
+		if err == nil {
+			if !r.healthy.Swap(true) {
+				s.logger.Info().Msgf("реплика %s используется для чтения;", r.name)
+			}
+			continue
+		}
+		s.markUnhealthy(r, err)
+	}
+}
+
+func (s *replicaSet) probe(r *replica) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// на простаивающей основной БД время последней транзакции устаревает,
+	// поэтому реплика, применившая все полученные изменения, считается не отставшей
+	query := `
+	SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE coalesce(extract(epoch FROM now() - pg_last_xact_replay_timestamp()), 0) END
+	`
+	var lag float64
+	if err := r.pool.QueryRow(ctx, query).Scan(&lag); err != nil {
+		return err
+	}
+	if s.maxLag > 0 && lag > s.maxLag.Seconds() {
+		return fmt.Errorf("replica lag %.1fs exceeds %s", lag, s.maxLag)
+	}
+	return nil
+}
+
+func (s *replicaSet) markUnhealthy(r *replica, err error) {
+	if r.healthy.Swap(false) {
+		s.logger.Warn().Err(err).Msgf("реплика %s исключена из чтения, запросы идут на основную БД; err is here 58545349;", r.name)
+	}
+}
+
+// следующая по кругу исправная реплика, nil - исправных нет
+func (s *replicaSet) pick() *replica {
+	if s == nil || len(s.replicas) == 0 {
+		return nil
+	}
+	start := s.next.Add(1)
+	for i := 0; i < len(s.replicas); i++ {
+		r := s.replicas[(int(start)+i)%len(s.replicas)]
+		if r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// выполняет чтение на реплике; если реплики нет или она вернула ошибку, чтение выполняется на основной БД
+func readReplica[T any](ctx context.Context, p *PosgresDB, read func(db *pgxpool.Pool) (T, error)) (T, error) {
+	r := p.replicas.pick()
+	if r == nil {
+		return read(p.DB)
+	}
+	result, err := read(r.pool)
+	if err == nil || errors.Is(err, errorapp.ErrEmptyResult) || ctx.Err() != nil {
+		return result, err
+	}
+	p.replicas.markUnhealthy(r, err)
+	return read(p.DB)
+}
+
+// адрес реплики без пароля
+func replicaName(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Host == "" {
+		return "replica"
+	}
+	return parsed.Host + parsed.Path
+}
@@ -0,0 +1,236 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/jackc/pgx/v5"
+)
+
+// исходящие вебхуки: события пишутся в outbox в транзакции изменения,
+// доставки получателям создаются там же и разбираются диспетчером
+
+// ставит в пачку запись события в outbox и создание доставок всем получателям, подписанным на его тип
+func queueOutboxEvent(batch *pgx.Batch, eventType schema.WebhookEventType, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	query := `
+	WITH ev AS (
+		INSERT INTO outbox(event_type, payload) VALUES ($1, $2::jsonb)
+		RETURNING event_id
+		)
+	INSERT INTO webhook_deliveries(event_id, endpoint_id)
+	SELECT ev.event_id, e.endpoint_id FROM ev, webhook_endpoints e
+	WHERE cardinality(e.event_types) = 0 OR $1 = ANY(e.event_types)
+	`
+	batch.Queue(query, eventType, string(payload))
+	return nil
+}
+
+// регистрирует получателя вебхуков
+func (p *PosgresDB) CreateWebhookEndpoint(ctx context.Context, endpoint schema.WebhookEndpoint) (schema.WebhookEndpoint, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	eventTypes := make([]string, 0, len(endpoint.EventTypes))
+	for _, eventType := range endpoint.EventTypes {
+		eventTypes = append(eventTypes, string(eventType))
+	}
+	// типы событий передаются строкой через запятую, чтобы не зависеть от поддержки массивов драйвером
+	query := `
+	INSERT INTO webhook_endpoints(url, secret, event_types)
+	VALUES ($1, $2, coalesce(string_to_array(NULLIF($3, ''), ','), '{}'))
+	RETURNING endpoint_id, created_at
+	`
+	err := p.DB.QueryRow(ctx, query, endpoint.URL, endpoint.Secret, strings.Join(eventTypes, ",")).
+		Scan(&endpoint.ID, &endpoint.CreatedAt.Time)
+	return endpoint, err
+}
+
+// возвращает получателей вебхуков без секретов
+func (p *PosgresDB) GetWebhookEndpoints(ctx context.Context) ([]schema.WebhookEndpoint, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	SELECT endpoint_id, url, array_to_string(event_types, ','), created_at
+	FROM webhook_endpoints ORDER BY endpoint_id
+	`
+	rows, err := p.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.WebhookEndpoint, 0)
+	for rows.Next() {
+		endpoint := schema.WebhookEndpoint{}
+		var eventTypes string
+		err := rows.Scan(&endpoint.ID, &endpoint.URL, &eventTypes, &endpoint.CreatedAt.Time)
+		if err != nil {
+			return nil, err
+		}
+		endpoint.EventTypes = make([]schema.WebhookEventType, 0)
+		for _, eventType := range strings.FieldsFunc(eventTypes, func(r rune) bool { return r == ',' }) {
+			endpoint.EventTypes = append(endpoint.EventTypes, schema.WebhookEventType(eventType))
+		}
+		result = append(result, endpoint)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// удаляет получателя вместе с его доставками
+func (p *PosgresDB) DeleteWebhookEndpoint(ctx context.Context, endpointID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	result, err := p.DB.Exec(ctx, "DELETE FROM webhook_endpoints WHERE endpoint_id = $1", endpointID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return errorapp.ErrEmptyResult
+	}
+	return nil
+}
+
+// захватывает до limit доставок готовых к отправке на время lease.
+// захват сдвигает время следующей попытки, поэтому зависшая доставка вернется в работу после lease
+func (p *PosgresDB) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]schema.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	WITH claimed AS (
+		SELECT delivery_id FROM webhook_deliveries
+		WHERE status = 'PENDING' AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+		),
+	upd AS (
+		UPDATE webhook_deliveries d
+		SET attempts = d.attempts + 1, next_attempt_at = NOW() + make_interval(secs => $2)
+		FROM claimed WHERE d.delivery_id = claimed.delivery_id
+		RETURNING d.*
+		)
+	SELECT upd.delivery_id, upd.event_id, o.event_type, upd.endpoint_id, e.url, e.secret,
+		upd.status, upd.attempts, coalesce(upd.last_error, ''), upd.next_attempt_at, o.created_at, o.payload::text
+	FROM upd JOIN outbox o ON o.event_id = upd.event_id
+		JOIN webhook_endpoints e ON e.endpoint_id = upd.endpoint_id
+	ORDER BY upd.event_id
+	`
+	rows, err := p.DB.Query(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// отмечает доставку выполненной
+func (p *PosgresDB) CompleteWebhookDelivery(ctx context.Context, deliveryID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	UPDATE webhook_deliveries SET status = 'DELIVERED', delivered_at = NOW(), last_error = NULL
+	WHERE delivery_id = $1
+	`
+	_, err := p.DB.Exec(ctx, query, deliveryID)
+	return err
+}
+
+// записывает неудачную попытку доставки: следующая попытка в nextAttemptAt,
+// либо, если final, доставка получает статус FAILED
+func (p *PosgresDB) FailWebhookDelivery(ctx context.Context, deliveryID int64, nextAttemptAt time.Time, failure string, final bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	UPDATE webhook_deliveries
+	SET status = CASE WHEN $4 THEN 'FAILED' ELSE 'PENDING' END, next_attempt_at = $2, last_error = $3
+	WHERE delivery_id = $1
+	`
+	_, err := p.DB.Exec(ctx, query, deliveryID, nextAttemptAt, failure, final)
+	return err
+}
+
+// возвращает доставки со статусом status, последние сначала
+func (p *PosgresDB) GetWebhookDeliveries(ctx context.Context, status schema.WebhookDeliveryStatus, limit int) ([]schema.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	query := `
+	SELECT d.delivery_id, d.event_id, o.event_type, d.endpoint_id, e.url, '',
+		d.status, d.attempts, coalesce(d.last_error, ''), d.next_attempt_at, o.created_at, o.payload::text
+	FROM webhook_deliveries d JOIN outbox o ON o.event_id = d.event_id
+		JOIN webhook_endpoints e ON e.endpoint_id = d.endpoint_id
+	WHERE d.status = $1
+	ORDER BY d.delivery_id DESC
+	LIMIT $2
+	`
+	rows, err := p.DB.Query(ctx, query, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	result, err := scanWebhookDeliveries(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// возвращает неудачные доставки в очередь с обнуленным счетчиком попыток.
+// deliveryID > 0 - одну доставку, иначе все неудачные доставки получателя endpointID
+func (p *PosgresDB) ReplayWebhookDeliveries(ctx context.Context, deliveryID int64, endpointID int64) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	// ErrEmptyResult только для неизвестной доставки или получателя, без неудачных доставок - ноль
+	query := `
+	WITH replayed AS (
+		UPDATE webhook_deliveries
+		SET status = 'PENDING', attempts = 0, next_attempt_at = NOW(), last_error = NULL
+		WHERE status = 'FAILED' AND (delivery_id = $1 OR ($1 = 0 AND endpoint_id = $2))
+		RETURNING 1
+	)
+	SELECT
+		(SELECT count(*) FROM replayed),
+		CASE WHEN $1 = 0
+			THEN EXISTS (SELECT 1 FROM webhook_endpoints WHERE endpoint_id = $2)
+			ELSE EXISTS (SELECT 1 FROM webhook_deliveries WHERE delivery_id = $1)
+		END
+	`
+	var replayed int
+	var found bool
+	err := p.DB.QueryRow(ctx, query, deliveryID, endpointID).Scan(&replayed, &found)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, errorapp.ErrEmptyResult
+	}
+	return replayed, nil
+}
+
+func scanWebhookDeliveries(rows pgx.Rows) ([]schema.WebhookDelivery, error) {
+	defer rows.Close()
+	result := make([]schema.WebhookDelivery, 0)
+	for rows.Next() {
+		d := schema.WebhookDelivery{}
+		err := rows.Scan(&d.ID, &d.EventID, &d.EventType, &d.EndpointID, &d.URL, &d.Secret,
+			&d.Status, &d.Attempts, &d.LastError, &d.NextAttemptAt.Time, &d.CreatedAt.Time, &d.Payload)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,133 @@
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+)
+
+// журнал доменных событий и события пользователей.
+// в SQLite нет LISTEN/NOTIFY, а хранилище используется одним процессом, поэтому события пользователей
+// раздаются подписчикам этого процесса сразу после коммита транзакции изменения
+
+// сколько событий пользователей ждут обработки подписчиком, лишние события подписчик пропускает
+const userEventsBuffer = 1024
+
+// добавляет доменное событие в журнал событий; data кодируется в json, nil - пустой объект
+func insertEvent(ctx context.Context, tx *txn, eventType schema.DomainEventType, userID uint16, orderNumber string, data any) error {
+	payload := []byte("{}")
+	if data != nil {
+		var err error
+		payload, err = json.Marshal(data)
+		if err != nil {
+			return err
+		}
+	}
+	query := `
+	INSERT INTO events(event_type, user_id, order_number, payload, created_at)
+	VALUES (?, NULLIF(?, 0), NULLIF(?, ''), ?, ?)
+	`
+	_, err := tx.ExecContext(ctx, query, eventType, userID, orderNumber, string(payload), now())
+	return err
+}
+
+// возвращает до limit событий со смещением больше offset в порядке смещений.
+// транзакции записи выполняются по одной, поэтому событие с меньшим смещением
+// всегда зафиксировано раньше и читатель, продолжающий с последнего полученного смещения, не теряет события
+func (s *SQLiteDB) GetEvents(ctx context.Context, offset int64, limit int) ([]schema.DomainEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	query := `
+	SELECT event_id, event_type, coalesce(user_id, 0), coalesce(order_number, ''), payload, created_at
+	FROM events
+	WHERE event_id > ?
+	ORDER BY event_id
+	LIMIT ?
+	`
+	rows, err := s.DB.QueryContext(ctx, query, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.DomainEvent, 0)
+	for rows.Next() {
+		event := schema.DomainEvent{}
+		var data string
+		var createdAt int64
+		err := rows.Scan(&event.Offset, &event.Type, &event.UserID, &event.OrderNumber, &data, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		event.Data = json.RawMessage(data)
+		event.CreatedAt.Time = time.UnixMicro(createdAt)
+		result = append(result, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// подписчики событий пользователей
+type listeners struct {
+	mu    sync.Mutex
+	chans map[chan schema.UserEvent]struct{}
+}
+
+func newListeners() *listeners {
+	return &listeners{chans: make(map[chan schema.UserEvent]struct{})}
+}
+
+func (l *listeners) add(events chan schema.UserEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.chans[events] = struct{}{}
+}
+
+func (l *listeners) remove(events chan schema.UserEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.chans, events)
+}
+
+// раздает события зафиксированной транзакции всем подписчикам
+func (s *SQLiteDB) publish(events []schema.UserEvent) {
+	if len(events) == 0 {
+		return
+	}
+	s.listeners.mu.Lock()
+	defer s.listeners.mu.Unlock()
+	for listener := range s.listeners.chans {
+		for _, event := range events {
+			select {
+			case listener <- event:
+			default:
+				s.logger.Warn().Msg("подписчик не успевает обрабатывать события пользователей, событие пропущено; err is here 61203408;")
+			}
+		}
+	}
+}
+
+// передает handler события пользователей, пока не отменен ctx
+func (s *SQLiteDB) ListenUserEvents(ctx context.Context, handler func(schema.UserEvent)) error {
+	events := make(chan schema.UserEvent, userEventsBuffer)
+	s.listeners.add(events)
+	defer s.listeners.remove(events)
+	s.logger.Info().Msg("Подписка на события пользователей готова;")
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event := <-events:
+			handler(event)
+		}
+	}
+}
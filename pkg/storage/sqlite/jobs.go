@@ -0,0 +1,133 @@
+package sqlite
+
+import (
+	"context"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+)
+
+// очередь опроса аккрол сервиса
+
+// захватывает до limit готовых к опросу заказов на время lease.
+// захват выполняется транзакцией записи, поэтому два воркера не получают один заказ
+func (s *SQLiteDB) ClaimAccrualJobs(ctx context.Context, owner string, limit int, lease time.Duration) ([]schema.AccrualJob, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	UPDATE accrual_jobs
+	SET lease_owner = ?1, lease_until = ?2 + ?3, attempts = attempts + 1
+	WHERE order_id IN (
+		SELECT order_id FROM accrual_jobs
+		WHERE next_attempt_at <= ?2 AND (lease_until IS NULL OR lease_until < ?2)
+		ORDER BY next_attempt_at
+		LIMIT ?4
+		)
+	RETURNING
+		(SELECT number FROM orders o WHERE o.order_id = accrual_jobs.order_id),
+		coalesce((
+			SELECT s.name FROM order_status os JOIN status s ON s.status_id = os.status_id
+			WHERE os.order_id = accrual_jobs.order_id
+			ORDER BY os.datetime DESC, os.order_status_id DESC
+			LIMIT 1
+			), ''),
+		attempts, failures, coalesce(last_error, ''), created_at
+	`
+	result := make([]schema.AccrualJob, 0)
+	err := s.write(ctx, func(tx *txn) error {
+		rows, err := tx.QueryContext(ctx, query, owner, now(), lease.Microseconds(), limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			job := schema.AccrualJob{}
+			var createdAt int64
+			err := rows.Scan(&job.OrderNumber, &job.Status, &job.Attempts, &job.Failures, &job.LastError, &createdAt)
+			if err != nil {
+				// задания уже захвачены в этой транзакции: откатываем захват целиком
+				s.logger.Error().Err(err).Msg("err is here 61203407;")
+				return err
+			}
+			job.CreatedAt = time.UnixMicro(createdAt)
+			result = append(result, job)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// снимает захват заказа владельцем owner и назначает время следующего опроса.
+// непустой failure засчитывается как очередной неудачный опрос, пустой сбрасывает счетчик неудач
+func (s *SQLiteDB) RescheduleAccrualJob(ctx context.Context, number string, owner string, nextAttemptAt time.Time, failure string) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	UPDATE accrual_jobs
+	SET next_attempt_at = ?3, lease_owner = NULL, lease_until = NULL,
+		failures = CASE WHEN ?4 = '' THEN 0 ELSE failures + 1 END,
+		last_error = NULLIF(?4, '')
+	WHERE order_id = (SELECT order_id FROM orders WHERE number = ?1) AND lease_owner = ?2
+	`
+	return s.write(ctx, func(tx *txn) error {
+		_, err := tx.ExecContext(ctx, query, number, owner, unixMicro(nextAttemptAt), failure)
+		return err
+	})
+}
+
+// количество заказов в очереди опроса
+func (s *SQLiteDB) GetAccrualQueueDepth(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	var depth int
+	err := s.DB.QueryRowContext(ctx, "SELECT count(*) FROM accrual_jobs").Scan(&depth)
+	return depth, err
+}
+
+// заказы, последний статус которых равен заданному
+const queryOrdersByStatus = `
+	SELECT o.number, s.name, coalesce(os.accrual, 0), o.datetime
+	FROM orders o JOIN order_status os ON os.order_status_id = (
+			SELECT order_status_id FROM order_status
+			WHERE order_id = o.order_id
+			ORDER BY datetime DESC, order_status_id DESC
+			LIMIT 1
+			)
+		JOIN status s ON s.status_id = os.status_id
+	WHERE s.name = ?
+	ORDER BY o.datetime, o.order_id
+	`
+
+// возвращает заказы всех пользователей, последний статус которых status
+func (s *SQLiteDB) GetOrdersByStatus(ctx context.Context, status schema.StatusOrder) ([]schema.Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	rows, err := s.DB.QueryContext(ctx, queryOrdersByStatus, status)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanOrders(rows)
+}
+
+// ставит заказ в очередь опроса либо удаляет из нее, если статус конечный
+func updateAccrualJob(ctx context.Context, tx *txn, orderID int64, status schema.StatusOrder) error {
+	switch status {
+	case schema.StatusOrderNew, schema.StatusOrderProcessing:
+		query := `
+		INSERT INTO accrual_jobs(order_id, next_attempt_at, created_at) VALUES (?1, ?2, ?2)
+		ON CONFLICT (order_id) DO NOTHING
+		`
+		_, err := tx.ExecContext(ctx, query, orderID, now())
+		return err
+	default:
+		_, err := tx.ExecContext(ctx, "DELETE FROM accrual_jobs WHERE order_id = ?", orderID)
+		return err
+	}
+}
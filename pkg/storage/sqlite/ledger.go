@@ -0,0 +1,435 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/ledger"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+)
+
+// журнал двойной записи
+
+// записывает проводку в журнал, возвращает id проводки
+func (s *SQLiteDB) PostLedgerEntry(ctx context.Context, entry schema.LedgerEntry) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	var entryID int64
+	err := s.write(ctx, func(tx *txn) (err error) {
+		entryID, err = postLedgerEntry(ctx, tx, entry)
+		return err
+	})
+	return entryID, err
+}
+
+// сторнирует проводку entryID, возвращает id сторнирующей проводки.
+// повторное сторно и сторно сторнирующей проводки не допускаются
+func (s *SQLiteDB) ReverseLedgerEntry(ctx context.Context, entryID int64, comment string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	var reversalID int64
+	err := s.write(ctx, func(tx *txn) error {
+		entry, err := getLedgerEntry(ctx, tx, entryID)
+		if err != nil {
+			return err
+		}
+		if entry.Kind == schema.LedgerEntryReversal {
+			return fmt.Errorf("%w: reversal entry can not be reversed", errorapp.ErrInvalidEntry)
+		}
+		reversalID, err = postLedgerEntry(ctx, tx, ledger.Reversal(entry, comment))
+		return err
+	})
+	return reversalID, err
+}
+
+// возвращает проводки затрагивающие счет пользователя в порядке записи
+func (s *SQLiteDB) GetLedgerEntries(ctx context.Context, userID uint16) ([]schema.LedgerEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	SELECT je.entry_id, je.kind, coalesce(je.order_number, ''), coalesce(je.reverses_entry_id, 0),
+		coalesce(je.comment, ''), je.datetime, coalesce(a.user_id, 0), coalesce(a.code, ''), p.amount
+	FROM journal_entries je
+		JOIN postings p ON p.entry_id = je.entry_id
+		JOIN accounts a ON a.account_id = p.account_id
+	WHERE je.entry_id IN (
+		SELECT up.entry_id FROM postings up JOIN accounts ua ON ua.account_id = up.account_id
+		WHERE ua.user_id = ?
+		)
+	ORDER BY je.datetime, je.entry_id, p.posting_id
+	`
+	rows, err := s.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.LedgerEntry, 0)
+	for rows.Next() {
+		entry := schema.LedgerEntry{}
+		posting := schema.Posting{}
+		var createdAt, amount int64
+		err := rows.Scan(&entry.ID, &entry.Kind, &entry.OrderNumber, &entry.ReversesID, &entry.Comment,
+			&createdAt, &posting.Account.UserID, &posting.Account.Code, &amount)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("err is here 61203406;")
+			continue
+		}
+		entry.CreatedAt.Time = time.UnixMicro(createdAt)
+		posting.Amount = fromUnits(amount)
+		// строки отсортированы по проводкам, движения одной проводки идут подряд
+		if last := len(result) - 1; last >= 0 && result[last].ID == entry.ID {
+			result[last].Postings = append(result[last].Postings, posting)
+			continue
+		}
+		entry.Postings = []schema.Posting{posting}
+		result = append(result, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// сумма всех движений журнала, при корректной работе всегда равна 0
+func (s *SQLiteDB) GetLedgerTotal(ctx context.Context) (float32, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	var total int64
+	err := s.DB.QueryRowContext(ctx, "SELECT coalesce(sum(amount), 0) FROM postings").Scan(&total)
+	return fromUnits(total), err
+}
+
+// сверяет снимки балансов пользователей с пересчетом по журналу, возвращает расхождения
+func (s *SQLiteDB) CheckBalances(ctx context.Context) ([]schema.BalanceDrift, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	query := `
+	WITH ledger AS (
+		SELECT a.user_id,
+			sum(p.amount) current,
+			coalesce(sum(CASE WHEN je.kind = 'WITHDRAWAL' OR rev.kind = 'WITHDRAWAL' THEN -p.amount END), 0) withdrawn
+		FROM postings p
+			JOIN accounts a ON a.account_id = p.account_id AND a.user_id IS NOT NULL
+			JOIN journal_entries je ON je.entry_id = p.entry_id
+			LEFT JOIN journal_entries rev ON rev.entry_id = je.reverses_entry_id
+		GROUP BY a.user_id
+		)
+	SELECT coalesce(b.user_id, l.user_id),
+		coalesce(b.current, 0), coalesce(b.withdrawn, 0),
+		coalesce(l.current, 0), coalesce(l.withdrawn, 0)
+	FROM user_balances b FULL JOIN ledger l ON l.user_id = b.user_id
+	WHERE coalesce(b.current, 0) <> coalesce(l.current, 0)
+		OR coalesce(b.withdrawn, 0) <> coalesce(l.withdrawn, 0)
+	ORDER BY 1
+	`
+	rows, err := s.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.BalanceDrift, 0)
+	for rows.Next() {
+		drift := schema.BalanceDrift{}
+		var current, withdrawn, ledgerCurrent, ledgerWithdrawn int64
+		err := rows.Scan(&drift.UserID, &current, &withdrawn, &ledgerCurrent, &ledgerWithdrawn)
+		if err != nil {
+			return nil, err
+		}
+		drift.Current, drift.Withdrawn = fromUnits(current), fromUnits(withdrawn)
+		drift.LedgerCurrent, drift.LedgerWithdrawn = fromUnits(ledgerCurrent), fromUnits(ledgerWithdrawn)
+		result = append(result, drift)
+	}
+	return result, rows.Err()
+}
+
+// пишет проводку в рамках транзакции, обновляет снимки балансов и партии начислений пользователей,
+// добавляет доменные события и события пользователей
+func postLedgerEntry(ctx context.Context, tx *txn, entry schema.LedgerEntry) (int64, error) {
+	if err := ledger.Validate(entry); err != nil {
+		return 0, err
+	}
+	query := `
+	INSERT INTO journal_entries(kind, order_number, reverses_entry_id, comment, datetime)
+	VALUES (?, NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, ''), ?)
+	RETURNING entry_id
+	`
+	var entryID int64
+	err := tx.QueryRowContext(ctx, query, entry.Kind, entry.OrderNumber, entry.ReversesID, entry.Comment, now()).Scan(&entryID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, errorapp.ErrAlreadyReversed
+		}
+		return 0, err
+	}
+
+	// сторно списания уменьшает сумму списаний пользователя
+	withdrawal := entry.Kind == schema.LedgerEntryWithdrawal
+	if entry.Kind == schema.LedgerEntryReversal {
+		var reversedKind schema.LedgerEntryKind
+		err := tx.QueryRowContext(ctx, "SELECT kind FROM journal_entries WHERE entry_id = ?", entry.ReversesID).Scan(&reversedKind)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return 0, errorapp.ErrEmptyResult
+			}
+			return 0, err
+		}
+		withdrawal = reversedKind == schema.LedgerEntryWithdrawal
+	}
+
+	for _, posting := range entry.Postings {
+		balance, err := insertPosting(ctx, tx, entryID, posting, withdrawal)
+		if err != nil {
+			return 0, err
+		}
+		if posting.Account.UserID == 0 {
+			continue
+		}
+		tx.userEvents = append(tx.userEvents,
+			schema.UserEvent{Type: schema.UserEventBalance, UserID: posting.Account.UserID, Balance: &balance})
+		eventType := schema.DomainEventPointsCredited
+		switch {
+		case withdrawal && posting.Amount < 0:
+			eventType = schema.DomainEventPointsWithdrawn
+		case posting.Amount < 0:
+			eventType = schema.DomainEventPointsDebited
+		}
+		movement := schema.PointsMovement{EntryID: entryID, Kind: entry.Kind, Amount: posting.Amount, Current: balance.Current}
+		err = insertEvent(ctx, tx, eventType, posting.Account.UserID, entry.OrderNumber, movement)
+		if err != nil {
+			return 0, err
+		}
+		err = updateCreditLots(ctx, tx, entry, entryID, posting)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return entryID, nil
+}
+
+// пишет движение проводки и для счета пользователя возвращает снимок баланса после движения.
+// счет пользователя создается при первом обращении
+func insertPosting(ctx context.Context, tx *txn, entryID int64, posting schema.Posting, withdrawal bool) (schema.Balance, error) {
+	balance := schema.Balance{}
+	amount := postingUnits(posting)
+	if posting.Account.UserID == 0 {
+		query := `
+		INSERT INTO postings(entry_id, account_id, amount)
+		SELECT ?, account_id, ? FROM accounts WHERE code = ?
+		`
+		inserted, err := tx.ExecContext(ctx, query, entryID, amount, posting.Account.Code)
+		if err != nil {
+			return balance, err
+		}
+		if affected, err := inserted.RowsAffected(); err != nil || affected == 0 {
+			return balance, fmt.Errorf("%w: unknown system account %q", errorapp.ErrInvalidEntry, posting.Account.Code)
+		}
+		// балансы системных счетов не материализуются
+		return balance, nil
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO accounts(user_id) VALUES (?) ON CONFLICT (user_id) DO NOTHING", posting.Account.UserID)
+	if err != nil {
+		return balance, err
+	}
+	query := `
+	INSERT INTO postings(entry_id, account_id, amount)
+	SELECT ?, account_id, ? FROM accounts WHERE user_id = ?
+	`
+	_, err = tx.ExecContext(ctx, query, entryID, amount, posting.Account.UserID)
+	if err != nil {
+		return balance, err
+	}
+	var withdrawn int64
+	if withdrawal {
+		withdrawn = -amount
+	}
+	// SQLite проверяет CHECK (withdrawn >= 0) у вставляемой строки раньше ON CONFLICT,
+	// поэтому отрицательная сумма списаний при сторно списания применяется только в ветке обновления
+	query = `
+	INSERT INTO user_balances(user_id, current, withdrawn, version, updated_at) VALUES (?1, ?2, max(?3, 0), 1, ?4)
+	ON CONFLICT (user_id) DO UPDATE SET
+		current = user_balances.current + excluded.current,
+		withdrawn = user_balances.withdrawn + ?3,
+		version = user_balances.version + 1,
+		updated_at = excluded.updated_at
+	RETURNING current, withdrawn
+	`
+	var current int64
+	err = tx.QueryRowContext(ctx, query, posting.Account.UserID, amount, withdrawn, now()).Scan(&current, &withdrawn)
+	if err != nil {
+		return balance, err
+	}
+	balance.Current, balance.Withdrawn = fromUnits(current), fromUnits(withdrawn)
+	return balance, nil
+}
+
+// изменяет партии начислений пользователя:
+// поступление на счет создает партию, списание расходует партии начиная с самых старых.
+// сторно начисления в первую очередь расходует партию самого начисления.
+// сгорание обнуляет партии само (см. ExpireUserCreditLots)
+func updateCreditLots(ctx context.Context, tx *txn, entry schema.LedgerEntry, entryID int64, posting schema.Posting) error {
+	if posting.Amount > 0 {
+		query := `
+		INSERT INTO credit_lots(user_id, entry_id, amount, remaining, credited_at)
+		VALUES (?1, ?2, ?3, ?3, ?4)
+		`
+		_, err := tx.ExecContext(ctx, query, posting.Account.UserID, entryID, postingUnits(posting), now())
+		return err
+	}
+	if entry.Kind == schema.LedgerEntryExpiration {
+		return nil
+	}
+	query := `
+	UPDATE credit_lots
+	SET remaining = remaining - min(remaining, ?3 - q.spent)
+	FROM (
+		SELECT lot_id,
+			sum(remaining) OVER (ORDER BY entry_id = ?2 DESC, credited_at, lot_id) - remaining spent
+		FROM credit_lots
+		WHERE user_id = ?1 AND remaining > 0
+		) q
+	WHERE credit_lots.lot_id = q.lot_id AND q.spent < ?3
+	`
+	_, err := tx.ExecContext(ctx, query, posting.Account.UserID, entry.ReversesID, -postingUnits(posting))
+	return err
+}
+
+// возвращает непотраченные партии начислений пользователя, начисленные не позже creditedBefore
+func (s *SQLiteDB) GetCreditLots(ctx context.Context, userID uint16, creditedBefore time.Time) ([]schema.CreditLot, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	SELECT remaining, credited_at
+	FROM credit_lots
+	WHERE user_id = ? AND remaining > 0 AND credited_at <= ?
+	ORDER BY credited_at, lot_id
+	`
+	rows, err := s.DB.QueryContext(ctx, query, userID, unixMicro(creditedBefore))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.CreditLot, 0)
+	for rows.Next() {
+		var remaining, creditedAt int64
+		if err := rows.Scan(&remaining, &creditedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, schema.CreditLot{Remaining: fromUnits(remaining), CreditedAt: time.UnixMicro(creditedAt)})
+	}
+	return result, rows.Err()
+}
+
+// возвращает пользователей с непотраченными партиями, начисленными не позже creditedBefore:
+// не больше limit пользователей по возрастанию id, начиная после afterUserID
+func (s *SQLiteDB) GetExpiringUsers(ctx context.Context, creditedBefore time.Time, afterUserID uint16, limit int) ([]uint16, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	SELECT DISTINCT user_id FROM credit_lots
+	WHERE remaining > 0 AND credited_at <= ? AND user_id > ?
+	ORDER BY user_id
+	LIMIT ?
+	`
+	rows, err := s.DB.QueryContext(ctx, query, unixMicro(creditedBefore), afterUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make([]uint16, 0)
+	for rows.Next() {
+		var userID uint16
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+	return users, rows.Err()
+}
+
+// сжигает остатки партий пользователя, начисленных не позже creditedBefore, и пишет проводку сгорания.
+// возвращает false, если сжигать было нечего
+func (s *SQLiteDB) ExpireUserCreditLots(ctx context.Context, userID uint16, creditedBefore time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	var expired bool
+	err := s.write(ctx, func(tx *txn) error {
+		// RETURNING вернул бы уже обнуленные остатки, поэтому сумма считается до обновления
+		query := `
+		SELECT coalesce(sum(remaining), 0) FROM credit_lots
+		WHERE user_id = ?1 AND remaining > 0 AND credited_at <= ?2
+		`
+		var amount int64
+		err := tx.QueryRowContext(ctx, query, userID, unixMicro(creditedBefore)).Scan(&amount)
+		if err != nil || amount == 0 {
+			return err
+		}
+		query = `
+		UPDATE credit_lots SET remaining = 0
+		WHERE user_id = ?1 AND remaining > 0 AND credited_at <= ?2
+		`
+		_, err = tx.ExecContext(ctx, query, userID, unixMicro(creditedBefore))
+		if err != nil {
+			return err
+		}
+		// проводка на ту же сумму в миллионных долях, что обнулена в партиях
+		entry, err := ledger.ExpirationDecimal(userID, decimalUnits(amount))
+		if err != nil {
+			return err
+		}
+		_, err = postLedgerEntry(ctx, tx, entry)
+		expired = err == nil
+		return err
+	})
+	return expired, err
+}
+
+// читает проводку с движениями; проводка не изменится до конца транзакции записи
+func getLedgerEntry(ctx context.Context, tx *txn, entryID int64) (schema.LedgerEntry, error) {
+	entry := schema.LedgerEntry{}
+	query := `
+	SELECT entry_id, kind, coalesce(order_number, ''), coalesce(reverses_entry_id, 0), coalesce(comment, ''), datetime
+	FROM journal_entries WHERE entry_id = ?
+	`
+	var createdAt int64
+	err := tx.QueryRowContext(ctx, query, entryID).Scan(&entry.ID, &entry.Kind, &entry.OrderNumber,
+		&entry.ReversesID, &entry.Comment, &createdAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return entry, errorapp.ErrEmptyResult
+		}
+		return entry, err
+	}
+	entry.CreatedAt.Time = time.UnixMicro(createdAt)
+
+	query = `
+	SELECT coalesce(a.user_id, 0), coalesce(a.code, ''), p.amount
+	FROM postings p JOIN accounts a ON a.account_id = p.account_id
+	WHERE p.entry_id = ?
+	ORDER BY p.posting_id
+	`
+	rows, err := tx.QueryContext(ctx, query, entryID)
+	if err != nil {
+		return entry, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		posting := schema.Posting{}
+		var amount int64
+		if err := rows.Scan(&posting.Account.UserID, &posting.Account.Code, &amount); err != nil {
+			return entry, err
+		}
+		posting.Amount = fromUnits(amount)
+		entry.Postings = append(entry.Postings, posting)
+	}
+	return entry, rows.Err()
+}
@@ -0,0 +1,148 @@
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// миграции схемы SQLite: автоматический up при запуске и подкоманда gophermart migrate
+
+// каталог миграций SQLite во встроенных файлах
+const migrationsDir = "sqlite"
+
+// миграции встроенные в бинарник
+type Migrator struct {
+	m        *migrate.Migrate
+	expected uint
+}
+
+// uri - sqlite://путь/к/файлу.db, как в DATABASE_URI
+func NewMigrator(uri string) (*Migrator, error) {
+	expected, err := latestMigration()
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать миграции: %w", err)
+	}
+	src, err := iofs.New(migrations.SQLiteFS, migrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	m, err := migrate.NewWithSourceInstance("iofs", src, uri)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось открыть БД для миграции: %w", err)
+	}
+	return &Migrator{m: m, expected: expected}, nil
+}
+
+// применяет все новые миграции, migrate.ErrNoChange если применять нечего
+func (mg *Migrator) Up() error {
+	return mg.m.Up()
+}
+
+// откатывает steps последних миграций
+func (mg *Migrator) Down(steps int) error {
+	if steps <= 0 {
+		return fmt.Errorf("число откатываемых миграций должно быть больше 0, получено %d", steps)
+	}
+	return mg.m.Steps(-steps)
+}
+
+// версия схемы БД и последняя версия встроенных миграций
+func (mg *Migrator) Status() (schema.MigrationStatus, error) {
+	status := schema.MigrationStatus{Expected: mg.expected}
+	version, dirty, err := mg.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return status, nil
+	}
+	status.Version, status.Dirty = version, dirty
+	return status, err
+}
+
+// записывает версию схемы без выполнения миграций и снимает признак dirty
+func (mg *Migrator) Force(version int) error {
+	return mg.m.Force(version)
+}
+
+func (mg *Migrator) Close() error {
+	sourceErr, dbErr := mg.m.Close()
+	if sourceErr != nil {
+		return sourceErr
+	}
+	return dbErr
+}
+
+// последняя версия среди встроенных миграций
+func latestMigration() (uint, error) {
+	src, err := iofs.New(migrations.SQLiteFS, migrationsDir)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	return lastVersion(src)
+}
+
+func lastVersion(src source.Driver) (uint, error) {
+	version, err := src.First()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		next, err := src.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+}
+
+// up миграции БД при запуске
+func (s *SQLiteDB) migrateUp() {
+	migrator, err := NewMigrator(s.URI)
+	if err != nil {
+		s.logger.Fatal().Err(err).Msg("не удалось открыть БД для выполнения миграции; err is here 61203409;")
+		return
+	}
+	defer migrator.Close()
+	s.expectedVersion = migrator.expected
+	err = migrator.Up()
+	if errors.Is(err, migrate.ErrNoChange) {
+		s.logger.Info().Msg("Миграция БД не требуется;")
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("ошибка при выполнении миграции; err is here 61203410")
+		return
+	}
+	s.logger.Info().Msgf("Миграция применена к БД, версия схемы %d;", migrator.expected)
+}
+
+// при выключенной автоматической миграции только сообщает, что схема отстает;
+// /readyz в этом случае отвечает 503 до выполнения gophermart migrate up
+func (s *SQLiteDB) checkMigrations() {
+	migrator, err := NewMigrator(s.URI)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("не удалось проверить версию схемы БД; err is here 61203411;")
+		return
+	}
+	defer migrator.Close()
+	s.expectedVersion = migrator.expected
+	status, err := migrator.Status()
+	if err != nil {
+		s.logger.Error().Err(err).Msg("не удалось проверить версию схемы БД; err is here 61203412;")
+		return
+	}
+	if status.Dirty || status.Version < status.Expected {
+		s.logger.Warn().Msgf("схема БД версии %d (dirty %v) отстает от миграций версии %d, выполните gophermart migrate up;",
+			status.Version, status.Dirty, status.Expected)
+	}
+}
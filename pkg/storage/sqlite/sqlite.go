@@ -0,0 +1,577 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/ledger"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+	"github.com/rs/zerolog"
+	sqlitedriver "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// хранилище на SQLite для установок на одном сервере.
+// SQLite допускает одного писателя, поэтому транзакции записи выполняются по очереди (см. write),
+// а чтение в режиме WAL идет параллельно с ними. события пользователей раздаются внутри процесса
+
+// настройки каждого соединения: внешние ключи, WAL, ожидание блокировки другим процессом
+// (например gophermart migrate) и захват блокировки записи в начале транзакции
+const connParams = "_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_txlock=immediate"
+
+// суммы журнала, балансов и партий начислений хранятся целым числом миллионных долей балла:
+// целые суммируются без ошибок округления, поэтому сверка балансов с журналом точная
+const amountScale = 1e6
+
+type SQLiteDB struct {
+	storage.Storage
+	URI string
+	DB  *sql.DB
+	// очередь транзакций записи, в канале не больше одного писателя
+	writer    chan struct{}
+	listeners *listeners
+	logger    zerolog.Logger
+	// последняя версия среди файлов миграций, с ней сравнивается версия схемы БД
+	expectedVersion uint
+}
+
+func New(cfg config.CfgDataBase, logger zerolog.Logger) storage.Storage {
+	s := &SQLiteDB{
+		URI:       cfg.DataBaseURI,
+		writer:    make(chan struct{}, 1),
+		listeners: newListeners(),
+		logger:    logger,
+	}
+	if cfg.AutoMigrate {
+		s.migrateUp()
+	} else {
+		s.checkMigrations()
+	}
+
+	db, err := sql.Open("sqlite", dsn(cfg.DataBaseURI))
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid DATABASE_URI; error is here 61203401")
+	}
+	db.SetMaxOpenConns(int(cfg.MaxConns))
+	db.SetConnMaxLifetime(cfg.MaxConnLifetime)
+	db.SetConnMaxIdleTime(cfg.MaxConnIdleTime)
+	s.DB = db
+	err = s.Ping(context.Background())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("DB not available; error is here 61203402")
+	}
+	logger.Info().Msg("Подключение с БД SQLite готово;")
+	return s
+}
+
+// закрывает соединения с БД; файл WAL сбрасывается в основной файл при закрытии последнего соединения
+func (s *SQLiteDB) Close() {
+	if err := s.DB.Close(); err != nil {
+		s.logger.Error().Err(err).Msg("err is here 61203440;")
+	}
+}
+
+// строка подключения драйвера: путь к файлу из sqlite://путь и настройки соединения
+func dsn(uri string) string {
+	path := strings.TrimPrefix(uri, config.DriverSQLite+"://")
+	if strings.Contains(path, "?") {
+		return path + "&" + connParams
+	}
+	return path + "?" + connParams
+}
+
+// транзакция записи и события пользователей, которые раздаются подписчикам после ее коммита
+type txn struct {
+	*sql.Tx
+	userEvents []schema.UserEvent
+}
+
+// выполняет fn в транзакции записи и фиксирует ее, если fn не вернула ошибку.
+// транзакции записи ждут своей очереди в процессе, а не повторяют попытки по SQLITE_BUSY
+func (s *SQLiteDB) write(ctx context.Context, fn func(tx *txn) error) error {
+	select {
+	case s.writer <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.writer }()
+
+	sqlTx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+	tx := &txn{Tx: sqlTx}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return err
+	}
+	s.publish(tx.userEvents)
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlitedriver.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY)
+}
+
+// время в микросекундах от начала эпохи, в таком виде время хранится в БД
+func unixMicro(t time.Time) int64 {
+	return t.UnixMicro()
+}
+
+func now() int64 {
+	return unixMicro(time.Now())
+}
+
+// сумма в миллионных долях балла; переводится через десятичную запись, как и в NUMERIC колонки Postgres
+func toUnits(amount float32) int64 {
+	value, _ := strconv.ParseFloat(ledger.Decimal(amount), 64)
+	return int64(math.Round(value * amountScale))
+}
+
+func fromUnits(units int64) float32 {
+	return float32(float64(units) / amountScale)
+}
+
+// сумма движения в миллионных долях балла; точная сумма движения переводится без округления до float32
+func postingUnits(posting schema.Posting) int64 {
+	if posting.Exact == "" {
+		return toUnits(posting.Amount)
+	}
+	value, _ := new(big.Rat).SetString(posting.Exact)
+	units, _ := strconv.ParseInt(value.Mul(value, big.NewRat(amountScale, 1)).FloatString(0), 10, 64)
+	return units
+}
+
+// точная десятичная запись суммы в миллионных долях балла
+func decimalUnits(units int64) string {
+	return big.NewRat(units, amountScale).FloatString(6)
+}
+
+func (s *SQLiteDB) SetUser(ctx context.Context, user, passwordHash string) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	return s.write(ctx, func(tx *txn) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO users(login, password_hash) VALUES (?, ?)", user, passwordHash)
+		if isUniqueViolation(err) {
+			return errorapp.ErrDuplicate
+		}
+		return err
+	})
+}
+
+func (s *SQLiteDB) GetUserID(ctx context.Context, login string, hashPassword string) (userID uint16, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := "SELECT user_id FROM users WHERE login = ? AND password_hash = ?"
+	err = s.DB.QueryRowContext(ctx, query, login, hashPassword).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, errorapp.ErrWrongLoginPassword
+		}
+		return 0, err
+	}
+	return userID, nil
+}
+
+// добавляет новый заказ для пользователя
+func (s *SQLiteDB) SetOrder(ctx context.Context, userID uint16, number string) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	return s.write(ctx, func(tx *txn) error {
+		query := "INSERT INTO orders(user_id, number, datetime) VALUES (?, ?, ?)"
+		_, err := tx.ExecContext(ctx, query, userID, number, now())
+		if err != nil {
+			if isUniqueViolation(err) {
+				return errorapp.ErrDuplicate
+			}
+			return err
+		}
+		return insertEvent(ctx, tx, schema.DomainEventOrderUploaded, userID, number, nil)
+	})
+}
+
+// устанавливает статус расчета заказа, повтор текущего статуса ничего не меняет и возвращает errorapp.ErrDuplicate.
+// несуществующий заказ - errorapp.ErrEmptyResult, недопустимый переход - errorapp.ErrInvalidTransition.
+// статус PROCESSED начиляет бонусы проводкой в журнале в той же транзакции
+func (s *SQLiteDB) SetOrderStatus(ctx context.Context, number string, status schema.StatusOrder, accrual float32) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	return s.write(ctx, func(tx *txn) error {
+		orderID, userID, current, err := lockOrder(ctx, tx, number)
+		if err != nil {
+			return err
+		}
+		switch {
+		case current == schema.StatusOrderCancelled:
+			return errorapp.ErrAlreadyCancelled
+		case current == status:
+			// повтор уже записанного статуса
+			return errorapp.ErrDuplicate
+		case !current.CanBecome(status):
+			return fmt.Errorf("%w: %s -> %s", errorapp.ErrInvalidTransition, current, status)
+		}
+
+		err = insertOrderStatus(ctx, tx, orderID, status, accrual)
+		if err != nil {
+			return err
+		}
+		change := schema.OrderStatusChange{From: current, To: status}
+		if status == schema.StatusOrderProcessed {
+			change.Accrual = accrual
+		}
+		err = insertEvent(ctx, tx, schema.DomainEventOrderStatusChanged, userID, number, change)
+		if err != nil {
+			return err
+		}
+		// если статус PROCESSED
+		// зачисляем бонусы на счет
+		if status == schema.StatusOrderProcessed {
+			err = insertBonusFlow(ctx, tx, userID, number, accrual)
+			if err != nil {
+				return err
+			}
+			err = insertOutboxEvent(ctx, tx, schema.WebhookEventOrderAccrued,
+				schema.WebhookOrderData{UserID: userID, Order: number, Accrual: accrual})
+			if err != nil {
+				return err
+			}
+		}
+		tx.userEvents = append(tx.userEvents, schema.UserEvent{
+			Type: schema.UserEventOrder, UserID: userID, Order: number, Status: status, Accrual: accrual,
+		})
+		return nil
+	})
+}
+
+// добавляет статус заказа и ставит заказ в очередь опроса либо убирает из нее, если статус конечный
+func insertOrderStatus(ctx context.Context, tx *txn, orderID int64, status schema.StatusOrder, accrual float32) error {
+	query := `
+	INSERT INTO order_status(order_id, status_id, accrual, datetime)
+	SELECT ?, status_id, ?, ? FROM status WHERE name = ?
+	`
+	_, err := tx.ExecContext(ctx, query, orderID, accrual, now(), status)
+	if err != nil {
+		return err
+	}
+	return updateAccrualJob(ctx, tx, orderID, status)
+}
+
+// отменяет заказ: добавляет статус CANCELLED и, если баллы за заказ уже начислены,
+// возвращает их с баланса пользователя по политике policy
+func (s *SQLiteDB) CancelOrder(ctx context.Context, number string, comment string, policy schema.CancelPolicy) (schema.OrderCancellation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	result := schema.OrderCancellation{Order: number, Status: schema.StatusOrderCancelled}
+	err := s.write(ctx, func(tx *txn) error {
+		orderID, userID, current, err := lockOrder(ctx, tx, number)
+		if err != nil {
+			return err
+		}
+		if current == schema.StatusOrderCancelled {
+			return errorapp.ErrAlreadyCancelled
+		}
+		err = insertOrderStatus(ctx, tx, orderID, schema.StatusOrderCancelled, 0)
+		if err != nil {
+			return err
+		}
+		err = insertEvent(ctx, tx, schema.DomainEventOrderStatusChanged, userID, number,
+			schema.OrderStatusChange{From: current, To: schema.StatusOrderCancelled})
+		if err != nil {
+			return err
+		}
+		tx.userEvents = append(tx.userEvents, schema.UserEvent{
+			Type: schema.UserEventOrder, UserID: userID, Order: number, Status: schema.StatusOrderCancelled,
+		})
+		if current != schema.StatusOrderProcessed {
+			return nil
+		}
+
+		// ищем несторнированное начисление по заказу
+		query := `
+		SELECT je.entry_id FROM journal_entries je
+		WHERE je.kind = 'ACCRUAL' AND je.order_number = ?
+			AND NOT EXISTS (SELECT 1 FROM journal_entries r WHERE r.reverses_entry_id = je.entry_id)
+		`
+		var entryID int64
+		err = tx.QueryRowContext(ctx, query, number).Scan(&entryID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// заказ без начисления
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry, err := getLedgerEntry(ctx, tx, entryID)
+		if err != nil {
+			return err
+		}
+		var accrual float32
+		for _, posting := range entry.Postings {
+			if posting.Account.UserID == userID {
+				accrual = posting.Amount
+			}
+		}
+
+		reversal := ledger.Reversal(entry, comment)
+		result.Reversed = accrual
+		if policy == schema.CancelPolicyClawback {
+			var balance int64
+			err = tx.QueryRowContext(ctx, "SELECT current FROM user_balances WHERE user_id = ?", userID).Scan(&balance)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if current := fromUnits(balance); current < accrual {
+				// возвращаем только то, что осталось на балансе, частичный возврат оформляется корректировкой
+				result.Reversed = current
+				if current <= 0 {
+					result.Reversed = 0
+					return nil
+				}
+				reversal = ledger.Adjustment(userID, -current, comment)
+				reversal.OrderNumber = number
+			}
+		}
+		_, err = postLedgerEntry(ctx, tx, reversal)
+		return err
+	})
+	return result, err
+}
+
+// возвращает id заказа, владельца и последний статус; заказ не изменится до конца транзакции записи.
+// пустой статус - у заказа еще нет статусов
+func lockOrder(ctx context.Context, tx *txn, number string) (orderID int64, userID uint16, status schema.StatusOrder, err error) {
+	query := "SELECT order_id, user_id FROM orders WHERE number = ?"
+	err = tx.QueryRowContext(ctx, query, number).Scan(&orderID, &userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, "", errorapp.ErrEmptyResult
+		}
+		return 0, 0, "", err
+	}
+	query = `
+	SELECT s.name FROM order_status os JOIN status s ON s.status_id = os.status_id
+	WHERE os.order_id = ?
+	ORDER BY os.datetime DESC, os.order_status_id DESC
+	LIMIT 1
+	`
+	err = tx.QueryRowContext(ctx, query, orderID).Scan(&status)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, "", err
+	}
+	return orderID, userID, status, nil
+}
+
+// последний статус каждого заказа пользователя
+const queryOrders = `
+	SELECT o.number, s.name, coalesce(os.accrual, 0), o.datetime
+	FROM orders o JOIN order_status os ON os.order_status_id = (
+			SELECT order_status_id FROM order_status
+			WHERE order_id = o.order_id
+			ORDER BY datetime DESC, order_status_id DESC
+			LIMIT 1
+			)
+		JOIN status s ON s.status_id = os.status_id
+	WHERE o.user_id = ?
+	ORDER BY o.order_id
+	`
+
+// возвращает все заказы в структуре []schema.Order.
+// номер, статус, начисление, датавремя добавления
+func (s *SQLiteDB) GetOrders(ctx context.Context, userID uint16) ([]schema.Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	rows, err := s.DB.QueryContext(ctx, queryOrders, userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanOrders(rows)
+}
+
+func (s *SQLiteDB) scanOrders(rows *sql.Rows) ([]schema.Order, error) {
+	defer rows.Close()
+	result := make([]schema.Order, 0)
+	for rows.Next() {
+		order := schema.Order{}
+		var uploadedAt int64
+		err := rows.Scan(&order.Number, &order.Status, &order.Accrual, &uploadedAt)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("err is here 61203403;")
+			continue
+		}
+		order.UploadedAt.Time = time.UnixMicro(uploadedAt)
+		result = append(result, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// возвращает баланс и общую сумму потраченных баллов из снимка баланса
+func (s *SQLiteDB) GetBalance(ctx context.Context, userID uint16) (schema.Balance, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	balance := schema.Balance{}
+	var current, withdrawn int64
+	query := "SELECT current, withdrawn, version FROM user_balances WHERE user_id = ?"
+	err := s.DB.QueryRowContext(ctx, query, userID).Scan(&current, &withdrawn, &balance.Version)
+	if err != nil {
+		// движений по счету еще не было
+		if errors.Is(err, sql.ErrNoRows) {
+			return balance, nil
+		}
+		s.logger.Error().Err(err).Msg("ошибка при получении из базы баланса; err is here 61203404;")
+		return balance, err
+	}
+	balance.Current, balance.Withdrawn = fromUnits(current), fromUnits(withdrawn)
+	return balance, nil
+}
+
+// списывает баллы в счет заказа, если их достаточно на балансе.
+// проверка баланса и списание выполняются в одной транзакции записи, поэтому параллельные списания не уводят баланс в минус
+func (s *SQLiteDB) Withdraw(ctx context.Context, userID uint16, orderNumber string, sum float32) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	return s.write(ctx, func(tx *txn) error {
+		var current int64
+		err := tx.QueryRowContext(ctx, "SELECT current FROM user_balances WHERE user_id = ?", userID).Scan(&current)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if fromUnits(current) < sum {
+			return errorapp.ErrNotEnoughFunds
+		}
+		err = insertBonusFlow(ctx, tx, userID, orderNumber, -sum)
+		if err != nil {
+			return err
+		}
+		return insertOutboxEvent(ctx, tx, schema.WebhookEventPointsWithdrawn,
+			schema.WebhookOrderData{UserID: userID, Order: orderNumber, Sum: sum})
+	})
+}
+
+// движение бонусов
+// отрицательная сумма записывается в журнал как списание, положительная как начисление
+func (s *SQLiteDB) SetBonusFlow(ctx context.Context, userID uint16, orderNumber string, amount float32) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	return s.write(ctx, func(tx *txn) error {
+		return insertBonusFlow(ctx, tx, userID, orderNumber, amount)
+	})
+}
+
+// пишет проводку в журнал и запись в bonus_flow со ссылкой на нее
+func insertBonusFlow(ctx context.Context, tx *txn, userID uint16, orderNumber string, amount float32) error {
+	var entryID *int64
+	if amount != 0 {
+		entry := ledger.Accrual(userID, orderNumber, amount)
+		if amount < 0 {
+			entry = ledger.Withdrawal(userID, orderNumber, -amount)
+		}
+		id, err := postLedgerEntry(ctx, tx, entry)
+		if err != nil {
+			return err
+		}
+		entryID = &id
+	}
+	// начисление ссылается на заказ пользователя, у списания заказа в orders нет
+	query := `
+	INSERT INTO bonus_flow(user_id, order_number, amount, entry_id, datetime, order_id)
+	VALUES (?1, ?2, ?3, ?4, ?5, (SELECT order_id FROM orders WHERE number = ?2 AND user_id = ?1))
+	`
+	_, err := tx.ExecContext(ctx, query, userID, orderNumber, amount, entryID, now())
+	return err
+}
+
+// списания пользователя без сторнированных
+const queryWithdrawals = `
+	SELECT order_number, -amount, datetime
+	FROM bonus_flow bf
+	WHERE user_id = ? AND amount < 0
+		AND NOT EXISTS (SELECT 1 FROM journal_entries r WHERE r.reverses_entry_id = bf.entry_id)
+	ORDER BY datetime, bonus_flow_id
+	`
+
+// возвращает список выводов пользователя, без сторнированных
+func (s *SQLiteDB) GetBonusFlow(ctx context.Context, userID uint16) ([]schema.OrderSum, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	rows, err := s.DB.QueryContext(ctx, queryWithdrawals, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.OrderSum, 0)
+	for rows.Next() {
+		orderSum := schema.OrderSum{}
+		var processedAt int64
+		err := rows.Scan(&orderSum.Order, &orderSum.Sum, &processedAt)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("err is here 61203405;")
+			continue
+		}
+		orderSum.ProcessedAt.Time = time.UnixMicro(processedAt)
+		result = append(result, orderSum)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// возвращает айди юзера добавившего заказ
+func (s *SQLiteDB) GetUserIDfromOrders(ctx context.Context, numberOrder string) (uint16, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	var userID uint16
+	err := s.DB.QueryRowContext(ctx, "SELECT user_id FROM orders WHERE number = ?", numberOrder).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, errorapp.ErrEmptyResult
+		}
+		return 0, err
+	}
+	return userID, nil
+}
+
+// проверка доступности БД
+func (s *SQLiteDB) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	return s.DB.PingContext(ctx)
+}
+
+// версия схемы БД и последняя версия среди файлов миграций
+func (s *SQLiteDB) GetMigrationStatus(ctx context.Context) (schema.MigrationStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	status := schema.MigrationStatus{Expected: s.expectedVersion}
+	query := "SELECT version, dirty FROM schema_migrations LIMIT 1"
+	err := s.DB.QueryRowContext(ctx, query).Scan(&status.Version, &status.Dirty)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return status, err
+	}
+	return status, nil
+}
@@ -0,0 +1,27 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/config"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+	"github.com/bubu256/gophermart_pet/pkg/storage/storagetest"
+	"github.com/rs/zerolog"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		cfg := config.CfgDataBase{
+			DataBaseURI:     "sqlite://" + filepath.Join(t.TempDir(), "gophermart.db"),
+			AutoMigrate:     true,
+			MaxConns:        4,
+			MaxConnLifetime: time.Hour,
+			MaxConnIdleTime: time.Hour,
+		}
+		s := New(cfg, zerolog.Nop()).(*SQLiteDB)
+		t.Cleanup(s.Close)
+		return s
+	})
+}
@@ -0,0 +1,289 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+)
+
+// исходящие вебхуки: события пишутся в outbox в транзакции изменения,
+// доставки получателям создаются там же и разбираются диспетчером
+
+// доставки с данными события и получателя
+const queryDeliveries = `
+	SELECT d.delivery_id, d.event_id, o.event_type, d.endpoint_id, e.url, e.secret,
+		d.status, d.attempts, coalesce(d.last_error, ''), d.next_attempt_at, o.created_at, o.payload
+	FROM webhook_deliveries d JOIN outbox o ON o.event_id = d.event_id
+		JOIN webhook_endpoints e ON e.endpoint_id = d.endpoint_id
+	`
+
+// записывает событие в outbox и создает доставки всем получателям, подписанным на его тип
+func insertOutboxEvent(ctx context.Context, tx *txn, eventType schema.WebhookEventType, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	createdAt := now()
+	var eventID int64
+	query := "INSERT INTO outbox(event_type, payload, created_at) VALUES (?, ?, ?) RETURNING event_id"
+	err = tx.QueryRowContext(ctx, query, eventType, string(payload), createdAt).Scan(&eventID)
+	if err != nil {
+		return err
+	}
+	query = `
+	INSERT INTO webhook_deliveries(event_id, endpoint_id, next_attempt_at)
+	SELECT ?1, endpoint_id, ?2 FROM webhook_endpoints
+	WHERE event_types = '' OR instr(',' || event_types || ',', ',' || ?3 || ',') > 0
+	`
+	_, err = tx.ExecContext(ctx, query, eventID, createdAt, eventType)
+	return err
+}
+
+// регистрирует получателя вебхуков
+func (s *SQLiteDB) CreateWebhookEndpoint(ctx context.Context, endpoint schema.WebhookEndpoint) (schema.WebhookEndpoint, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	eventTypes := make([]string, 0, len(endpoint.EventTypes))
+	for _, eventType := range endpoint.EventTypes {
+		eventTypes = append(eventTypes, string(eventType))
+	}
+	createdAt := now()
+	query := `
+	INSERT INTO webhook_endpoints(url, secret, event_types, created_at)
+	VALUES (?, ?, ?, ?)
+	RETURNING endpoint_id
+	`
+	err := s.write(ctx, func(tx *txn) error {
+		return tx.QueryRowContext(ctx, query, endpoint.URL, endpoint.Secret, strings.Join(eventTypes, ","), createdAt).
+			Scan(&endpoint.ID)
+	})
+	endpoint.CreatedAt.Time = time.UnixMicro(createdAt)
+	return endpoint, err
+}
+
+// возвращает получателей вебхуков без секретов
+func (s *SQLiteDB) GetWebhookEndpoints(ctx context.Context) ([]schema.WebhookEndpoint, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := "SELECT endpoint_id, url, event_types, created_at FROM webhook_endpoints ORDER BY endpoint_id"
+	rows, err := s.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.WebhookEndpoint, 0)
+	for rows.Next() {
+		endpoint := schema.WebhookEndpoint{}
+		var eventTypes string
+		var createdAt int64
+		err := rows.Scan(&endpoint.ID, &endpoint.URL, &eventTypes, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		endpoint.CreatedAt.Time = time.UnixMicro(createdAt)
+		endpoint.EventTypes = make([]schema.WebhookEventType, 0)
+		for _, eventType := range strings.FieldsFunc(eventTypes, func(r rune) bool { return r == ',' }) {
+			endpoint.EventTypes = append(endpoint.EventTypes, schema.WebhookEventType(eventType))
+		}
+		result = append(result, endpoint)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	return result, nil
+}
+
+// удаляет получателя вместе с его доставками
+func (s *SQLiteDB) DeleteWebhookEndpoint(ctx context.Context, endpointID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	return s.write(ctx, func(tx *txn) error {
+		result, err := tx.ExecContext(ctx, "DELETE FROM webhook_endpoints WHERE endpoint_id = ?", endpointID)
+		if err != nil {
+			return err
+		}
+		deleted, err := result.RowsAffected()
+		if err == nil && deleted == 0 {
+			return errorapp.ErrEmptyResult
+		}
+		return err
+	})
+}
+
+// захватывает до limit доставок готовых к отправке на время lease.
+// захват сдвигает время следующей попытки, поэтому зависшая доставка вернется в работу после lease
+func (s *SQLiteDB) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]schema.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	UPDATE webhook_deliveries
+	SET attempts = attempts + 1, next_attempt_at = ?1 + ?2
+	WHERE delivery_id IN (
+		SELECT delivery_id FROM webhook_deliveries
+		WHERE status = 'PENDING' AND next_attempt_at <= ?1
+		ORDER BY next_attempt_at
+		LIMIT ?3
+		)
+	RETURNING delivery_id
+	`
+	var result []schema.WebhookDelivery
+	err := s.write(ctx, func(tx *txn) error {
+		rows, err := tx.QueryContext(ctx, query, now(), lease.Microseconds(), limit)
+		if err != nil {
+			return err
+		}
+		claimed := make([]int64, 0)
+		for rows.Next() {
+			var deliveryID int64
+			if err := rows.Scan(&deliveryID); err != nil {
+				rows.Close()
+				return err
+			}
+			claimed = append(claimed, deliveryID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		// захваченные доставки передаются списком json, чтобы не собирать запрос с переменным числом параметров
+		ids, err := json.Marshal(claimed)
+		if err != nil {
+			return err
+		}
+		rows, err = tx.QueryContext(ctx, queryDeliveries+`
+		WHERE d.delivery_id IN (SELECT value FROM json_each(?))
+		ORDER BY d.event_id
+		`, string(ids))
+		if err != nil {
+			return err
+		}
+		result, err = scanWebhookDeliveries(rows)
+		return err
+	})
+	return result, err
+}
+
+// отмечает доставку выполненной
+func (s *SQLiteDB) CompleteWebhookDelivery(ctx context.Context, deliveryID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	UPDATE webhook_deliveries SET status = 'DELIVERED', delivered_at = ?, last_error = NULL
+	WHERE delivery_id = ?
+	`
+	return s.write(ctx, func(tx *txn) error {
+		_, err := tx.ExecContext(ctx, query, now(), deliveryID)
+		return err
+	})
+}
+
+// записывает неудачную попытку доставки: следующая попытка в nextAttemptAt,
+// либо, если final, доставка получает статус FAILED
+func (s *SQLiteDB) FailWebhookDelivery(ctx context.Context, deliveryID int64, nextAttemptAt time.Time, failure string, final bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+	defer cancel()
+	query := `
+	UPDATE webhook_deliveries
+	SET status = CASE WHEN ?4 THEN 'FAILED' ELSE 'PENDING' END, next_attempt_at = ?2, last_error = ?3
+	WHERE delivery_id = ?1
+	`
+	return s.write(ctx, func(tx *txn) error {
+		_, err := tx.ExecContext(ctx, query, deliveryID, unixMicro(nextAttemptAt), failure, final)
+		return err
+	})
+}
+
+// возвращает доставки со статусом status, последние сначала
+func (s *SQLiteDB) GetWebhookDeliveries(ctx context.Context, status schema.WebhookDeliveryStatus, limit int) ([]schema.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	rows, err := s.DB.QueryContext(ctx, queryDeliveries+`
+	WHERE d.status = ?
+	ORDER BY d.delivery_id DESC
+	LIMIT ?
+	`, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	result, err := scanWebhookDeliveries(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return result, errorapp.ErrEmptyResult
+	}
+	// секрет получателя нужен только диспетчеру
+	for i := range result {
+		result[i].Secret = ""
+	}
+	return result, nil
+}
+
+// возвращает неудачные доставки в очередь с обнуленным счетчиком попыток.
+// deliveryID > 0 - одну доставку, иначе все неудачные доставки получателя endpointID
+func (s *SQLiteDB) ReplayWebhookDeliveries(ctx context.Context, deliveryID int64, endpointID int64) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	query := `
+	UPDATE webhook_deliveries
+	SET status = 'PENDING', attempts = 0, next_attempt_at = ?3, last_error = NULL
+	WHERE status = 'FAILED' AND (delivery_id = ?1 OR (?1 = 0 AND endpoint_id = ?2))
+	`
+	// ErrEmptyResult только для неизвестной доставки или получателя, без неудачных доставок - ноль
+	exists := `
+	SELECT CASE WHEN ?1 = 0
+		THEN EXISTS (SELECT 1 FROM webhook_endpoints WHERE endpoint_id = ?2)
+		ELSE EXISTS (SELECT 1 FROM webhook_deliveries WHERE delivery_id = ?1)
+	END
+	`
+	var replayed int64
+	var found bool
+	err := s.write(ctx, func(tx *txn) error {
+		err := tx.QueryRowContext(ctx, exists, deliveryID, endpointID).Scan(&found)
+		if err != nil || !found {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, query, deliveryID, endpointID, now())
+		if err != nil {
+			return err
+		}
+		replayed, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, errorapp.ErrEmptyResult
+	}
+	return int(replayed), nil
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]schema.WebhookDelivery, error) {
+	defer rows.Close()
+	result := make([]schema.WebhookDelivery, 0)
+	for rows.Next() {
+		d := schema.WebhookDelivery{}
+		var nextAttemptAt, createdAt int64
+		var payload string
+		err := rows.Scan(&d.ID, &d.EventID, &d.EventType, &d.EndpointID, &d.URL, &d.Secret,
+			&d.Status, &d.Attempts, &d.LastError, &nextAttemptAt, &createdAt, &payload)
+		if err != nil {
+			return nil, err
+		}
+		d.NextAttemptAt.Time = time.UnixMicro(nextAttemptAt)
+		d.CreatedAt.Time = time.UnixMicro(createdAt)
+		d.Payload = []byte(payload)
+		result = append(result, d)
+	}
+	return result, rows.Err()
+}
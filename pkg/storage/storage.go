@@ -1,19 +1,75 @@
 package storage
 
 import (
+	"context"
+	"time"
+
 	"github.com/bubu256/gophermart_pet/internal/schema"
 )
 
 type Storage interface {
-	SetUser(user, passwordHash string) error
-	GetUserID(login string, hash string) (userID uint16, err error)
-	SetOrder(userID uint16, number string) error
-	SetOrderStatus(number string, status schema.StatusOrder, accrual float32) error
-	GetOrders(userID uint16) ([]schema.Order, error)
-	GetBalance(userID uint16) (schema.Balance, error)
-	SetBonusFlow(userID uint16, orderNumber string, amount float32) error
-	GetUserIDfromOrders(numberOrder string) (userID uint16, err error)
-	GetBonusFlow(userID uint16) ([]schema.OrderSum, error)
-	GetWaitingOrders() ([]schema.Order, error)
-	Ping() error
+	SetUser(ctx context.Context, user, passwordHash string) error
+	GetUserID(ctx context.Context, login string, hash string) (userID uint16, err error)
+	SetOrder(ctx context.Context, userID uint16, number string) error
+	// смена статуса заказа: ErrEmptyResult - заказа нет, ErrDuplicate - статус уже записан,
+	// ErrInvalidTransition - недопустимый переход, ErrAlreadyCancelled - заказ отменен
+	SetOrderStatus(ctx context.Context, number string, status schema.StatusOrder, accrual float32) error
+	CancelOrder(ctx context.Context, number string, comment string, policy schema.CancelPolicy) (schema.OrderCancellation, error)
+	GetOrders(ctx context.Context, userID uint16) ([]schema.Order, error)
+	GetBalance(ctx context.Context, userID uint16) (schema.Balance, error)
+	SetBonusFlow(ctx context.Context, userID uint16, orderNumber string, amount float32) error
+	Withdraw(ctx context.Context, userID uint16, orderNumber string, sum float32) error
+	GetUserIDfromOrders(ctx context.Context, numberOrder string) (userID uint16, err error)
+	GetBonusFlow(ctx context.Context, userID uint16) ([]schema.OrderSum, error)
+	Ping(ctx context.Context) error
+	GetMigrationStatus(ctx context.Context) (schema.MigrationStatus, error)
+
+	// журнал двойной записи
+	PostLedgerEntry(ctx context.Context, entry schema.LedgerEntry) (entryID int64, err error)
+	ReverseLedgerEntry(ctx context.Context, entryID int64, comment string) (reversalID int64, err error)
+	GetLedgerEntries(ctx context.Context, userID uint16) ([]schema.LedgerEntry, error)
+	GetLedgerTotal(ctx context.Context) (float32, error)
+	CheckBalances(ctx context.Context) ([]schema.BalanceDrift, error)
+
+	// сгорание баллов
+	GetCreditLots(ctx context.Context, userID uint16, creditedBefore time.Time) ([]schema.CreditLot, error)
+	GetExpiringUsers(ctx context.Context, creditedBefore time.Time, afterUserID uint16, limit int) ([]uint16, error)
+	ExpireUserCreditLots(ctx context.Context, userID uint16, creditedBefore time.Time) (expired bool, err error)
+
+	// очередь опроса аккрол сервиса
+	ClaimAccrualJobs(ctx context.Context, owner string, limit int, lease time.Duration) ([]schema.AccrualJob, error)
+	RescheduleAccrualJob(ctx context.Context, number string, owner string, nextAttemptAt time.Time, failure string) error
+	GetOrdersByStatus(ctx context.Context, status schema.StatusOrder) ([]schema.Order, error)
+	GetAccrualQueueDepth(ctx context.Context) (int, error)
+
+	// исходящие вебхуки
+	CreateWebhookEndpoint(ctx context.Context, endpoint schema.WebhookEndpoint) (schema.WebhookEndpoint, error)
+	GetWebhookEndpoints(ctx context.Context) ([]schema.WebhookEndpoint, error)
+	DeleteWebhookEndpoint(ctx context.Context, endpointID int64) error
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]schema.WebhookDelivery, error)
+	CompleteWebhookDelivery(ctx context.Context, deliveryID int64) error
+	FailWebhookDelivery(ctx context.Context, deliveryID int64, nextAttemptAt time.Time, failure string, final bool) error
+	GetWebhookDeliveries(ctx context.Context, status schema.WebhookDeliveryStatus, limit int) ([]schema.WebhookDelivery, error)
+	// повтор неудачных доставок; ErrEmptyResult, если нет такой доставки или получателя
+	ReplayWebhookDeliveries(ctx context.Context, deliveryID int64, endpointID int64) (replayed int, err error)
+
+	// журнал доменных событий: до limit событий после смещения offset
+	GetEvents(ctx context.Context, offset int64, limit int) ([]schema.DomainEvent, error)
+
+	// события пользователей: блокируется и передает handler события всех экземпляров приложения,
+	// пока не отменен ctx или не оборвалось соединение
+	ListenUserEvents(ctx context.Context, handler func(schema.UserEvent)) error
+}
+
+// миграции схемы БД реализации хранилища, подкоманда gophermart migrate
+type Migrator interface {
+	// применяет все новые миграции, migrate.ErrNoChange если применять нечего
+	Up() error
+	// откатывает steps последних миграций
+	Down(steps int) error
+	// версия схемы БД и последняя версия миграций реализации
+	Status() (schema.MigrationStatus, error)
+	// записывает версию схемы без выполнения миграций и снимает признак dirty
+	Force(version int) error
+	Close() error
 }
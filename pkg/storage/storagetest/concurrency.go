@@ -0,0 +1,164 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+)
+
+// сколько вызовов выполняется одновременно в тестах конкурентного доступа
+const parallel = 20
+
+// запускает call parallel раз одновременно и возвращает ошибки вызовов
+func runParallel(call func(i int) error) []error {
+	errs := make([]error, parallel)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = call(i)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	return errs
+}
+
+func testConcurrentWithdraw(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	accrue(t, s, alice, "12345678903", 100)
+
+	// баланса хватает ровно на половину списаний, баланс не уходит в минус
+	errs := runParallel(func(i int) error {
+		return s.Withdraw(ctx, alice, fmt.Sprintf("withdraw-%d", i), 10)
+	})
+	succeeded := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, errorapp.ErrNotEnoughFunds):
+			t.Errorf("Withdraw error = %v, want nil or ErrNotEnoughFunds", err)
+		}
+	}
+	if succeeded != 10 {
+		t.Errorf("%d withdrawals succeeded, want 10", succeeded)
+	}
+	assertBalance(t, s, alice, 0, 100)
+	withdrawals, err := s.GetBonusFlow(ctx, alice)
+	if err != nil || len(withdrawals) != 10 {
+		t.Errorf("GetBonusFlow = %d withdrawals, %v, want 10", len(withdrawals), err)
+	}
+	assertLedgerConsistent(t, s)
+}
+
+func testConcurrentOrders(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	users := make([]uint16, parallel)
+	for i := range users {
+		users[i] = newUser(t, s, fmt.Sprintf("user%d", i))
+	}
+
+	// один номер заказа загружают все пользователи сразу, заказ достается одному
+	errs := runParallel(func(i int) error {
+		return s.SetOrder(ctx, users[i], "12345678903")
+	})
+	owner := uint16(0)
+	for i, err := range errs {
+		switch {
+		case err == nil && owner == 0:
+			owner = users[i]
+		case err == nil:
+			t.Errorf("SetOrder succeeded for users %d and %d", owner, users[i])
+		case !errors.Is(err, errorapp.ErrDuplicate):
+			t.Errorf("SetOrder error = %v, want nil or ErrDuplicate", err)
+		}
+	}
+	if got, err := s.GetUserIDfromOrders(ctx, "12345678903"); err != nil || got != owner {
+		t.Errorf("GetUserIDfromOrders = %d, %v, want %d", got, err, owner)
+	}
+
+	// один и тот же конечный статус от опроса и callback: начисление записывается один раз
+	setStatus(t, s, "12345678903", schema.StatusOrderNew, 0)
+	errs = runParallel(func(i int) error {
+		return s.SetOrderStatus(ctx, "12345678903", schema.StatusOrderProcessed, 42)
+	})
+	succeeded := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, errorapp.ErrDuplicate):
+			t.Errorf("SetOrderStatus error = %v, want nil or ErrDuplicate", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d status updates succeeded, want 1", succeeded)
+	}
+	assertBalance(t, s, owner, 42, 0)
+	assertLedgerConsistent(t, s)
+}
+
+func testConcurrentClaims(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	const orders = 30
+	for i := 0; i < orders; i++ {
+		setOrder(t, s, alice, fmt.Sprintf("order-%d", i), schema.StatusOrderNew)
+	}
+
+	// воркеры делят очередь: каждый заказ захватывается ровно одним воркером
+	var mu sync.Mutex
+	claimed := make(map[string]int)
+	claim := func(owner string) (int, error) {
+		jobs, err := s.ClaimAccrualJobs(ctx, owner, 3, time.Minute)
+		if errors.Is(err, errorapp.ErrEmptyResult) {
+			return 0, nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, job := range jobs {
+			claimed[job.OrderNumber]++
+		}
+		return len(jobs), err
+	}
+	errs := runParallel(func(i int) error {
+		_, err := claim(fmt.Sprintf("worker-%d", i))
+		return err
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("ClaimAccrualJobs: %v", err)
+		}
+	}
+	// реализация может пропустить задачи, захватываемые в этот момент другим воркером,
+	// поэтому остаток очереди разбирается последовательно
+	for {
+		n, err := claim("worker-last")
+		if err != nil {
+			t.Fatalf("ClaimAccrualJobs: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if len(claimed) != orders {
+		t.Errorf("%d orders claimed, want %d", len(claimed), orders)
+	}
+	for number, count := range claimed {
+		if count != 1 {
+			t.Errorf("order %s claimed %d times", number, count)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/ledger"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+)
+
+func testEvents(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	if _, err := s.GetEvents(ctx, 0, 10); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetEvents without events error = %v, want ErrEmptyResult", err)
+	}
+	alice := newUser(t, s, "alice")
+	setOrder(t, s, alice, "12345678903", schema.StatusOrderNew)
+	setStatus(t, s, "12345678903", schema.StatusOrderProcessed, 100)
+
+	events, err := s.GetEvents(ctx, 0, 10)
+	if err != nil {
+		t.Fatalf("GetEvents: %v", err)
+	}
+	want := []schema.DomainEventType{
+		schema.DomainEventOrderUploaded,
+		schema.DomainEventOrderStatusChanged,
+		schema.DomainEventOrderStatusChanged,
+		schema.DomainEventPointsCredited,
+	}
+	if len(events) != len(want) {
+		t.Fatalf("GetEvents = %+v, want %v", events, want)
+	}
+	for i, event := range events {
+		if event.Type != want[i] || event.UserID != alice || event.OrderNumber != "12345678903" {
+			t.Errorf("event %d = %+v, want %s of the order", i, event, want[i])
+		}
+		if i > 0 && event.Offset <= events[i-1].Offset {
+			t.Errorf("event offsets are not increasing: %d after %d", event.Offset, events[i-1].Offset)
+		}
+	}
+
+	// чтение продолжается с последнего полученного смещения
+	rest, err := s.GetEvents(ctx, events[1].Offset, 1)
+	if err != nil || len(rest) != 1 || rest[0].Offset != events[2].Offset {
+		t.Errorf("GetEvents after offset = %+v, %v, want the third event", rest, err)
+	}
+	if _, err := s.GetEvents(ctx, events[3].Offset, 10); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetEvents after the last event error = %v, want ErrEmptyResult", err)
+	}
+}
+
+func testUserEvents(t *testing.T, s storage.Storage) {
+	alice := newUser(t, s, "alice")
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan schema.UserEvent, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenUserEvents(ctx, func(event schema.UserEvent) { received <- event })
+	}()
+
+	// подписка готовится асинхронно, поэтому изменения повторяются, пока подписчик не получит событие
+	deadline := time.After(5 * time.Second)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case event := <-received:
+			if event.Type != schema.UserEventBalance || event.UserID != alice || event.Balance == nil || event.Balance.Current <= 0 {
+				t.Errorf("user event = %+v, want balance event of the user", event)
+			}
+			cancel()
+			if err := <-done; err == nil {
+				t.Errorf("ListenUserEvents returned nil after cancel, want error")
+			}
+			return
+		case <-ticker.C:
+			if _, err := s.PostLedgerEntry(context.Background(), ledger.Adjustment(alice, 1, fmt.Sprint(i))); err != nil {
+				t.Fatalf("PostLedgerEntry: %v", err)
+			}
+		case err := <-done:
+			t.Fatalf("ListenUserEvents: %v", err)
+		case <-deadline:
+			cancel()
+			t.Fatal("no user event received")
+		}
+	}
+}
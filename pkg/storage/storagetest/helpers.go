@@ -0,0 +1,71 @@
+package storagetest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+)
+
+// регистрирует пользователя и возвращает его id
+func newUser(t *testing.T, s storage.Storage, login string) uint16 {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.SetUser(ctx, login, "hash"); err != nil {
+		t.Fatalf("SetUser(%s): %v", login, err)
+	}
+	userID, err := s.GetUserID(ctx, login, "hash")
+	if err != nil {
+		t.Fatalf("GetUserID(%s): %v", login, err)
+	}
+	return userID
+}
+
+// добавляет заказ пользователя с первым статусом
+func setOrder(t *testing.T, s storage.Storage, userID uint16, number string, status schema.StatusOrder) {
+	t.Helper()
+	if err := s.SetOrder(context.Background(), userID, number); err != nil {
+		t.Fatalf("SetOrder(%s): %v", number, err)
+	}
+	setStatus(t, s, number, status, 0)
+}
+
+func setStatus(t *testing.T, s storage.Storage, number string, status schema.StatusOrder, accrual float32) {
+	t.Helper()
+	if err := s.SetOrderStatus(context.Background(), number, status, accrual); err != nil {
+		t.Fatalf("SetOrderStatus(%s, %s): %v", number, status, err)
+	}
+}
+
+// начисляет баллы за новый заказ пользователя
+func accrue(t *testing.T, s storage.Storage, userID uint16, number string, accrual float32) {
+	t.Helper()
+	setOrder(t, s, userID, number, schema.StatusOrderNew)
+	setStatus(t, s, number, schema.StatusOrderProcessed, accrual)
+}
+
+func assertBalance(t *testing.T, s storage.Storage, userID uint16, current, withdrawn float32) {
+	t.Helper()
+	balance, err := s.GetBalance(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("GetBalance: %v", err)
+	}
+	if balance.Current != current || balance.Withdrawn != withdrawn {
+		t.Errorf("balance = %v/%v, want current %v, withdrawn %v", balance.Current, balance.Withdrawn, current, withdrawn)
+	}
+}
+
+// журнал сходится в ноль, снимки балансов совпадают с пересчетом по журналу
+func assertLedgerConsistent(t *testing.T, s storage.Storage) {
+	t.Helper()
+	ctx := context.Background()
+	total, err := s.GetLedgerTotal(ctx)
+	if err != nil || total != 0 {
+		t.Errorf("GetLedgerTotal = %v, %v, want 0", total, err)
+	}
+	drifts, err := s.CheckBalances(ctx)
+	if err != nil || len(drifts) != 0 {
+		t.Errorf("CheckBalances = %+v, %v, want no drift", drifts, err)
+	}
+}
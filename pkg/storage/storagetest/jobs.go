@@ -0,0 +1,143 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+)
+
+func testAccrualJobs(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+
+	if _, err := s.ClaimAccrualJobs(ctx, "w1", 10, time.Minute); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("ClaimAccrualJobs of empty queue error = %v, want ErrEmptyResult", err)
+	}
+	setOrder(t, s, alice, "12345678903", schema.StatusOrderNew)
+	setOrder(t, s, alice, "2377225624", schema.StatusOrderNew)
+	setStatus(t, s, "2377225624", schema.StatusOrderProcessing, 0)
+	if depth, err := s.GetAccrualQueueDepth(ctx); err != nil || depth != 2 {
+		t.Errorf("GetAccrualQueueDepth = %d, %v, want 2", depth, err)
+	}
+
+	jobs, err := s.ClaimAccrualJobs(ctx, "w1", 1, time.Minute)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("ClaimAccrualJobs limit 1 = %+v, %v, want 1 job", jobs, err)
+	}
+	more, err := s.ClaimAccrualJobs(ctx, "w1", 10, time.Minute)
+	if err != nil || len(more) != 1 || more[0].OrderNumber == jobs[0].OrderNumber {
+		t.Fatalf("ClaimAccrualJobs = %+v, %v, want the other job", more, err)
+	}
+	jobs = append(jobs, more...)
+	for _, job := range jobs {
+		want := schema.StatusOrderNew
+		if job.OrderNumber == "2377225624" {
+			want = schema.StatusOrderProcessing
+		}
+		if job.Status != want || job.Attempts != 1 || job.Failures != 0 || job.LastError != "" || job.CreatedAt.IsZero() {
+			t.Errorf("claimed job %+v, want first attempt of order with status %s", job, want)
+		}
+	}
+	// захваченные задачи не выдаются до истечения захвата
+	if _, err := s.ClaimAccrualJobs(ctx, "w2", 10, time.Minute); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("ClaimAccrualJobs during lease error = %v, want ErrEmptyResult", err)
+	}
+
+	// перенос чужой задачи ничего не меняет
+	past := time.Now().Add(-time.Minute)
+	if err := s.RescheduleAccrualJob(ctx, "12345678903", "w2", past, ""); err != nil {
+		t.Fatalf("RescheduleAccrualJob: %v", err)
+	}
+	if _, err := s.ClaimAccrualJobs(ctx, "w2", 10, time.Minute); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("ClaimAccrualJobs after reschedule by other owner error = %v, want ErrEmptyResult", err)
+	}
+
+	// неудача засчитывается и задача снова доступна в назначенное время
+	if err := s.RescheduleAccrualJob(ctx, "12345678903", "w1", past, "timeout"); err != nil {
+		t.Fatalf("RescheduleAccrualJob: %v", err)
+	}
+	if err := s.RescheduleAccrualJob(ctx, "2377225624", "w1", time.Now().Add(time.Hour), ""); err != nil {
+		t.Fatalf("RescheduleAccrualJob: %v", err)
+	}
+	jobs, err = s.ClaimAccrualJobs(ctx, "w2", 10, time.Minute)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("ClaimAccrualJobs after reschedule = %+v, %v, want 1 job", jobs, err)
+	}
+	if job := jobs[0]; job.OrderNumber != "12345678903" || job.Attempts != 2 || job.Failures != 1 || job.LastError != "timeout" {
+		t.Errorf("claimed job %+v, want second attempt after one failure", job)
+	}
+	// успешный опрос сбрасывает счетчик неудач
+	if err := s.RescheduleAccrualJob(ctx, "12345678903", "w2", past, ""); err != nil {
+		t.Fatalf("RescheduleAccrualJob: %v", err)
+	}
+	jobs, err = s.ClaimAccrualJobs(ctx, "w1", 10, time.Minute)
+	if err != nil || len(jobs) != 1 || jobs[0].Failures != 0 || jobs[0].LastError != "" || jobs[0].Attempts != 3 {
+		t.Errorf("ClaimAccrualJobs after success = %+v, %v, want failures reset", jobs, err)
+	}
+
+	// конечный статус убирает заказ из очереди
+	setStatus(t, s, "12345678903", schema.StatusOrderInvalid, 0)
+	setStatus(t, s, "2377225624", schema.StatusOrderProcessed, 10)
+	if depth, err := s.GetAccrualQueueDepth(ctx); err != nil || depth != 0 {
+		t.Errorf("GetAccrualQueueDepth = %d, %v, want 0 after final statuses", depth, err)
+	}
+}
+
+func testOrdersByStatus(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+
+	if _, err := s.GetOrdersByStatus(ctx, schema.StatusOrderStale); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetOrdersByStatus without orders error = %v, want ErrEmptyResult", err)
+	}
+	// заказы всех пользователей в порядке загрузки
+	numbers := []string{"12345678903", "2377225624", "49927398716"}
+	setOrder(t, s, bob, numbers[0], schema.StatusOrderNew)
+	setOrder(t, s, alice, numbers[1], schema.StatusOrderNew)
+	setOrder(t, s, bob, numbers[2], schema.StatusOrderNew)
+	for _, number := range numbers {
+		setStatus(t, s, number, schema.StatusOrderStale, 0)
+	}
+	// заказ вернувшийся из STALE в уже пройденный статус PROCESSING снова попадает в очередь опроса
+	// и в выборку STALE не попадает
+	setOrder(t, s, alice, "79927398713", schema.StatusOrderNew)
+	setStatus(t, s, "79927398713", schema.StatusOrderProcessing, 0)
+	setStatus(t, s, "79927398713", schema.StatusOrderStale, 0)
+	if depth, err := s.GetAccrualQueueDepth(ctx); err != nil || depth != 0 {
+		t.Errorf("GetAccrualQueueDepth = %d, %v, want 0: STALE orders leave the queue", depth, err)
+	}
+	setStatus(t, s, "79927398713", schema.StatusOrderProcessing, 0)
+	jobs, err := s.ClaimAccrualJobs(ctx, "w1", 10, time.Minute)
+	if err != nil || len(jobs) != 1 || jobs[0].OrderNumber != "79927398713" || jobs[0].Status != schema.StatusOrderProcessing {
+		t.Errorf("ClaimAccrualJobs = %+v, %v, want the order back in PROCESSING", jobs, err)
+	}
+	if err := s.SetOrderStatus(ctx, "79927398713", schema.StatusOrderProcessing, 0); !errors.Is(err, errorapp.ErrDuplicate) {
+		t.Errorf("SetOrderStatus repeated PROCESSING error = %v, want ErrDuplicate", err)
+	}
+	processing, err := s.GetOrders(ctx, alice)
+	if err != nil || len(processing) != 2 || processing[1].Status != string(schema.StatusOrderProcessing) {
+		t.Errorf("GetOrders = %+v, %v, want the order in PROCESSING", processing, err)
+	}
+
+	orders, err := s.GetOrdersByStatus(ctx, schema.StatusOrderStale)
+	if err != nil {
+		t.Fatalf("GetOrdersByStatus: %v", err)
+	}
+	if len(orders) != len(numbers) {
+		t.Fatalf("GetOrdersByStatus = %+v, want %v", orders, numbers)
+	}
+	for i, order := range orders {
+		if order.Number != numbers[i] || order.Status != string(schema.StatusOrderStale) {
+			t.Errorf("order %d = %+v, want %s in STALE", i, order, numbers[i])
+		}
+		if i > 0 && order.UploadedAt.Before(orders[i-1].UploadedAt.Time) {
+			t.Errorf("GetOrdersByStatus is not ordered by upload time: %+v", orders)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/ledger"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+)
+
+func testLedger(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+
+	if _, err := s.GetLedgerEntries(ctx, alice); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetLedgerEntries without entries error = %v, want ErrEmptyResult", err)
+	}
+	unbalanced := ledger.Adjustment(alice, 10, "")
+	unbalanced.Postings[1].Amount = -9
+	if _, err := s.PostLedgerEntry(ctx, unbalanced); !errors.Is(err, errorapp.ErrUnbalancedEntry) {
+		t.Errorf("PostLedgerEntry unbalanced error = %v, want ErrUnbalancedEntry", err)
+	}
+	unknown := ledger.Adjustment(alice, 10, "")
+	unknown.Postings[1].Account.Code = "BONUS"
+	if _, err := s.PostLedgerEntry(ctx, unknown); !errors.Is(err, errorapp.ErrInvalidEntry) {
+		t.Errorf("PostLedgerEntry unknown system account error = %v, want ErrInvalidEntry", err)
+	}
+
+	entryID, err := s.PostLedgerEntry(ctx, ledger.Adjustment(alice, 0.1, "compensation"))
+	if err != nil {
+		t.Fatalf("PostLedgerEntry: %v", err)
+	}
+	if _, err := s.PostLedgerEntry(ctx, ledger.Adjustment(alice, 0.2, "compensation")); err != nil {
+		t.Fatalf("PostLedgerEntry: %v", err)
+	}
+	// точная арифметика: 0.1 + 0.2 в журнале равно 0.3
+	assertBalance(t, s, alice, 0.3, 0)
+
+	reversalID, err := s.ReverseLedgerEntry(ctx, entryID, "mistake")
+	if err != nil {
+		t.Fatalf("ReverseLedgerEntry: %v", err)
+	}
+	assertBalance(t, s, alice, 0.2, 0)
+	if _, err := s.ReverseLedgerEntry(ctx, entryID, "again"); !errors.Is(err, errorapp.ErrAlreadyReversed) {
+		t.Errorf("ReverseLedgerEntry twice error = %v, want ErrAlreadyReversed", err)
+	}
+	if _, err := s.ReverseLedgerEntry(ctx, reversalID, ""); !errors.Is(err, errorapp.ErrInvalidEntry) {
+		t.Errorf("ReverseLedgerEntry of reversal error = %v, want ErrInvalidEntry", err)
+	}
+	if _, err := s.ReverseLedgerEntry(ctx, reversalID+100, ""); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("ReverseLedgerEntry unknown entry error = %v, want ErrEmptyResult", err)
+	}
+
+	entries, err := s.GetLedgerEntries(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetLedgerEntries: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("GetLedgerEntries = %+v, want 3 entries", entries)
+	}
+	reversal := entries[2]
+	if reversal.ID != reversalID || reversal.Kind != schema.LedgerEntryReversal || reversal.ReversesID != entryID ||
+		reversal.Comment != "mistake" || len(reversal.Postings) != 2 {
+		t.Errorf("reversal entry = %+v, want reversal of %d with comment", reversal, entryID)
+	}
+	if reversal.Postings[0].Account != ledger.UserAccount(alice) || reversal.Postings[0].Amount != -0.1 {
+		t.Errorf("reversal postings = %+v, want user account debited by 0.1", reversal.Postings)
+	}
+	assertLedgerConsistent(t, s)
+}
+
+func testLedgerOrder(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+
+	accrue(t, s, alice, "12345678903", 30)
+	accrue(t, s, bob, "2377225624", 5)
+	if err := s.Withdraw(ctx, alice, "49927398716", 10); err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+	if _, err := s.PostLedgerEntry(ctx, ledger.Adjustment(alice, -5, "")); err != nil {
+		t.Fatalf("PostLedgerEntry: %v", err)
+	}
+
+	// только проводки пользователя, в порядке записи
+	entries, err := s.GetLedgerEntries(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetLedgerEntries: %v", err)
+	}
+	want := []schema.LedgerEntryKind{schema.LedgerEntryAccrual, schema.LedgerEntryWithdrawal, schema.LedgerEntryAdjustment}
+	if len(entries) != len(want) {
+		t.Fatalf("GetLedgerEntries = %+v, want %v", entries, want)
+	}
+	for i, entry := range entries {
+		if entry.Kind != want[i] {
+			t.Errorf("entry %d kind = %s, want %s", i, entry.Kind, want[i])
+		}
+		if i > 0 && (entry.ID <= entries[i-1].ID || entry.CreatedAt.Before(entries[i-1].CreatedAt.Time)) {
+			t.Errorf("entry %d (%d at %v) is recorded before entry %d (%d at %v)",
+				i, entry.ID, entry.CreatedAt, i-1, entries[i-1].ID, entries[i-1].CreatedAt)
+		}
+	}
+	if entries[0].OrderNumber != "12345678903" || entries[1].OrderNumber != "49927398716" {
+		t.Errorf("GetLedgerEntries = %+v, want order numbers of accrual and withdrawal", entries)
+	}
+	assertBalance(t, s, alice, 15, 10)
+	assertBalance(t, s, bob, 5, 0)
+	assertLedgerConsistent(t, s)
+}
+
+func testCreditLots(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	future := time.Now().Add(time.Hour)
+
+	if lots, err := s.GetCreditLots(ctx, alice, future); err != nil || len(lots) != 0 {
+		t.Errorf("GetCreditLots without accruals = %+v, %v, want empty result without error", lots, err)
+	}
+	if users, err := s.GetExpiringUsers(ctx, future, 0, 10); err != nil || len(users) != 0 {
+		t.Errorf("GetExpiringUsers without lots = %v, %v, want none", users, err)
+	}
+	if expired, err := s.ExpireUserCreditLots(ctx, alice, future); err != nil || expired {
+		t.Errorf("ExpireUserCreditLots without lots = %v, %v, want false", expired, err)
+	}
+
+	// две партии с разным временем начисления, списание расходует сначала старую
+	accrue(t, s, alice, "12345678903", 100)
+	time.Sleep(10 * time.Millisecond)
+	accrue(t, s, alice, "2377225624", 50)
+	if err := s.Withdraw(ctx, alice, "49927398716", 30); err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+	lots, err := s.GetCreditLots(ctx, alice, future)
+	if err != nil {
+		t.Fatalf("GetCreditLots: %v", err)
+	}
+	if len(lots) != 2 || lots[0].Remaining != 70 || lots[1].Remaining != 50 || !lots[0].CreditedAt.Before(lots[1].CreditedAt) {
+		t.Fatalf("GetCreditLots = %+v, want 70 left of the older lot and 50 of the newer", lots)
+	}
+
+	// граница включительная; время берется из самих партий, чтобы не зависеть от часов БД
+	older := lots[0].CreditedAt
+	lots, err = s.GetCreditLots(ctx, alice, older)
+	if err != nil || len(lots) != 1 || lots[0].Remaining != 70 {
+		t.Errorf("GetCreditLots up to the older lot = %+v, %v, want only the older lot", lots, err)
+	}
+	users, err := s.GetExpiringUsers(ctx, older, 0, 10)
+	if err != nil || len(users) != 1 || users[0] != alice {
+		t.Fatalf("GetExpiringUsers = %v, %v, want [%d]", users, err, alice)
+	}
+	expired, err := s.ExpireUserCreditLots(ctx, alice, older)
+	if err != nil || !expired {
+		t.Fatalf("ExpireUserCreditLots = %v, %v, want true", expired, err)
+	}
+	assertBalance(t, s, alice, 50, 30)
+	if users, err := s.GetExpiringUsers(ctx, older, 0, 10); err != nil || len(users) != 0 {
+		t.Errorf("GetExpiringUsers after expiration = %v, %v, want none", users, err)
+	}
+	if expired, err := s.ExpireUserCreditLots(ctx, alice, older); err != nil || expired {
+		t.Errorf("ExpireUserCreditLots again = %v, %v, want false", expired, err)
+	}
+	lots, err = s.GetCreditLots(ctx, alice, future)
+	if err != nil || len(lots) != 1 || lots[0].Remaining != 50 {
+		t.Errorf("GetCreditLots after expiration = %+v, %v, want only the newer lot", lots, err)
+	}
+
+	entries, err := s.GetLedgerEntries(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetLedgerEntries: %v", err)
+	}
+	last := entries[len(entries)-1]
+	if last.Kind != schema.LedgerEntryExpiration || last.Postings[0].Amount != -70 {
+		t.Errorf("last ledger entry = %+v, want expiration of 70", last)
+	}
+
+	// сторно начисления расходует в первую очередь партию самого начисления
+	accrue(t, s, alice, "79927398713", 20)
+	entries, err = s.GetLedgerEntries(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetLedgerEntries: %v", err)
+	}
+	if _, err := s.ReverseLedgerEntry(ctx, entries[len(entries)-1].ID, ""); err != nil {
+		t.Fatalf("ReverseLedgerEntry: %v", err)
+	}
+	lots, err = s.GetCreditLots(ctx, alice, future)
+	if err != nil || len(lots) != 1 || lots[0].Remaining != 50 {
+		t.Errorf("GetCreditLots after reversal = %+v, %v, want the reversed lot spent", lots, err)
+	}
+
+	// пользователи выбираются по возрастанию id, не больше limit, после afterUserID
+	bob := newUser(t, s, "bob")
+	accrue(t, s, bob, "5555555555554444", 10)
+	users, err = s.GetExpiringUsers(ctx, future, 0, 1)
+	if err != nil || len(users) != 1 || users[0] != alice {
+		t.Errorf("GetExpiringUsers with limit 1 = %v, %v, want [%d]", users, err, alice)
+	}
+	users, err = s.GetExpiringUsers(ctx, future, alice, 10)
+	if err != nil || len(users) != 1 || users[0] != bob {
+		t.Errorf("GetExpiringUsers after %d = %v, %v, want [%d]", alice, users, err, bob)
+	}
+	for _, userID := range []uint16{alice, bob} {
+		if expired, err := s.ExpireUserCreditLots(ctx, userID, future); err != nil || !expired {
+			t.Errorf("ExpireUserCreditLots(%d) = %v, %v, want true", userID, expired, err)
+		}
+	}
+	assertBalance(t, s, alice, 0, 30)
+	assertBalance(t, s, bob, 0, 0)
+
+	// сумма партий не представима в float32, но сгорает точно вся
+	carol := newUser(t, s, "carol")
+	accrue(t, s, carol, "4111111111111111", 8000000.5)
+	accrue(t, s, carol, "378282246310005", 1000000.25)
+	if expired, err := s.ExpireUserCreditLots(ctx, carol, future); err != nil || !expired {
+		t.Errorf("ExpireUserCreditLots(%d) = %v, %v, want true", carol, expired, err)
+	}
+	assertBalance(t, s, carol, 0, 0)
+	if lots, err := s.GetCreditLots(ctx, carol, future); err != nil || len(lots) != 0 {
+		t.Errorf("GetCreditLots after precise expiration = %+v, %v, want none", lots, err)
+	}
+	assertLedgerConsistent(t, s)
+}
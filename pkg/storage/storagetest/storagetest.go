@@ -0,0 +1,334 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+)
+
+// Общий набор поведенческих тестов storage.Storage. Каждая реализация хранилища запускает его
+// из своих тестов, передавая фабрику пустых хранилищ:
+//
+//	func TestStorage(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storage { ... })
+//	}
+//
+// тесты описывают контракт интерфейса: какие вызовы возвращают errorapp.ErrEmptyResult,
+// какие ошибки означают повтор и недопустимую операцию, как меняются баланс, журнал и очереди
+
+// возвращает хранилище с пустой БД актуальной схемы; ресурсы освобождаются через t.Cleanup
+type Factory func(t *testing.T) storage.Storage
+
+// запускает все тесты набора, каждый на новом хранилище
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.Storage)
+	}{
+		{"Users", testUsers},
+		{"Orders", testOrders},
+		{"OrderStatus", testOrderStatus},
+		{"Withdraw", testWithdraw},
+		{"BonusFlow", testBonusFlow},
+		{"CancelOrder", testCancelOrder},
+		{"Ledger", testLedger},
+		{"LedgerOrder", testLedgerOrder},
+		{"CreditLots", testCreditLots},
+		{"AccrualJobs", testAccrualJobs},
+		{"OrdersByStatus", testOrdersByStatus},
+		{"Webhooks", testWebhooks},
+		{"WebhookDeliveries", testWebhookDeliveries},
+		{"Events", testEvents},
+		{"UserEvents", testUserEvents},
+		{"ConcurrentWithdraw", testConcurrentWithdraw},
+		{"ConcurrentOrders", testConcurrentOrders},
+		{"ConcurrentClaims", testConcurrentClaims},
+		{"Migrations", testMigrations},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+func testUsers(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	if err := s.SetUser(ctx, "alice", "hash"); err != nil {
+		t.Fatalf("SetUser: %v", err)
+	}
+	if err := s.SetUser(ctx, "alice", "other"); !errors.Is(err, errorapp.ErrDuplicate) {
+		t.Errorf("SetUser duplicate login error = %v, want ErrDuplicate", err)
+	}
+	if err := s.SetUser(ctx, "bob", "hash"); err != nil {
+		t.Fatalf("SetUser: %v", err)
+	}
+
+	alice, err := s.GetUserID(ctx, "alice", "hash")
+	if err != nil {
+		t.Fatalf("GetUserID: %v", err)
+	}
+	bob, err := s.GetUserID(ctx, "bob", "hash")
+	if err != nil {
+		t.Fatalf("GetUserID: %v", err)
+	}
+	if alice == 0 || alice == bob {
+		t.Errorf("user ids alice = %d, bob = %d, want distinct non-zero", alice, bob)
+	}
+	if _, err := s.GetUserID(ctx, "alice", "wrong"); !errors.Is(err, errorapp.ErrWrongLoginPassword) {
+		t.Errorf("GetUserID wrong password error = %v, want ErrWrongLoginPassword", err)
+	}
+	if _, err := s.GetUserID(ctx, "nobody", "hash"); !errors.Is(err, errorapp.ErrWrongLoginPassword) {
+		t.Errorf("GetUserID unknown login error = %v, want ErrWrongLoginPassword", err)
+	}
+}
+
+func testOrders(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+
+	if _, err := s.GetOrders(ctx, alice); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetOrders without orders error = %v, want ErrEmptyResult", err)
+	}
+	if err := s.SetOrder(ctx, alice, "12345678903"); err != nil {
+		t.Fatalf("SetOrder: %v", err)
+	}
+	if err := s.SetOrder(ctx, alice, "12345678903"); !errors.Is(err, errorapp.ErrDuplicate) {
+		t.Errorf("SetOrder same user error = %v, want ErrDuplicate", err)
+	}
+	if err := s.SetOrder(ctx, bob, "12345678903"); !errors.Is(err, errorapp.ErrDuplicate) {
+		t.Errorf("SetOrder other user error = %v, want ErrDuplicate", err)
+	}
+
+	owner, err := s.GetUserIDfromOrders(ctx, "12345678903")
+	if err != nil || owner != alice {
+		t.Errorf("GetUserIDfromOrders = %d, %v, want %d", owner, err, alice)
+	}
+	if _, err := s.GetUserIDfromOrders(ctx, "0"); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetUserIDfromOrders unknown error = %v, want ErrEmptyResult", err)
+	}
+
+	// заказ попадает в список пользователя со своим первым статусом
+	setStatus(t, s, "12345678903", schema.StatusOrderNew, 0)
+	setOrder(t, s, alice, "2377225624", schema.StatusOrderNew)
+	orders, err := s.GetOrders(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetOrders: %v", err)
+	}
+	if len(orders) != 2 || orders[0].Number != "12345678903" || orders[1].Number != "2377225624" {
+		t.Fatalf("GetOrders = %+v, want both orders in upload order", orders)
+	}
+	for _, order := range orders {
+		if order.Status != string(schema.StatusOrderNew) || order.UploadedAt.IsZero() {
+			t.Errorf("order %+v, want status NEW and upload time", order)
+		}
+	}
+	if _, err := s.GetOrders(ctx, bob); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetOrders of other user error = %v, want ErrEmptyResult", err)
+	}
+}
+
+func testOrderStatus(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	setOrder(t, s, alice, "12345678903", schema.StatusOrderNew)
+
+	if err := s.SetOrderStatus(ctx, "0", schema.StatusOrderNew, 0); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("SetOrderStatus unknown order error = %v, want ErrEmptyResult", err)
+	}
+	// ответ сервиса начислений по неизвестному заказу тоже ошибка, а не молчаливый пропуск
+	if err := s.SetOrderStatus(ctx, "0", schema.StatusOrderProcessed, 10); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("SetOrderStatus(PROCESSED) unknown order error = %v, want ErrEmptyResult", err)
+	}
+	if err := s.SetOrderStatus(ctx, "12345678903", schema.StatusOrderNew, 0); !errors.Is(err, errorapp.ErrDuplicate) {
+		t.Errorf("SetOrderStatus repeated status error = %v, want ErrDuplicate", err)
+	}
+	setStatus(t, s, "12345678903", schema.StatusOrderProcessing, 0)
+	setStatus(t, s, "12345678903", schema.StatusOrderProcessed, 729.98)
+	if err := s.SetOrderStatus(ctx, "12345678903", schema.StatusOrderProcessed, 729.98); !errors.Is(err, errorapp.ErrDuplicate) {
+		t.Errorf("SetOrderStatus repeated PROCESSED error = %v, want ErrDuplicate", err)
+	}
+	if err := s.SetOrderStatus(ctx, "12345678903", schema.StatusOrderInvalid, 0); !errors.Is(err, errorapp.ErrInvalidTransition) {
+		t.Errorf("SetOrderStatus from final status error = %v, want ErrInvalidTransition", err)
+	}
+
+	orders, err := s.GetOrders(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetOrders: %v", err)
+	}
+	if len(orders) != 1 || orders[0].Status != string(schema.StatusOrderProcessed) || orders[0].Accrual != 729.98 {
+		t.Errorf("GetOrders = %+v, want PROCESSED with accrual 729.98", orders)
+	}
+	// начисление записывается один раз, несмотря на повтор статуса
+	assertBalance(t, s, alice, 729.98, 0)
+
+	processed, err := s.GetOrdersByStatus(ctx, schema.StatusOrderProcessed)
+	if err != nil || len(processed) != 1 || processed[0].Number != "12345678903" {
+		t.Errorf("GetOrdersByStatus(PROCESSED) = %+v, %v, want the order", processed, err)
+	}
+	if _, err := s.GetOrdersByStatus(ctx, schema.StatusOrderProcessing); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetOrdersByStatus(PROCESSING) error = %v, want ErrEmptyResult: only the last status counts", err)
+	}
+}
+
+func testWithdraw(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+
+	// баланса еще нет: нулевой баланс без ошибки
+	assertBalance(t, s, alice, 0, 0)
+	if _, err := s.GetBonusFlow(ctx, alice); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetBonusFlow without withdrawals error = %v, want ErrEmptyResult", err)
+	}
+	if err := s.Withdraw(ctx, alice, "2377225624", 1); !errors.Is(err, errorapp.ErrNotEnoughFunds) {
+		t.Errorf("Withdraw from empty balance error = %v, want ErrNotEnoughFunds", err)
+	}
+
+	accrue(t, s, alice, "12345678903", 500)
+	if err := s.Withdraw(ctx, alice, "2377225624", 100.5); err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+	if err := s.Withdraw(ctx, alice, "49927398716", 399.6); !errors.Is(err, errorapp.ErrNotEnoughFunds) {
+		t.Errorf("Withdraw over balance error = %v, want ErrNotEnoughFunds", err)
+	}
+	if err := s.Withdraw(ctx, alice, "49927398716", 399.5); err != nil {
+		t.Fatalf("Withdraw whole balance: %v", err)
+	}
+	assertBalance(t, s, alice, 0, 500)
+
+	withdrawals, err := s.GetBonusFlow(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetBonusFlow: %v", err)
+	}
+	if len(withdrawals) != 2 {
+		t.Fatalf("GetBonusFlow = %+v, want 2 withdrawals without accruals", withdrawals)
+	}
+	if withdrawals[0].Order != "2377225624" || withdrawals[0].Sum != 100.5 || withdrawals[1].Order != "49927398716" {
+		t.Errorf("GetBonusFlow = %+v, want withdrawals in processing order with positive sums", withdrawals)
+	}
+	if withdrawals[0].ProcessedAt.After(withdrawals[1].ProcessedAt.Time) {
+		t.Errorf("GetBonusFlow is not ordered by processing time: %+v", withdrawals)
+	}
+	assertLedgerConsistent(t, s)
+}
+
+func testBonusFlow(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+
+	// положительная сумма - начисление, отрицательная - списание, в истории только списания
+	if err := s.SetBonusFlow(ctx, alice, "12345678903", 10); err != nil {
+		t.Fatalf("SetBonusFlow: %v", err)
+	}
+	if err := s.SetBonusFlow(ctx, alice, "2377225624", -4); err != nil {
+		t.Fatalf("SetBonusFlow: %v", err)
+	}
+	if err := s.SetBonusFlow(ctx, alice, "49927398716", 0); err != nil {
+		t.Fatalf("SetBonusFlow zero amount: %v", err)
+	}
+	assertBalance(t, s, alice, 6, 4)
+	withdrawals, err := s.GetBonusFlow(ctx, alice)
+	if err != nil || len(withdrawals) != 1 || withdrawals[0].Order != "2377225624" || withdrawals[0].Sum != 4 {
+		t.Errorf("GetBonusFlow = %+v, %v, want the withdrawal of 4", withdrawals, err)
+	}
+	entries, err := s.GetLedgerEntries(ctx, alice)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("GetLedgerEntries = %+v, %v, want 2 entries: zero amount is not posted", entries, err)
+	}
+
+	// сторнированное списание возвращает баллы и пропадает из истории списаний
+	if _, err := s.ReverseLedgerEntry(ctx, entries[1].ID, "refund"); err != nil {
+		t.Fatalf("ReverseLedgerEntry: %v", err)
+	}
+	assertBalance(t, s, alice, 10, 0)
+	if _, err := s.GetBonusFlow(ctx, alice); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetBonusFlow after reversal error = %v, want ErrEmptyResult", err)
+	}
+	assertLedgerConsistent(t, s)
+}
+
+func testCancelOrder(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+
+	if _, err := s.CancelOrder(ctx, "0", "", schema.CancelPolicyNegative); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("CancelOrder unknown order error = %v, want ErrEmptyResult", err)
+	}
+
+	// заказ без начисления отменяется без возврата и уходит из очереди опроса
+	setOrder(t, s, alice, "12345678903", schema.StatusOrderNew)
+	result, err := s.CancelOrder(ctx, "12345678903", "fraud", schema.CancelPolicyNegative)
+	if err != nil {
+		t.Fatalf("CancelOrder: %v", err)
+	}
+	if result.Order != "12345678903" || result.Status != schema.StatusOrderCancelled || result.Reversed != 0 {
+		t.Errorf("CancelOrder = %+v, want cancelled without reversal", result)
+	}
+	if depth, err := s.GetAccrualQueueDepth(ctx); err != nil || depth != 0 {
+		t.Errorf("GetAccrualQueueDepth = %d, %v, want 0 after cancel", depth, err)
+	}
+	if _, err := s.CancelOrder(ctx, "12345678903", "", schema.CancelPolicyNegative); !errors.Is(err, errorapp.ErrAlreadyCancelled) {
+		t.Errorf("CancelOrder twice error = %v, want ErrAlreadyCancelled", err)
+	}
+	if err := s.SetOrderStatus(ctx, "12345678903", schema.StatusOrderProcessed, 10); !errors.Is(err, errorapp.ErrAlreadyCancelled) {
+		t.Errorf("SetOrderStatus of cancelled order error = %v, want ErrAlreadyCancelled", err)
+	}
+	orders, err := s.GetOrders(ctx, alice)
+	if err != nil || len(orders) != 1 || orders[0].Status != string(schema.StatusOrderCancelled) {
+		t.Errorf("GetOrders = %+v, %v, want the cancelled order", orders, err)
+	}
+
+	// negative: начисление сторнируется целиком, баланс может уйти в минус
+	accrue(t, s, alice, "2377225624", 100)
+	if err := s.Withdraw(ctx, alice, "1", 80); err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+	result, err = s.CancelOrder(ctx, "2377225624", "", schema.CancelPolicyNegative)
+	if err != nil || result.Reversed != 100 {
+		t.Errorf("CancelOrder negative = %+v, %v, want 100 reversed", result, err)
+	}
+	assertBalance(t, s, alice, -80, 80)
+
+	// clawback: возвращается только остаток на балансе
+	bob := newUser(t, s, "bob")
+	accrue(t, s, bob, "49927398716", 100)
+	if err := s.Withdraw(ctx, bob, "2", 80); err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+	result, err = s.CancelOrder(ctx, "49927398716", "", schema.CancelPolicyClawback)
+	if err != nil || result.Reversed != 20 {
+		t.Errorf("CancelOrder clawback = %+v, %v, want 20 reversed", result, err)
+	}
+	assertBalance(t, s, bob, 0, 80)
+
+	// clawback при пустом балансе ничего не возвращает, но заказ отменяется
+	accrue(t, s, bob, "79927398713", 50)
+	if err := s.Withdraw(ctx, bob, "3", 50); err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+	result, err = s.CancelOrder(ctx, "79927398713", "", schema.CancelPolicyClawback)
+	if err != nil || result.Reversed != 0 || result.Status != schema.StatusOrderCancelled {
+		t.Errorf("CancelOrder clawback of empty balance = %+v, %v, want cancelled with nothing reversed", result, err)
+	}
+	assertBalance(t, s, bob, 0, 130)
+	assertLedgerConsistent(t, s)
+}
+
+func testMigrations(t *testing.T, s storage.Storage) {
+	if err := s.Ping(context.Background()); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+	status, err := s.GetMigrationStatus(context.Background())
+	if err != nil {
+		t.Fatalf("GetMigrationStatus: %v", err)
+	}
+	if status.Dirty || status.Expected == 0 || status.Version != status.Expected {
+		t.Errorf("GetMigrationStatus = %+v, want up to date schema", status)
+	}
+}
@@ -0,0 +1,187 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bubu256/gophermart_pet/internal/errorapp"
+	"github.com/bubu256/gophermart_pet/internal/schema"
+	"github.com/bubu256/gophermart_pet/pkg/storage"
+)
+
+func testWebhooks(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+
+	if _, err := s.GetWebhookEndpoints(ctx); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetWebhookEndpoints without endpoints error = %v, want ErrEmptyResult", err)
+	}
+	all, err := s.CreateWebhookEndpoint(ctx, schema.WebhookEndpoint{URL: "http://all.example", Secret: "s1"})
+	if err != nil {
+		t.Fatalf("CreateWebhookEndpoint: %v", err)
+	}
+	withdrawals, err := s.CreateWebhookEndpoint(ctx, schema.WebhookEndpoint{
+		URL: "http://withdrawals.example", Secret: "s2", EventTypes: []schema.WebhookEventType{schema.WebhookEventPointsWithdrawn},
+	})
+	if err != nil {
+		t.Fatalf("CreateWebhookEndpoint: %v", err)
+	}
+	if all.ID == 0 || all.ID == withdrawals.ID || all.CreatedAt.IsZero() {
+		t.Errorf("created endpoints %+v, %+v, want distinct ids and creation time", all, withdrawals)
+	}
+	endpoints, err := s.GetWebhookEndpoints(ctx)
+	if err != nil || len(endpoints) != 2 {
+		t.Fatalf("GetWebhookEndpoints = %+v, %v, want 2 endpoints", endpoints, err)
+	}
+	if endpoints[0].Secret != "" || len(endpoints[0].EventTypes) != 0 || len(endpoints[1].EventTypes) != 1 {
+		t.Errorf("GetWebhookEndpoints = %+v, want no secrets and stored event types", endpoints)
+	}
+
+	// начисление доставляется только получателю всех событий, списание - обоим
+	accrue(t, s, alice, "12345678903", 100)
+	if err := s.Withdraw(ctx, alice, "2377225624", 40); err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+	deliveries, err := s.ClaimWebhookDeliveries(ctx, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimWebhookDeliveries: %v", err)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("ClaimWebhookDeliveries = %+v, want 3 deliveries", deliveries)
+	}
+	for _, d := range deliveries {
+		if d.Attempts != 1 || d.Status != schema.WebhookDeliveryPending || d.Secret == "" || len(d.Payload) == 0 {
+			t.Errorf("claimed delivery %+v, want first attempt with secret and payload", d)
+		}
+	}
+	if deliveries[0].EventType != schema.WebhookEventOrderAccrued || deliveries[0].EndpointID != all.ID {
+		t.Errorf("first delivery %+v, want order.accrued to the endpoint of all events", deliveries[0])
+	}
+	// захваченные доставки не выдаются повторно до истечения захвата
+	again, err := s.ClaimWebhookDeliveries(ctx, 10, time.Minute)
+	if err != nil || len(again) != 0 {
+		t.Errorf("ClaimWebhookDeliveries during lease = %+v, %v, want nothing", again, err)
+	}
+
+	if err := s.DeleteWebhookEndpoint(ctx, withdrawals.ID); err != nil {
+		t.Fatalf("DeleteWebhookEndpoint: %v", err)
+	}
+	if err := s.DeleteWebhookEndpoint(ctx, withdrawals.ID); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("DeleteWebhookEndpoint twice error = %v, want ErrEmptyResult", err)
+	}
+	if _, err := s.GetWebhookDeliveries(ctx, schema.WebhookDeliveryPending, 10); err != nil {
+		t.Errorf("GetWebhookDeliveries(PENDING): %v", err)
+	}
+}
+
+func testWebhookDeliveries(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	endpoint, err := s.CreateWebhookEndpoint(ctx, schema.WebhookEndpoint{URL: "http://hook.example", Secret: "secret"})
+	if err != nil {
+		t.Fatalf("CreateWebhookEndpoint: %v", err)
+	}
+	if _, err := s.GetWebhookDeliveries(ctx, schema.WebhookDeliveryPending, 10); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetWebhookDeliveries without events error = %v, want ErrEmptyResult", err)
+	}
+	accrue(t, s, alice, "12345678903", 100)
+	accrue(t, s, alice, "2377225624", 50)
+
+	claim := func() []schema.WebhookDelivery {
+		t.Helper()
+		deliveries, err := s.ClaimWebhookDeliveries(ctx, 10, time.Minute)
+		if err != nil {
+			t.Fatalf("ClaimWebhookDeliveries: %v", err)
+		}
+		return deliveries
+	}
+	deliveries := claim()
+	if len(deliveries) != 2 || deliveries[0].EventID >= deliveries[1].EventID {
+		t.Fatalf("ClaimWebhookDeliveries = %+v, want 2 deliveries in event order", deliveries)
+	}
+	first, second := deliveries[0], deliveries[1]
+	if first.URL != endpoint.URL || first.Secret != "secret" || first.EventType != schema.WebhookEventOrderAccrued || first.CreatedAt.IsZero() {
+		t.Errorf("claimed delivery %+v, want order.accrued to the endpoint with its secret", first)
+	}
+
+	// неудачная попытка возвращает доставку в очередь к назначенному времени
+	past := time.Now().Add(-time.Minute)
+	if err := s.FailWebhookDelivery(ctx, first.ID, past, "status 500", false); err != nil {
+		t.Fatalf("FailWebhookDelivery: %v", err)
+	}
+	deliveries = claim()
+	if len(deliveries) != 1 || deliveries[0].ID != first.ID || deliveries[0].Attempts != 2 || deliveries[0].LastError != "status 500" {
+		t.Fatalf("ClaimWebhookDeliveries after failure = %+v, want the second attempt of the failed delivery", deliveries)
+	}
+
+	// последняя попытка переводит доставку в FAILED, такие доставки не захватываются
+	if err := s.FailWebhookDelivery(ctx, first.ID, past, "status 502", true); err != nil {
+		t.Fatalf("FailWebhookDelivery: %v", err)
+	}
+	if err := s.FailWebhookDelivery(ctx, second.ID, past, "timeout", true); err != nil {
+		t.Fatalf("FailWebhookDelivery: %v", err)
+	}
+	if deliveries := claim(); len(deliveries) != 0 {
+		t.Errorf("ClaimWebhookDeliveries = %+v, want no failed deliveries", deliveries)
+	}
+	failed, err := s.GetWebhookDeliveries(ctx, schema.WebhookDeliveryFailed, 10)
+	if err != nil || len(failed) != 2 {
+		t.Fatalf("GetWebhookDeliveries(FAILED) = %+v, %v, want 2 deliveries", failed, err)
+	}
+	if failed[0].ID != second.ID || failed[0].Secret != "" || failed[0].LastError != "timeout" || len(failed[0].Payload) == 0 {
+		t.Errorf("GetWebhookDeliveries(FAILED) = %+v, want latest first, without secret", failed)
+	}
+	if limited, err := s.GetWebhookDeliveries(ctx, schema.WebhookDeliveryFailed, 1); err != nil || len(limited) != 1 {
+		t.Errorf("GetWebhookDeliveries limit 1 = %+v, %v, want 1 delivery", limited, err)
+	}
+
+	// повтор одной доставки, затем всех неудачных доставок получателя
+	replayed, err := s.ReplayWebhookDeliveries(ctx, first.ID, 0)
+	if err != nil || replayed != 1 {
+		t.Errorf("ReplayWebhookDeliveries(delivery) = %d, %v, want 1", replayed, err)
+	}
+	if replayed, err := s.ReplayWebhookDeliveries(ctx, first.ID, 0); err != nil || replayed != 0 {
+		t.Errorf("ReplayWebhookDeliveries of pending delivery = %d, %v, want 0 without error", replayed, err)
+	}
+	replayed, err = s.ReplayWebhookDeliveries(ctx, 0, endpoint.ID)
+	if err != nil || replayed != 1 {
+		t.Errorf("ReplayWebhookDeliveries(endpoint) = %d, %v, want 1", replayed, err)
+	}
+	// у получателя не осталось неудачных доставок - это не ошибка, в отличие от неизвестного получателя
+	if replayed, err := s.ReplayWebhookDeliveries(ctx, 0, endpoint.ID); err != nil || replayed != 0 {
+		t.Errorf("ReplayWebhookDeliveries(endpoint) without failed deliveries = %d, %v, want 0 without error", replayed, err)
+	}
+	if _, err := s.ReplayWebhookDeliveries(ctx, 0, endpoint.ID+1000); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("ReplayWebhookDeliveries of unknown endpoint error = %v, want ErrEmptyResult", err)
+	}
+	if _, err := s.ReplayWebhookDeliveries(ctx, second.ID+1000, 0); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("ReplayWebhookDeliveries of unknown delivery error = %v, want ErrEmptyResult", err)
+	}
+	deliveries = claim()
+	if len(deliveries) != 2 || deliveries[0].Attempts != 1 || deliveries[0].LastError != "" {
+		t.Fatalf("ClaimWebhookDeliveries after replay = %+v, want both deliveries from the first attempt", deliveries)
+	}
+
+	for _, d := range deliveries {
+		if err := s.CompleteWebhookDelivery(ctx, d.ID); err != nil {
+			t.Fatalf("CompleteWebhookDelivery: %v", err)
+		}
+	}
+	delivered, err := s.GetWebhookDeliveries(ctx, schema.WebhookDeliveryDelivered, 10)
+	if err != nil || len(delivered) != 2 {
+		t.Errorf("GetWebhookDeliveries(DELIVERED) = %+v, %v, want 2 deliveries", delivered, err)
+	}
+	if _, err := s.GetWebhookDeliveries(ctx, schema.WebhookDeliveryFailed, 10); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetWebhookDeliveries(FAILED) error = %v, want ErrEmptyResult", err)
+	}
+
+	// доставки удаляются вместе с получателем
+	if err := s.DeleteWebhookEndpoint(ctx, endpoint.ID); err != nil {
+		t.Fatalf("DeleteWebhookEndpoint: %v", err)
+	}
+	if _, err := s.GetWebhookDeliveries(ctx, schema.WebhookDeliveryDelivered, 10); !errors.Is(err, errorapp.ErrEmptyResult) {
+		t.Errorf("GetWebhookDeliveries after endpoint deletion error = %v, want ErrEmptyResult", err)
+	}
+}